@@ -0,0 +1,37 @@
+package goloader
+
+import (
+	"cmd/objfile/buildid"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var hostBuildID struct {
+	once sync.Once
+	id   string
+	err  error
+}
+
+// HostBuildID returns the Go build ID of the running executable. Anything derived from the host's symbol table
+// (cached archives, pre-linked images) is only valid for the binary with this exact build ID.
+func HostBuildID() (string, error) {
+	hostBuildID.once.Do(func() {
+		path, err := os.Executable()
+		if err != nil {
+			hostBuildID.err = fmt.Errorf("could not find executable path: %w", err)
+			return
+		}
+		id, err := buildid.ReadFile(path)
+		if err != nil {
+			hostBuildID.err = fmt.Errorf("could not read build ID of %s: %w", path, err)
+			return
+		}
+		if id == "" {
+			hostBuildID.err = fmt.Errorf("executable %s has no build ID", path)
+			return
+		}
+		hostBuildID.id = id
+	})
+	return hostBuildID.id, hostBuildID.err
+}
@@ -0,0 +1,88 @@
+package goloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ErrModuleBusy is matched (with errors.Is) by the *ModuleBusyError returned by CodeModule.Unload if goroutines are
+// executing the module's code
+var ErrModuleBusy = errors.New("module is busy")
+
+// ModuleBusyError lists the goroutines executing a module's code, which would crash if it were unloaded
+type ModuleBusyError struct {
+	Goroutines []BusyGoroutine
+}
+
+// BusyGoroutine is a goroutine with frames from a module's code on its stack
+type BusyGoroutine struct {
+	ID        int64
+	Functions []string // The module's functions on the goroutine's stack, innermost first
+}
+
+func (e *ModuleBusyError) Error() string {
+	parts := make([]string, 0, len(e.Goroutines))
+	for _, g := range e.Goroutines {
+		parts = append(parts, fmt.Sprintf("goroutine %d (%s)", g.ID, strings.Join(g.Functions, ", ")))
+	}
+	return fmt.Sprintf("module is busy: %d goroutine(s) executing its code: %s", len(e.Goroutines), strings.Join(parts, "; "))
+}
+
+func (e *ModuleBusyError) Is(target error) bool {
+	return target == ErrModuleBusy
+}
+
+// busyGoroutines returns the goroutines with frames from the module's code on their stacks, found by unwinding every
+// goroutine's stack with the world stopped
+func (cm *CodeModule) busyGoroutines() []BusyGoroutine {
+	if cm.module == nil {
+		return nil
+	}
+	var busy []BusyGoroutine
+	for _, frame := range framesWithin(cm.module.text, cm.module.etext, nil) {
+		if len(busy) == 0 || busy[len(busy)-1].ID != frame.goid {
+			busy = append(busy, BusyGoroutine{ID: frame.goid})
+		}
+		g := &busy[len(busy)-1]
+		name := "unknown"
+		if f := runtime.FuncForPC(frame.pc); f != nil {
+			name = f.Name()
+		}
+		if len(g.Functions) == 0 || g.Functions[len(g.Functions)-1] != name {
+			g.Functions = append(g.Functions, name)
+		}
+	}
+	return busy
+}
+
+// Busy returns a *ModuleBusyError if any goroutines are executing the module's code, or nil if it's quiescent.
+// Goroutines may still enter the module afterwards through any of its functions or types still referenced by the host.
+func (cm *CodeModule) Busy() error {
+	if busy := cm.busyGoroutines(); len(busy) > 0 {
+		return &ModuleBusyError{Goroutines: busy}
+	}
+	return nil
+}
+
+// UnloadWait polls until no goroutines are executing the module's code, then unloads it with opts. If ctx is done
+// first, the module isn't unloaded and an error wrapping ctx.Err() is returned.
+func (cm *CodeModule) UnloadWait(ctx context.Context, opts ...UnloadOptFunc) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := cm.Unload(opts...)
+		var busyErr *ModuleBusyError
+		if !errors.As(err, &busyErr) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w while waiting to unload: %s", ctx.Err(), busyErr)
+		case <-ticker.C:
+		}
+	}
+}
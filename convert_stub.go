@@ -3,7 +3,11 @@
 
 package goloader
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
 
 func CanAttemptConversion(oldValue, newValue interface{}) bool {
 	return false
@@ -12,3 +16,20 @@ func CanAttemptConversion(oldValue, newValue interface{}) bool {
 func ConvertTypesAcrossModules(oldModule, newModule *CodeModule, oldValue, newValue interface{}) (res interface{}, err error) {
 	return nil, fmt.Errorf("not supported in this older Go version yet - requires backport")
 }
+
+type TypeMismatchError struct {
+	Expected    reflect.Type
+	Actual      reflect.Type
+	Differences []string
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("expected type %s but got %s:\n\t%s", e.Expected, e.Actual, strings.Join(e.Differences, "\n\t"))
+}
+
+func TypeMismatch(expected, actual reflect.Type) error {
+	if expected == actual {
+		return nil
+	}
+	return &TypeMismatchError{Expected: expected, Actual: actual, Differences: []string{fmt.Sprintf("expected %v, got %v", expected, actual)}}
+}
@@ -0,0 +1,272 @@
+//go:build go1.20 && !go1.23
+// +build go1.20,!go1.23
+
+package goloader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Coverage counter modes and granularities, see $GOROOT/src/internal/coverage/defs.go
+const (
+	covCtrModeSet         = 1
+	covCtrModeCount       = 2
+	covCtrModeAtomic      = 3
+	covCtrGranularityFunc = 2
+)
+
+// Layout of each function's counters, see $GOROOT/src/internal/coverage/defs.go
+const (
+	covNumCtrsOffset  = 0
+	covPkgIdOffset    = 1
+	covFuncIdOffset   = 2
+	covFirstCtrOffset = 3
+)
+
+// copy from $GOROOT/src/internal/coverage/rtcov/rtcov.go
+type covMetaBlob struct {
+	p                  *byte
+	len                uint32
+	hash               [16]byte
+	pkgPath            string
+	pkgID              int
+	counterMode        uint8
+	counterGranularity uint8
+}
+
+// Packages built with -cover register their meta-data blob here from their init function (via runtime.addCovMeta)
+//
+//go:linkname covMeta runtime.covMeta
+var covMeta struct {
+	metaList                   []covMetaBlob
+	pkgMap                     map[int]int
+	hardCodedListNeedsUpdating bool
+}
+
+//go:linkname addCovMeta runtime.addCovMeta
+func addCovMeta(p unsafe.Pointer, dlen uint32, hash [16]byte, pkgpath string, pkgid int, cmode uint8, cgran uint8) uint32
+
+// regCoverageSymbols makes sure runtime.addCovMeta, which the init functions of packages built with -cover call,
+// is linked into the host binary even if the host wasn't itself built with -cover
+func regCoverageSymbols(symPtr map[string]uintptr) {
+	if _, ok := symPtr["runtime.addCovMeta"]; !ok {
+		symPtr["runtime.addCovMeta"] = getFunctionPtr(addCovMeta)
+	}
+}
+
+func setCoverageCounters(module *moduledata, start, end uintptr) {
+	module.covctrs = start
+	module.ecovctrs = end
+}
+
+// coverageLock serialises reading modules' counters with unmapping them
+var coverageLock sync.Mutex
+
+// releaseCoverageMeta snapshots the module's coverage for Coverage to return once it's unloaded, and moves its
+// meta-data blobs (which the runtime never forgets) onto the heap before its data segment is unmapped, so that
+// runtime/coverage.WriteMeta doesn't read unmapped memory after the module is unloaded
+func releaseCoverageMeta(cm *CodeModule) {
+	coverageLock.Lock()
+	defer coverageLock.Unlock()
+	cm.finalCoverage, cm.finalCoverageErr = cm.readCoverage()
+	cm.coverageReleased = true
+	for i, blob := range covMeta.metaList {
+		if cm.inDataSegment(unsafe.Pointer(blob.p)) {
+			meta := make([]byte, blob.len)
+			copy(meta, unsafe.Slice(blob.p, blob.len))
+			covMeta.metaList[i].p = &meta[0]
+		}
+	}
+}
+
+func (cm *CodeModule) inDataSegment(p unsafe.Pointer) bool {
+	return cm.module != nil && uintptr(p) >= cm.module.data && uintptr(p) < cm.module.enoptrbss
+}
+
+// Coverage returns the current coverage counters of the module's packages which were built with -cover
+// (e.g. using jit.BuildConfig.Cover).
+// Since these packages also register with the host's runtime, they are also included in the files written by
+// runtime/coverage.WriteMetaDir and runtime/coverage.WriteCountersDir while the module is loaded.
+// Once the module has been unloaded, it returns the coverage at the time it was unloaded.
+func (cm *CodeModule) Coverage() (*Coverage, error) {
+	coverageLock.Lock()
+	defer coverageLock.Unlock()
+	if cm.coverageReleased {
+		return cm.finalCoverage, cm.finalCoverageErr
+	}
+	if cm.module == nil {
+		return nil, errors.New("module is not loaded")
+	}
+	return cm.readCoverage()
+}
+
+// readCoverage reads the module's counters, which must still be mapped
+func (cm *CodeModule) readCoverage() (*Coverage, error) {
+	type funcKey struct {
+		pkgID, funcID uint32
+	}
+	funcCounters := map[funcKey][]uint32{}
+	if cm.module.ecovctrs > cm.module.covctrs {
+		ctrs := unsafe.Slice((*uint32)(unsafe.Pointer(cm.module.covctrs)), (cm.module.ecovctrs-cm.module.covctrs)/4)
+		for i := 0; i < len(ctrs); i++ {
+			// Each executed function's counters are prefixed by a header, and zeroes are skipped until the next one
+			numCtrs := atomic.LoadUint32(&ctrs[i+covNumCtrsOffset])
+			if numCtrs == 0 {
+				continue
+			}
+			first := i + covFirstCtrOffset
+			if first+int(numCtrs) > len(ctrs) {
+				return nil, fmt.Errorf("malformed coverage counters at offset %d: %d counters overflow counter section", i, numCtrs)
+			}
+			key := funcKey{pkgID: atomic.LoadUint32(&ctrs[i+covPkgIdOffset]), funcID: atomic.LoadUint32(&ctrs[i+covFuncIdOffset])}
+			counts := make([]uint32, numCtrs)
+			for j := range counts {
+				counts[j] = atomic.LoadUint32(&ctrs[first+j])
+			}
+			funcCounters[key] = counts
+			i = first + int(numCtrs) - 1
+		}
+	}
+
+	coverage := &Coverage{}
+	for slot, blob := range covMeta.metaList {
+		if !cm.inDataSegment(unsafe.Pointer(blob.p)) {
+			continue
+		}
+		var mode string
+		switch blob.counterMode {
+		case covCtrModeSet:
+			mode = "set"
+		case covCtrModeCount:
+			mode = "count"
+		case covCtrModeAtomic:
+			mode = "atomic"
+		default:
+			return nil, fmt.Errorf("unsupported coverage counter mode %d in package %s", blob.counterMode, blob.pkgPath)
+		}
+		if coverage.Mode != "" && coverage.Mode != mode {
+			return nil, fmt.Errorf("package %s was built with -covermode=%s, but other packages with -covermode=%s", blob.pkgPath, mode, coverage.Mode)
+		}
+		coverage.Mode = mode
+
+		funcs, err := decodeCoverageMeta(unsafe.Slice(blob.p, blob.len))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode coverage meta-data of package %s: %w", blob.pkgPath, err)
+		}
+		// Packages are identified in their counters by the ID addCovMeta returned, unless their ID is hard coded
+		pkgID := uint32(slot + 1)
+		if blob.pkgID != -1 {
+			pkgID = uint32(blob.pkgID)
+		}
+		for funcID := range funcs {
+			counts := funcCounters[funcKey{pkgID: pkgID, funcID: uint32(funcID)}]
+			for i := range funcs[funcID].Blocks {
+				switch {
+				case len(counts) == 0:
+				case blob.counterGranularity == covCtrGranularityFunc:
+					funcs[funcID].Blocks[i].Count = counts[0]
+				case i < len(counts):
+					funcs[funcID].Blocks[i].Count = counts[i]
+				}
+			}
+		}
+		coverage.Packages = append(coverage.Packages, PackageCoverage{PkgPath: blob.pkgPath, Funcs: funcs})
+	}
+	if len(coverage.Packages) == 0 {
+		return nil, errors.New("module contains no packages built with -cover")
+	}
+	return coverage, nil
+}
+
+// covMetaHeaderSize is the size of a package's meta-data header (coverage.MetaSymbolHeader)
+const covMetaHeaderSize = 16 + 4 + 4 + 4 + 4 + 4 + 4 + 4
+
+// decodeCoverageMeta decodes the functions of a package's meta-data blob, as emitted by the compiler.
+// See $GOROOT/src/internal/coverage/decodemeta/decode.go
+func decodeCoverageMeta(meta []byte) ([]FuncCoverage, error) {
+	if len(meta) < covMetaHeaderSize {
+		return nil, fmt.Errorf("meta-data blob too short (%d bytes)", len(meta))
+	}
+	numFuncs := binary.LittleEndian.Uint32(meta[40:])
+	r := &covMetaReader{b: meta, off: covMetaHeaderSize + 4*int(numFuncs)}
+	if r.off > len(meta) {
+		return nil, fmt.Errorf("meta-data blob too short for %d functions", numFuncs)
+	}
+	numStrs := r.uleb128()
+	if numStrs > uint64(len(meta)) {
+		return nil, fmt.Errorf("malformed string table with %d entries", numStrs)
+	}
+	strs := make([]string, numStrs)
+	for i := range strs {
+		strs[i] = r.string(int(r.uleb128()))
+	}
+	str := func(idx uint64) string {
+		if idx >= uint64(len(strs)) {
+			r.err = fmt.Errorf("string table index %d out of range", idx)
+			return ""
+		}
+		return strs[idx]
+	}
+
+	funcs := make([]FuncCoverage, numFuncs)
+	for i := range funcs {
+		r.off = int(binary.LittleEndian.Uint32(meta[covMetaHeaderSize+4*i:]))
+		numUnits := r.uleb128()
+		funcs[i].Name = str(r.uleb128())
+		funcs[i].File = str(r.uleb128())
+		for j := uint64(0); j < numUnits && r.err == nil; j++ {
+			funcs[i].Blocks = append(funcs[i].Blocks, CoverBlock{
+				StartLine: uint32(r.uleb128()),
+				StartCol:  uint32(r.uleb128()),
+				EndLine:   uint32(r.uleb128()),
+				EndCol:    uint32(r.uleb128()),
+				NumStmts:  uint32(r.uleb128()),
+			})
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	return funcs, nil
+}
+
+type covMetaReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *covMetaReader) uleb128() uint64 {
+	var value uint64
+	for shift := uint(0); r.err == nil; shift += 7 {
+		if r.off < 0 || r.off >= len(r.b) || shift >= 64 {
+			r.err = fmt.Errorf("malformed uleb128 at offset %d", r.off)
+			return 0
+		}
+		b := r.b[r.off]
+		r.off++
+		value |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return value
+}
+
+func (r *covMetaReader) string(length int) string {
+	if r.err != nil {
+		return ""
+	}
+	if r.off+length > len(r.b) {
+		r.err = fmt.Errorf("string of length %d at offset %d overflows meta-data blob", length, r.off)
+		return ""
+	}
+	s := string(r.b[r.off : r.off+length])
+	r.off += length
+	return s
+}
@@ -0,0 +1,46 @@
+package goloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Coverage is a snapshot of the coverage counters of the packages in a module which were built with -cover
+type Coverage struct {
+	Mode     string // "set", "count" or "atomic"
+	Packages []PackageCoverage
+}
+
+type PackageCoverage struct {
+	PkgPath string
+	Funcs   []FuncCoverage
+}
+
+type FuncCoverage struct {
+	Name   string
+	File   string
+	Blocks []CoverBlock
+}
+
+// CoverBlock is a coverable unit of source code, along with the number of times it was executed (0 or 1 in "set" mode)
+type CoverBlock struct {
+	StartLine, StartCol uint32
+	EndLine, EndCol     uint32
+	NumStmts            uint32
+	Count               uint32
+}
+
+// WriteProfile writes the coverage in the text format of 'go test -coverprofile', as read by 'go tool cover'
+func (c *Coverage) WriteProfile(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "mode: %s\n", c.Mode)
+	for _, pkg := range c.Packages {
+		for _, fn := range pkg.Funcs {
+			for _, b := range fn.Blocks {
+				_, _ = fmt.Fprintf(bw, "%s:%d.%d,%d.%d %d %d\n", fn.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmts, b.Count)
+			}
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,19 @@
+//go:build !go1.20
+// +build !go1.20
+
+package goloader
+
+import (
+	"errors"
+)
+
+func regCoverageSymbols(symPtr map[string]uintptr) {}
+
+func setCoverageCounters(module *moduledata, start, end uintptr) {}
+
+func releaseCoverageMeta(cm *CodeModule) {}
+
+// Coverage requires go1.20 or later, which introduced the coverage counters and meta-data it reads
+func (cm *CodeModule) Coverage() (*Coverage, error) {
+	return nil, errors.New("coverage of loaded modules requires go1.20 or later")
+}
@@ -0,0 +1,837 @@
+//go:build go1.18
+// +build go1.18
+
+package goloader
+
+import (
+	"bytes"
+	"cmd/objfile/dwarf"
+	"cmd/objfile/sys"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"github.com/eh-steve/goloader/obj"
+	"github.com/eh-steve/goloader/objabi/reloctype"
+	"github.com/eh-steve/goloader/objabi/symkind"
+)
+
+// Parameters of the line number programs generated by the compiler, see $GOROOT/src/cmd/internal/obj/dwarf.go
+const (
+	dwarfLineBase   = -4
+	dwarfLineRange  = 10
+	dwarfOpcodeBase = 11
+)
+
+const (
+	elfHeaderSize        = 64
+	elfSectionHeaderSize = 64
+)
+
+// dataAlignmentFactor as used by the Go linker for .debug_frame, see $GOROOT/src/cmd/link/internal/ld/dwarf.go
+const dataAlignmentFactor = -4
+
+type debugSection int
+
+const (
+	debugInfo debugSection = iota
+	debugAbbrev
+	debugLine
+	debugFrame
+	debugLoc
+	debugRanges
+	numDebugSections
+)
+
+var debugSectionNames = [numDebugSections]string{".debug_info", ".debug_abbrev", ".debug_line", ".debug_frame", ".debug_loc", ".debug_ranges"}
+
+// Abbreviations for the DIEs which the Go linker (rather than the compiler) generates - compilation units and types.
+// Their codes follow those of the compiler's abbreviations.
+const (
+	abbrevCompileUnit = iota
+	abbrevTypeUnit
+	abbrevBaseType
+	abbrevPointerType
+	abbrevVoidPointerType
+	abbrevStructType
+	abbrevMember
+	abbrevArrayType
+	abbrevSubrange
+	abbrevUnspecifiedType
+)
+
+type debugAbbrevEntry struct {
+	tag      uint64
+	children uint8
+	attrs    [][2]uint64 // Attribute and form
+}
+
+var debugAbbrevs = []debugAbbrevEntry{
+	abbrevCompileUnit: {dwarf.DW_TAG_compile_unit, dwarf.DW_CHILDREN_yes, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_language, dwarf.DW_FORM_data1},
+		{dwarf.DW_AT_stmt_list, dwarf.DW_FORM_sec_offset},
+		{dwarf.DW_AT_low_pc, dwarf.DW_FORM_addr},
+		{dwarf.DW_AT_ranges, dwarf.DW_FORM_sec_offset},
+		{dwarf.DW_AT_comp_dir, dwarf.DW_FORM_string},
+	}},
+	abbrevTypeUnit: {dwarf.DW_TAG_compile_unit, dwarf.DW_CHILDREN_yes, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_language, dwarf.DW_FORM_data1},
+	}},
+	abbrevBaseType: {dwarf.DW_TAG_base_type, dwarf.DW_CHILDREN_no, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_encoding, dwarf.DW_FORM_data1},
+		{dwarf.DW_AT_byte_size, dwarf.DW_FORM_udata},
+	}},
+	abbrevPointerType: {dwarf.DW_TAG_pointer_type, dwarf.DW_CHILDREN_no, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_type, dwarf.DW_FORM_ref_addr},
+	}},
+	abbrevVoidPointerType: {dwarf.DW_TAG_pointer_type, dwarf.DW_CHILDREN_no, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+	}},
+	abbrevStructType: {dwarf.DW_TAG_structure_type, dwarf.DW_CHILDREN_yes, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_byte_size, dwarf.DW_FORM_udata},
+	}},
+	abbrevMember: {dwarf.DW_TAG_member, dwarf.DW_CHILDREN_no, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_data_member_location, dwarf.DW_FORM_udata},
+		{dwarf.DW_AT_type, dwarf.DW_FORM_ref_addr},
+	}},
+	abbrevArrayType: {dwarf.DW_TAG_array_type, dwarf.DW_CHILDREN_yes, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+		{dwarf.DW_AT_byte_size, dwarf.DW_FORM_udata},
+		{dwarf.DW_AT_type, dwarf.DW_FORM_ref_addr},
+	}},
+	abbrevSubrange: {dwarf.DW_TAG_subrange_type, dwarf.DW_CHILDREN_no, [][2]uint64{
+		{dwarf.DW_AT_count, dwarf.DW_FORM_udata},
+	}},
+	abbrevUnspecifiedType: {dwarf.DW_TAG_unspecified_type, dwarf.DW_CHILDREN_no, [][2]uint64{
+		{dwarf.DW_AT_name, dwarf.DW_FORM_string},
+	}},
+}
+
+type debugSymOffset struct {
+	section debugSection
+	offset  int
+}
+
+type debugReloc struct {
+	section debugSection
+	offset  int
+	reloc   obj.Reloc
+}
+
+type debugFunc struct {
+	name string
+	sym  *obj.ObjSymbol
+	addr uintptr
+	size int
+	cu   int
+}
+
+// debugInfoBuilder concatenates the DWARF symbols emitted by the compiler for a module's functions into DWARF
+// sections, along with the compilation units, line program headers, frame descriptions and type DIEs which the Go
+// linker would normally generate
+type debugInfoBuilder struct {
+	linker     *Linker
+	symbolMap  map[string]uintptr
+	byteOrder  binary.ByteOrder
+	sections   [numDebugSections][]byte
+	offsets    map[string]debugSymOffset
+	relocs     []debugReloc
+	abbrevBase uint64
+	types      map[string]reflect.Type // Type DIEs to generate by DWARF symbol name, nil for types which aren't known
+	typeNames  map[reflect.Type]string
+	typeQueue  []string
+}
+
+// buildDebugInfo returns an ELF object holding the module's relocated DWARF, and symbols for its functions
+func (linker *Linker) buildDebugInfo(codeModule *CodeModule, symbolMap map[string]uintptr) ([]byte, error) {
+	var regSP, regRA uint64
+	switch linker.Arch.Family {
+	case sys.AMD64:
+		regSP, regRA = 7, 16
+	case sys.ARM64:
+		regSP, regRA = 31, 30
+	default:
+		return nil, fmt.Errorf("debug info is not supported on %s", linker.Arch.Name)
+	}
+	b := &debugInfoBuilder{
+		linker:    linker,
+		symbolMap: symbolMap,
+		byteOrder: linker.Arch.ByteOrder,
+		offsets:   make(map[string]debugSymOffset),
+		types:     make(map[string]reflect.Type),
+		typeNames: make(map[reflect.Type]string),
+	}
+	if err := b.writeAbbrevs(); err != nil {
+		return nil, err
+	}
+
+	cuNames := make([]string, len(linker.cuFiles))
+	cuByObjidx := make(map[uint32]int)
+	cu := 0
+	for _, pkg := range linker.pkgs {
+		cuByObjidx[pkg.Objidx] = cu
+		for range pkg.CUFiles {
+			cuNames[cu] = pkg.PkgPath
+			cu++
+		}
+	}
+
+	funcs := linker.textFuncs(symbolMap)
+
+	// Assign each function's info DIE to its compilation unit, along with the abstract function DIEs referenced by
+	// inlined calls, whose file numbers are relative to the unit of the package which emitted them
+	cuSyms := make([][]string, len(linker.cuFiles))
+	placed := make(map[string]struct{})
+	type pendingSym struct {
+		name string
+		cu   int
+	}
+	var queue []pendingSym
+	for _, f := range funcs {
+		queue = append(queue, pendingSym{f.sym.Func.DwarfInfo, f.cu})
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		objsym := linker.objsymbolMap[p.name]
+		if _, ok := placed[p.name]; ok || objsym == nil || len(cuSyms) == 0 {
+			continue
+		}
+		placed[p.name] = struct{}{}
+		cuSyms[p.cu] = append(cuSyms[p.cu], p.name)
+		for _, reloc := range objsym.Reloc {
+			if reloc.Type == reloctype.R_DWARFSECREF && strings.HasPrefix(reloc.Sym.Name, dwarf.InfoPrefix) {
+				if target := linker.objsymbolMap[reloc.Sym.Name]; target != nil {
+					targetCU, ok := cuByObjidx[target.Objidx]
+					if !ok {
+						targetCU = p.cu
+					}
+					queue = append(queue, pendingSym{reloc.Sym.Name, targetCU})
+				}
+			}
+		}
+	}
+
+	for _, f := range funcs {
+		b.appendSym(debugLoc, f.sym.Func.DwarfLoc)
+		b.appendSym(debugRanges, f.sym.Func.DwarfRanges)
+	}
+	for cu, syms := range cuSyms {
+		if len(syms) > 0 {
+			b.writeCompileUnit(cuNames[cu], linker.cuFiles[cu].Files, syms, funcs, cu)
+		}
+	}
+	b.writeTypeUnit()
+	b.writeFrames(funcs, regSP, regRA)
+	b.applyRelocs()
+	return b.writeELF(codeModule, funcs), nil
+}
+
+// textFuncs returns the module's functions sorted by address, with the compilation unit each belongs to
+func (linker *Linker) textFuncs(symbolMap map[string]uintptr) []debugFunc {
+	cuStarts := make([]int, len(linker.cuFiles))
+	cuOffset := 0
+	for i, cuFiles := range linker.cuFiles {
+		cuStarts[i] = cuOffset
+		cuOffset += len(cuFiles.Files)
+	}
+	var funcs []debugFunc
+	for name, sym := range linker.symMap {
+		objsym := linker.objsymbolMap[name]
+		if sym.Kind != symkind.STEXT || sym.Offset == InvalidOffset || objsym == nil || objsym.Func == nil {
+			continue
+		}
+		addr, ok := symbolMap[name]
+		if !ok {
+			continue
+		}
+		f := debugFunc{name: name, sym: objsym, addr: addr, size: len(objsym.Data)}
+		// The function's text may have been extended with relocation epilogues, which are covered by its pcsp table
+		if pcs, _ := readPCData(objsym.Func.PCSP, 0); len(pcs) > 0 {
+			f.size = int(pcs[len(pcs)-1])
+		}
+		f.cu = sort.Search(len(cuStarts), func(i int) bool { return cuStarts[i] > objsym.Func.CUOffset }) - 1
+		if f.cu < 0 {
+			f.cu = 0
+		}
+		funcs = append(funcs, f)
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].addr < funcs[j].addr })
+	return funcs
+}
+
+func (b *debugInfoBuilder) uint16(section debugSection, v uint16) {
+	var buf [2]byte
+	b.byteOrder.PutUint16(buf[:], v)
+	b.sections[section] = append(b.sections[section], buf[:]...)
+}
+
+func (b *debugInfoBuilder) uint32(section debugSection, v uint32) {
+	var buf [4]byte
+	b.byteOrder.PutUint32(buf[:], v)
+	b.sections[section] = append(b.sections[section], buf[:]...)
+}
+
+func (b *debugInfoBuilder) uint64(section debugSection, v uint64) {
+	var buf [8]byte
+	b.byteOrder.PutUint64(buf[:], v)
+	b.sections[section] = append(b.sections[section], buf[:]...)
+}
+
+func (b *debugInfoBuilder) uleb(section debugSection, v uint64) {
+	b.sections[section] = dwarf.AppendUleb128(b.sections[section], v)
+}
+
+func (b *debugInfoBuilder) sleb(section debugSection, v int64) {
+	b.sections[section] = dwarf.AppendSleb128(b.sections[section], v)
+}
+
+func (b *debugInfoBuilder) cstring(section debugSection, s string) {
+	b.sections[section] = append(append(b.sections[section], s...), 0)
+}
+
+// unitLength reserves a unit's initial length field, returning a func which fills it in once the unit is complete
+func (b *debugInfoBuilder) unitLength(section debugSection) func() {
+	start := len(b.sections[section])
+	b.uint32(section, 0)
+	return func() {
+		b.byteOrder.PutUint32(b.sections[section][start:], uint32(len(b.sections[section])-start-4))
+	}
+}
+
+// appendSym appends a DWARF symbol emitted by the compiler to a section, along with its relocations
+func (b *debugInfoBuilder) appendSym(section debugSection, name string) {
+	objsym := b.linker.objsymbolMap[name]
+	if _, ok := b.offsets[name]; ok || objsym == nil {
+		return
+	}
+	offset := len(b.sections[section])
+	b.offsets[name] = debugSymOffset{section, offset}
+	b.sections[section] = append(b.sections[section], objsym.Data...)
+	for _, reloc := range objsym.Reloc {
+		if reloc.Type == reloctype.R_DWARFSECREF && strings.HasPrefix(reloc.Sym.Name, dwarf.InfoPrefix) && b.linker.objsymbolMap[reloc.Sym.Name] == nil {
+			// The linker generates the DIEs of types
+			b.typeRef(reloc.Sym.Name)
+		}
+		reloc.Offset += offset
+		b.relocs = append(b.relocs, debugReloc{section, reloc.Offset, reloc})
+	}
+}
+
+// ref appends a reference to another DIE
+func (b *debugInfoBuilder) ref(name string) {
+	b.relocs = append(b.relocs, debugReloc{debugInfo, len(b.sections[debugInfo]), obj.Reloc{
+		Offset: len(b.sections[debugInfo]),
+		Sym:    &obj.Sym{Name: name},
+		Size:   Uint32Size,
+		Type:   reloctype.R_DWARFSECREF,
+	}})
+	b.uint32(debugInfo, 0)
+}
+
+func (b *debugInfoBuilder) writeAbbrevs() error {
+	abbrev := dwarf.GetAbbrev()
+	// Each abbreviation is its code, tag, children flag and attribute/form pairs up to a pair of zeroes, and the table
+	// ends with a zero code
+	for p := abbrev; ; {
+		code, n := binary.Uvarint(p)
+		if n <= 0 {
+			return errors.New("failed to parse compiler's DWARF abbreviations")
+		}
+		p = p[n:]
+		if code == 0 {
+			break
+		}
+		if code > b.abbrevBase {
+			b.abbrevBase = code
+		}
+		_, n = binary.Uvarint(p) // tag
+		if n <= 0 || len(p) < n+1 {
+			return errors.New("failed to parse compiler's DWARF abbreviations")
+		}
+		p = p[n+1:]
+		for {
+			attr, n1 := binary.Uvarint(p)
+			form, n2 := binary.Uvarint(p[n1:])
+			if n1 <= 0 || n2 <= 0 {
+				return errors.New("failed to parse compiler's DWARF abbreviations")
+			}
+			p = p[n1+n2:]
+			if attr == 0 && form == 0 {
+				break
+			}
+		}
+	}
+	b.sections[debugAbbrev] = append(b.sections[debugAbbrev], abbrev[:len(abbrev)-1]...)
+	for i, a := range debugAbbrevs {
+		b.uleb(debugAbbrev, b.abbrevBase+1+uint64(i))
+		b.uleb(debugAbbrev, a.tag)
+		b.sections[debugAbbrev] = append(b.sections[debugAbbrev], a.children)
+		for _, attr := range a.attrs {
+			b.uleb(debugAbbrev, attr[0])
+			b.uleb(debugAbbrev, attr[1])
+		}
+		b.sections[debugAbbrev] = append(b.sections[debugAbbrev], 0, 0)
+	}
+	b.sections[debugAbbrev] = append(b.sections[debugAbbrev], 0)
+	return nil
+}
+
+func (b *debugInfoBuilder) abbrev(a int) {
+	b.uleb(debugInfo, b.abbrevBase+1+uint64(a))
+}
+
+// unitHeader writes the header of a DWARF 4 compilation unit, returning a func to fill in its length
+func (b *debugInfoBuilder) unitHeader() func() {
+	setLength := b.unitLength(debugInfo)
+	b.uint16(debugInfo, 4)
+	b.uint32(debugInfo, 0) // .debug_abbrev offset
+	b.sections[debugInfo] = append(b.sections[debugInfo], PtrSize)
+	return setLength
+}
+
+// writeCompileUnit writes the unit's line program (a header for the unit's files, followed by its functions' line
+// programs) and range list, and its DIEs. The unit's base address is 0, so addresses relative to it are absolute.
+func (b *debugInfoBuilder) writeCompileUnit(name string, files []string, syms []string, funcs []debugFunc, cu int) {
+	stmtList := len(b.sections[debugLine])
+	setLineLength := b.unitLength(debugLine)
+	b.uint16(debugLine, 2)
+	headerStart := len(b.sections[debugLine])
+	b.uint32(debugLine, 0) // header_length
+	lineBase := int8(dwarfLineBase)
+	b.sections[debugLine] = append(b.sections[debugLine], 1, 1, uint8(lineBase), dwarfLineRange, dwarfOpcodeBase)
+	b.sections[debugLine] = append(b.sections[debugLine], 0, 1, 1, 1, 1, 0, 0, 0, 1, 0) // standard_opcode_lengths
+	b.sections[debugLine] = append(b.sections[debugLine], 0)                            // include_directories
+	for _, file := range files {
+		b.cstring(debugLine, expandGoroot(strings.TrimPrefix(file, FileSymPrefix)))
+		b.uleb(debugLine, 0) // directory
+		b.uleb(debugLine, 0) // modification time
+		b.uleb(debugLine, 0) // length
+	}
+	b.sections[debugLine] = append(b.sections[debugLine], 0)
+	b.byteOrder.PutUint32(b.sections[debugLine][headerStart:], uint32(len(b.sections[debugLine])-headerStart-4))
+
+	ranges := len(b.sections[debugRanges])
+	for _, f := range funcs {
+		if f.cu == cu {
+			b.appendSym(debugLine, f.sym.Func.DwarfLines)
+			b.uint64(debugRanges, uint64(f.addr))
+			b.uint64(debugRanges, uint64(f.addr)+uint64(f.size))
+		}
+	}
+	b.uint64(debugRanges, 0)
+	b.uint64(debugRanges, 0)
+	setLineLength()
+
+	setLength := b.unitHeader()
+	b.abbrev(abbrevCompileUnit)
+	b.cstring(debugInfo, name)
+	b.sections[debugInfo] = append(b.sections[debugInfo], dwarf.DW_LANG_Go)
+	b.uint32(debugInfo, uint32(stmtList))
+	b.uint64(debugInfo, 0) // low_pc
+	b.uint32(debugInfo, uint32(ranges))
+	b.cstring(debugInfo, ".")
+	for _, sym := range syms {
+		b.appendSym(debugInfo, sym)
+	}
+	b.sections[debugInfo] = append(b.sections[debugInfo], 0)
+	setLength()
+}
+
+// typeRef queues the generation of a type's DIE from its runtime type descriptor, given the name of the type's DWARF
+// symbol as referenced by the compiler
+func (b *debugInfoBuilder) typeRef(name string) string {
+	if _, ok := b.types[name]; !ok {
+		var t reflect.Type
+		if addr, ok := b.symbolMap[TypePrefix+strings.TrimPrefix(name, dwarf.InfoPrefix)]; ok && addr != 0 {
+			t = AsRType((*_type)(unsafe.Pointer(addr)))
+			if _, ok := b.typeNames[t]; !ok {
+				b.typeNames[t] = name
+			}
+		}
+		b.types[name] = t
+		b.typeQueue = append(b.typeQueue, name)
+	}
+	return name
+}
+
+// reflectTypeRef queues the generation of a type's DIE, returning the name of its DWARF symbol
+func (b *debugInfoBuilder) reflectTypeRef(t reflect.Type) string {
+	if name, ok := b.typeNames[t]; ok {
+		return name
+	}
+	name := dwarf.InfoPrefix + resolveFullyQualifiedSymbolName(fromRType(t))
+	b.typeNames[t] = name
+	if _, ok := b.types[name]; !ok {
+		b.types[name] = t
+		b.typeQueue = append(b.typeQueue, name)
+	}
+	return name
+}
+
+// writeTypeUnit writes the DIEs of all types referenced by the module's DIEs into a unit of their own
+func (b *debugInfoBuilder) writeTypeUnit() {
+	if len(b.typeQueue) == 0 {
+		return
+	}
+	setLength := b.unitHeader()
+	b.abbrev(abbrevTypeUnit)
+	b.cstring(debugInfo, "goloader.types")
+	b.sections[debugInfo] = append(b.sections[debugInfo], dwarf.DW_LANG_Go)
+	// Writing types can queue more types
+	for i := 0; i < len(b.typeQueue); i++ {
+		b.writeType(b.typeQueue[i])
+	}
+	b.sections[debugInfo] = append(b.sections[debugInfo], 0)
+	setLength()
+}
+
+type debugMember struct {
+	name   string
+	offset uintptr
+	typ    reflect.Type
+}
+
+var (
+	bytePtrType       = reflect.TypeOf((*byte)(nil))
+	intType           = reflect.TypeOf(0)
+	uintptrType       = reflect.TypeOf(uintptr(0))
+	unsafePointerType = reflect.TypeOf(unsafe.Pointer(nil))
+)
+
+func (b *debugInfoBuilder) writeType(name string) {
+	b.offsets[name] = debugSymOffset{debugInfo, len(b.sections[debugInfo])}
+	typeName := strings.TrimPrefix(name, dwarf.InfoPrefix)
+	t := b.types[name]
+	if t == nil {
+		b.abbrev(abbrevUnspecifiedType)
+		b.cstring(debugInfo, typeName)
+		return
+	}
+	var members []debugMember
+	switch t.Kind() {
+	case reflect.Bool:
+		b.writeBaseType(typeName, dwarf.DW_ATE_boolean, t.Size())
+		return
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.writeBaseType(typeName, dwarf.DW_ATE_signed, t.Size())
+		return
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b.writeBaseType(typeName, dwarf.DW_ATE_unsigned, t.Size())
+		return
+	case reflect.Float32, reflect.Float64:
+		b.writeBaseType(typeName, dwarf.DW_ATE_float, t.Size())
+		return
+	case reflect.Complex64, reflect.Complex128:
+		b.writeBaseType(typeName, dwarf.DW_ATE_complex_float, t.Size())
+		return
+	case reflect.Ptr:
+		b.abbrev(abbrevPointerType)
+		b.cstring(debugInfo, typeName)
+		b.ref(b.reflectTypeRef(t.Elem()))
+		return
+	case reflect.UnsafePointer, reflect.Map, reflect.Chan, reflect.Func:
+		b.abbrev(abbrevVoidPointerType)
+		b.cstring(debugInfo, typeName)
+		return
+	case reflect.Array:
+		b.abbrev(abbrevArrayType)
+		b.cstring(debugInfo, typeName)
+		b.uleb(debugInfo, uint64(t.Size()))
+		b.ref(b.reflectTypeRef(t.Elem()))
+		b.abbrev(abbrevSubrange)
+		b.uleb(debugInfo, uint64(t.Len()))
+		b.sections[debugInfo] = append(b.sections[debugInfo], 0)
+		return
+	case reflect.String:
+		members = []debugMember{{"str", 0, bytePtrType}, {"len", PtrSize, intType}}
+	case reflect.Slice:
+		members = []debugMember{{"array", 0, reflect.PtrTo(t.Elem())}, {"len", PtrSize, intType}, {"cap", 2 * PtrSize, intType}}
+	case reflect.Interface:
+		first := "tab"
+		if t.NumMethod() == 0 {
+			first = "_type"
+		}
+		members = []debugMember{{first, 0, uintptrType}, {"data", PtrSize, unsafePointerType}}
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			members = append(members, debugMember{field.Name, field.Offset, field.Type})
+		}
+	default:
+		b.abbrev(abbrevUnspecifiedType)
+		b.cstring(debugInfo, typeName)
+		return
+	}
+	b.abbrev(abbrevStructType)
+	b.cstring(debugInfo, typeName)
+	b.uleb(debugInfo, uint64(t.Size()))
+	for _, member := range members {
+		b.abbrev(abbrevMember)
+		b.cstring(debugInfo, member.name)
+		b.uleb(debugInfo, uint64(member.offset))
+		b.ref(b.reflectTypeRef(member.typ))
+	}
+	b.sections[debugInfo] = append(b.sections[debugInfo], 0)
+}
+
+func (b *debugInfoBuilder) writeBaseType(name string, encoding uint8, size uintptr) {
+	b.abbrev(abbrevBaseType)
+	b.cstring(debugInfo, name)
+	b.sections[debugInfo] = append(b.sections[debugInfo], encoding)
+	b.uleb(debugInfo, uint64(size))
+}
+
+// writeFrames writes the call frame information for each function from its pcsp table, as the Go linker does
+func (b *debugInfoBuilder) writeFrames(funcs []debugFunc, regSP, regRA uint64) {
+	hasLR := b.linker.Arch.HasLR
+	cieReserve := 16
+	if hasLR {
+		cieReserve = 32
+	}
+	b.uint32(debugFrame, uint32(cieReserve))
+	b.uint32(debugFrame, 0xffffffff)                              // CIE id
+	b.sections[debugFrame] = append(b.sections[debugFrame], 3, 0) // version, augmentation
+	b.uleb(debugFrame, 1)                                         // code_alignment_factor
+	b.sleb(debugFrame, dataAlignmentFactor)
+	b.uleb(debugFrame, regRA)
+	b.sections[debugFrame] = append(b.sections[debugFrame], dwarf.DW_CFA_def_cfa)
+	b.uleb(debugFrame, regSP)
+	if hasLR {
+		b.uleb(debugFrame, 0)
+		b.sections[debugFrame] = append(b.sections[debugFrame], dwarf.DW_CFA_same_value)
+		b.uleb(debugFrame, regRA)
+		b.sections[debugFrame] = append(b.sections[debugFrame], dwarf.DW_CFA_val_offset)
+		b.uleb(debugFrame, regSP)
+		b.uleb(debugFrame, 0)
+	} else {
+		b.uleb(debugFrame, PtrSize)
+		b.sections[debugFrame] = append(b.sections[debugFrame], dwarf.DW_CFA_offset_extended)
+		b.uleb(debugFrame, regRA)
+		b.uleb(debugFrame, uint64(-PtrSize/dataAlignmentFactor))
+	}
+	b.sections[debugFrame] = append(b.sections[debugFrame], make([]byte, cieReserve+4-len(b.sections[debugFrame]))...)
+
+	for _, f := range funcs {
+		pcs, vals := readPCData(f.sym.Func.PCSP, 0)
+		if len(pcs) == 0 {
+			continue
+		}
+		topFrame := funcFlag(f.sym.Func.FuncFlag)&funcFlag_TOPFRAME != 0
+		var deltas []byte
+		if hasLR && topFrame {
+			deltas = append(deltas, dwarf.DW_CFA_undefined)
+			deltas = dwarf.AppendUleb128(deltas, regRA)
+		}
+		var pc uintptr
+		for i, nextPC := range pcs {
+			end := nextPC
+			// DWARF expects the last row to stop just before the end of the function
+			if int(end) == f.size {
+				end--
+				if end < pc {
+					continue
+				}
+			}
+			spdelta := int64(vals[i])
+			if !hasLR {
+				// The return address has been pushed onto the stack
+				spdelta += PtrSize
+			}
+			if hasLR && !topFrame {
+				if vals[i] > 0 {
+					deltas = append(deltas, dwarf.DW_CFA_offset_extended_sf)
+					deltas = dwarf.AppendUleb128(deltas, regRA)
+					deltas = dwarf.AppendSleb128(deltas, -spdelta/dataAlignmentFactor)
+				} else {
+					deltas = append(deltas, dwarf.DW_CFA_same_value)
+					deltas = dwarf.AppendUleb128(deltas, regRA)
+				}
+			}
+			deltas = append(deltas, dwarf.DW_CFA_def_cfa_offset_sf)
+			deltas = dwarf.AppendSleb128(deltas, spdelta/dataAlignmentFactor)
+			switch delta := end - pc; {
+			case delta < 0x40:
+				deltas = append(deltas, uint8(dwarf.DW_CFA_advance_loc+delta))
+			case delta < 0x100:
+				deltas = append(deltas, dwarf.DW_CFA_advance_loc1, uint8(delta))
+			case delta < 0x10000:
+				deltas = append(deltas, dwarf.DW_CFA_advance_loc2, 0, 0)
+				b.byteOrder.PutUint16(deltas[len(deltas)-2:], uint16(delta))
+			default:
+				deltas = append(deltas, dwarf.DW_CFA_advance_loc4, 0, 0, 0, 0)
+				b.byteOrder.PutUint32(deltas[len(deltas)-4:], uint32(delta))
+			}
+			pc = nextPC
+		}
+		deltas = append(deltas, make([]byte, alignof(len(deltas), PtrSize)-len(deltas))...)
+
+		b.uint32(debugFrame, uint32(4+2*PtrSize+len(deltas)))
+		b.uint32(debugFrame, 0) // CIE offset
+		b.uint64(debugFrame, uint64(f.addr))
+		b.uint64(debugFrame, uint64(f.size))
+		b.sections[debugFrame] = append(b.sections[debugFrame], deltas...)
+	}
+}
+
+// applyRelocs resolves addresses against the module's symbols, and references to other DWARF symbols against their
+// offsets within their sections
+func (b *debugInfoBuilder) applyRelocs() {
+	for _, r := range b.relocs {
+		var value uint64
+		switch r.reloc.Type {
+		case reloctype.R_ADDR, reloctype.R_ADDRCUOFF:
+			addr, ok := b.symbolMap[r.reloc.Sym.Name]
+			if !ok {
+				continue
+			}
+			value = uint64(int64(addr) + int64(r.reloc.Add))
+		case reloctype.R_DWARFSECREF:
+			target, ok := b.offsets[r.reloc.Sym.Name]
+			if !ok {
+				continue
+			}
+			value = uint64(target.offset + r.reloc.Add)
+		default:
+			continue
+		}
+		data := b.sections[r.section][r.offset:]
+		switch r.reloc.Size {
+		case 4:
+			b.byteOrder.PutUint32(data, uint32(value))
+		case 8:
+			b.byteOrder.PutUint64(data, value)
+		}
+	}
+}
+
+// writeELF wraps the DWARF sections in an ELF executable with a .text section (without contents) at the module's
+// code, and symbols for its functions, which is how debuggers expect JIT code to be described
+func (b *debugInfoBuilder) writeELF(codeModule *CodeModule, funcs []debugFunc) []byte {
+	machine := elf.EM_X86_64
+	if b.linker.Arch.Family == sys.ARM64 {
+		machine = elf.EM_AARCH64
+	}
+	shstrtab := []byte{0}
+	addName := func(name string) uint32 {
+		off := len(shstrtab)
+		shstrtab = append(append(shstrtab, name...), 0)
+		return uint32(off)
+	}
+	const textIndex = 1
+	sections := []elf.Section64{{}, {
+		Name:      addName(".text"),
+		Type:      uint32(elf.SHT_NOBITS),
+		Flags:     uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR),
+		Addr:      uint64(codeModule.codeBase),
+		Size:      uint64(codeModule.codeLen),
+		Addralign: PtrSize,
+	}}
+	var contents [][]byte
+	for i, data := range b.sections {
+		sections = append(sections, elf.Section64{Name: addName(debugSectionNames[i]), Type: uint32(elf.SHT_PROGBITS), Size: uint64(len(data)), Addralign: 1})
+		contents = append(contents, data)
+	}
+
+	strtab := []byte{0}
+	symtab := make([]byte, elf.Sym64Size)
+	for _, f := range funcs {
+		sym := elf.Sym64{
+			Name:  uint32(len(strtab)),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			Shndx: textIndex,
+			Value: uint64(f.addr),
+			Size:  uint64(f.size),
+		}
+		strtab = append(append(strtab, f.name...), 0)
+		buf := &bytes.Buffer{}
+		_ = binary.Write(buf, b.byteOrder, sym)
+		symtab = append(symtab, buf.Bytes()...)
+	}
+	symtabIndex := len(sections)
+	sections = append(sections,
+		elf.Section64{Name: addName(".symtab"), Type: uint32(elf.SHT_SYMTAB), Size: uint64(len(symtab)), Link: uint32(symtabIndex + 1), Info: 1, Addralign: PtrSize, Entsize: elf.Sym64Size},
+		elf.Section64{Name: addName(".strtab"), Type: uint32(elf.SHT_STRTAB), Size: uint64(len(strtab)), Addralign: 1},
+		elf.Section64{Type: uint32(elf.SHT_STRTAB), Addralign: 1},
+	)
+	contents = append(contents, symtab, strtab)
+	sections[len(sections)-1].Name = addName(".shstrtab")
+	sections[len(sections)-1].Size = uint64(len(shstrtab))
+	contents = append(contents, shstrtab)
+
+	// Section contents follow the header, then the section headers
+	off := uint64(elfHeaderSize)
+	for i := range contents {
+		section := &sections[len(sections)-len(contents)+i]
+		off = uint64(alignof(int(off), int(section.Addralign)))
+		section.Off = off
+		off += uint64(len(contents[i]))
+	}
+	shoff := uint64(alignof(int(off), PtrSize))
+
+	out := &bytes.Buffer{}
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shoff,
+		Ehsize:    elfHeaderSize,
+		Shentsize: elfSectionHeaderSize,
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  uint16(len(sections) - 1),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	_ = binary.Write(out, b.byteOrder, header)
+	for i := range contents {
+		section := sections[len(sections)-len(contents)+i]
+		out.Write(make([]byte, int(section.Off)-out.Len()))
+		out.Write(contents[i])
+	}
+	out.Write(make([]byte, int(shoff)-out.Len()))
+	for _, section := range sections {
+		_ = binary.Write(out, b.byteOrder, section)
+	}
+	return out.Bytes()
+}
+
+// registerDebugInfo builds the module's debug object and registers it with any attached debugger, if the linker was
+// created WithDebugInfo
+func (linker *Linker) registerDebugInfo(codeModule *CodeModule, symbolMap map[string]uintptr) error {
+	if !linker.options.DebugInfo {
+		return nil
+	}
+	debugELF, err := linker.buildDebugInfo(codeModule, symbolMap)
+	if err != nil {
+		return fmt.Errorf("failed to build debug info: %w", err)
+	}
+	codeModule.debugELF = debugELF
+	codeModule.jitDebugEntry = registerJITDebugObject(debugELF)
+	return nil
+}
+
+func (cm *CodeModule) unregisterDebugInfo() {
+	if cm.jitDebugEntry != nil {
+		unregisterJITDebugObject(cm.jitDebugEntry)
+		cm.jitDebugEntry = nil
+	}
+}
+
+// DebugELF returns the in-memory ELF object (holding the module's DWARF and function symbols) which was registered
+// with debuggers through the GDB JIT interface, or nil if the module wasn't linked WithDebugInfo
+func (cm *CodeModule) DebugELF() []byte {
+	return cm.debugELF
+}
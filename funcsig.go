@@ -0,0 +1,298 @@
+package goloader
+
+import (
+	"cmd/objfile/objfile"
+	"debug/dwarf"
+	"errors"
+	"fmt"
+	"github.com/eh-steve/goloader/obj"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FuncSignature is the parameter and result types of a function, spelled the way the linker spells type names
+// (e.g. "*net/http.Request", "[]uint8", "interface {}"). Methods include the receiver as their first parameter.
+// An empty string means the type is unknown, and is not compared.
+type FuncSignature struct {
+	Params  []string
+	Results []string
+}
+
+func (s FuncSignature) String() string {
+	typeList := func(types []string) string {
+		names := make([]string, len(types))
+		for i, t := range types {
+			if t == "" {
+				t = "?"
+			}
+			names[i] = t
+		}
+		return strings.Join(names, ", ")
+	}
+	switch len(s.Results) {
+	case 0:
+		return fmt.Sprintf("func(%s)", typeList(s.Params))
+	case 1:
+		return fmt.Sprintf("func(%s) %s", typeList(s.Params), typeList(s.Results))
+	default:
+		return fmt.Sprintf("func(%s) (%s)", typeList(s.Params), typeList(s.Results))
+	}
+}
+
+func (s FuncSignature) matches(other FuncSignature) bool {
+	typesMatch := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != "" && b[i] != "" && a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return typesMatch(s.Params, other.Params) && typesMatch(s.Results, other.Results)
+}
+
+type FuncSignatureMismatch struct {
+	Func     string
+	Expected FuncSignature // Signature the JIT code was compiled against
+	Host     FuncSignature // Signature of the function in the host binary
+	CalledBy []string
+}
+
+// FuncSignatureMismatchError is returned by Load when JIT code calls host functions whose signatures differ from
+// the ones it was compiled against (e.g. because it was built against a different version of the host's packages)
+type FuncSignatureMismatchError struct {
+	Mismatches []FuncSignatureMismatch
+}
+
+func (e *FuncSignatureMismatchError) Error() string {
+	lines := make([]string, 0, len(e.Mismatches))
+	for _, m := range e.Mismatches {
+		lines = append(lines, fmt.Sprintf("%s: JIT code expects %s but host has %s (called by %s)", m.Func, m.Expected, m.Host, strings.Join(m.CalledBy, ", ")))
+	}
+	return fmt.Sprintf("%d host function(s) have different signatures to those the JIT code was compiled against:\n\t%s", len(e.Mismatches), strings.Join(lines, "\n\t"))
+}
+
+// ErrNoHostDWARF is matched (with errors.Is) by the error Load returns when it can't verify the signatures of host
+// functions called by JIT code because the host was built without DWARF info (e.g. with -ldflags=-w), unless linked
+// WithAllowNoHostDWARF
+var ErrNoHostDWARF = errors.New("host executable has no DWARF info")
+
+// WithAllowNoHostDWARF skips verifying the signatures of host functions (instead of failing to load) if the host was
+// built without DWARF info
+func WithAllowNoHostDWARF() func(*LinkerOptions) {
+	return func(options *LinkerOptions) {
+		options.AllowNoHostDWARF = true
+	}
+}
+
+var hostFuncSignatures struct {
+	once    sync.Once
+	sigs    map[string]FuncSignature
+	inlined map[string]struct{}
+	err     error
+}
+
+// HostFuncSignatures returns the signatures of the functions in the running executable, read from its DWARF info.
+// It returns an error matching ErrNoHostDWARF if the executable was built without DWARF (e.g. with -ldflags=-w).
+func HostFuncSignatures() (map[string]FuncSignature, error) {
+	readHostDWARF()
+	return hostFuncSignatures.sigs, hostFuncSignatures.err
+}
+
+// hostInlinedFuncs returns the functions which the host's compiler inlined into at least one caller
+func hostInlinedFuncs() (map[string]struct{}, error) {
+	readHostDWARF()
+	return hostFuncSignatures.inlined, hostFuncSignatures.err
+}
+
+func readHostDWARF() {
+	hostFuncSignatures.once.Do(func() {
+		path, err := os.Executable()
+		if err != nil {
+			hostFuncSignatures.err = fmt.Errorf("could not find executable path: %w", err)
+			return
+		}
+		f, err := objfile.Open(path)
+		if err != nil {
+			hostFuncSignatures.err = fmt.Errorf("could not open executable %s: %w", path, err)
+			return
+		}
+		defer f.Close()
+		d, err := f.DWARF()
+		if err != nil {
+			hostFuncSignatures.err = fmt.Errorf("%w: could not read DWARF of %s: %s", ErrNoHostDWARF, path, err)
+			return
+		}
+		hostFuncSignatures.sigs, hostFuncSignatures.inlined, hostFuncSignatures.err = readDWARFFuncSignatures(d)
+	})
+}
+
+type dwarfParam struct {
+	typeOffset dwarf.Offset
+	isResult   bool
+}
+
+// readDWARFFuncSignatures returns the signatures of the functions in d, and the set of functions which were inlined
+func readDWARFFuncSignatures(d *dwarf.Data) (map[string]FuncSignature, map[string]struct{}, error) {
+	typeNames := map[dwarf.Offset]string{}
+	funcParams := map[string][]dwarfParam{}
+	inlined := map[string]struct{}{}
+
+	r := d.Reader()
+	var currentFunc string
+	depth := 0
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read DWARF entry: %w", err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag == 0 {
+			depth--
+			if depth <= 1 {
+				currentFunc = ""
+			}
+			continue
+		}
+		// Functions and types are children of their compilation unit, and parameters are children of their function
+		switch {
+		case entry.Tag == dwarf.TagSubprogram && depth == 1:
+			// Concrete out-of-line instances of inlined functions have no name, only an abstract origin which has
+			// the same parameters, so only named subprograms are needed
+			if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+				funcParams[name] = nil
+				// Only abstract subprograms (of functions inlined somewhere) have DW_AT_inline
+				if _, ok := entry.Val(dwarf.AttrInline).(int64); ok {
+					inlined[name] = struct{}{}
+				}
+				if entry.Children {
+					currentFunc = name
+				}
+			}
+		case entry.Tag == dwarf.TagFormalParameter && depth == 2 && currentFunc != "":
+			typeOffset, _ := entry.Val(dwarf.AttrType).(dwarf.Offset)
+			isResult, _ := entry.Val(dwarf.AttrVarParam).(bool)
+			funcParams[currentFunc] = append(funcParams[currentFunc], dwarfParam{typeOffset: typeOffset, isResult: isResult})
+		case depth == 1 && entry.Tag != dwarf.TagVariable:
+			if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+				typeNames[entry.Offset] = name
+			}
+		}
+		if entry.Children {
+			depth++
+		}
+	}
+
+	sigs := make(map[string]FuncSignature, len(funcParams))
+	for name, params := range funcParams {
+		var sig FuncSignature
+		for _, param := range params {
+			typeName := typeNames[param.typeOffset]
+			if param.isResult {
+				sig.Results = append(sig.Results, typeName)
+			} else {
+				sig.Params = append(sig.Params, typeName)
+			}
+		}
+		sigs[name] = sig
+	}
+	return sigs, inlined, nil
+}
+
+// HostSymbolRefs returns the names (and package paths) of all reachable symbols referenced by the linked packages
+// which will be resolved against the host's symbols in symPtr, excluding types and other linker-generated symbols
+func (linker *Linker) HostSymbolRefs(symPtr map[string]uintptr) map[string]string {
+	refs := map[string]string{}
+	for name, sym := range linker.symMap {
+		if sym.Offset != InvalidOffset || !linker.isSymbolReachable(name) {
+			continue
+		}
+		if strings.HasPrefix(name, TypePrefix) || strings.HasPrefix(name, ItabPrefix) || strings.HasPrefix(name, "go:") || strings.HasSuffix(name, obj.ABI0Suffix) {
+			continue
+		}
+		if _, ok := symPtr[name]; ok {
+			refs[name] = sym.Pkg
+		}
+	}
+	return refs
+}
+
+// ExpectFuncSignatures records the signatures that the linked packages expect host functions to have.
+// Load compares these against the host's DWARF info before relocating, and fails if any differ, or if the host has no
+// DWARF info (unless linked WithAllowNoHostDWARF).
+func (linker *Linker) ExpectFuncSignatures(sigs map[string]FuncSignature) {
+	if linker.expectedFuncSignatures == nil {
+		linker.expectedFuncSignatures = make(map[string]FuncSignature, len(sigs))
+	}
+	for name, sig := range sigs {
+		linker.expectedFuncSignatures[name] = sig
+	}
+}
+
+func (linker *Linker) verifyFuncSignatures(symPtr map[string]uintptr) error {
+	if len(linker.expectedFuncSignatures) == 0 {
+		return nil
+	}
+	hostSigs, err := HostFuncSignatures()
+	if err != nil {
+		if errors.Is(err, ErrNoHostDWARF) && linker.options.AllowNoHostDWARF {
+			return nil
+		}
+		return fmt.Errorf("could not verify the signatures of host functions called by JIT code: %w", err)
+	}
+	var mismatches []FuncSignatureMismatch
+	for name, expected := range linker.expectedFuncSignatures {
+		sym, ok := linker.symMap[name]
+		if !ok || sym.Offset != InvalidOffset || !linker.isSymbolReachable(name) {
+			continue
+		}
+		if _, ok := symPtr[name]; !ok {
+			continue
+		}
+		if _, isAsm := symPtr[name+obj.ABI0Suffix]; isAsm {
+			continue
+		}
+		host, ok := hostSigs[name]
+		if !ok {
+			continue
+		}
+		if !expected.matches(host) {
+			mismatches = append(mismatches, FuncSignatureMismatch{Func: name, Expected: expected, Host: host})
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Func < mismatches[j].Func
+	})
+	mismatchIndex := make(map[string]int, len(mismatches))
+	for i, m := range mismatches {
+		mismatchIndex[m.Func] = i
+	}
+	for callerName, caller := range linker.symMap {
+		if caller.Offset == InvalidOffset {
+			continue
+		}
+		for _, reloc := range caller.Reloc {
+			if i, ok := mismatchIndex[reloc.Sym.Name]; ok {
+				calledBy := mismatches[i].CalledBy
+				if len(calledBy) == 0 || calledBy[len(calledBy)-1] != callerName {
+					mismatches[i].CalledBy = append(calledBy, callerName)
+				}
+			}
+		}
+	}
+	for i := range mismatches {
+		sort.Strings(mismatches[i].CalledBy)
+	}
+	return &FuncSignatureMismatchError{Mismatches: mismatches}
+}
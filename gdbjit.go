@@ -0,0 +1,76 @@
+package goloader
+
+import (
+	"sync"
+	_ "unsafe"
+)
+
+// The GDB JIT compilation interface, see https://sourceware.org/gdb/current/onlinedocs/gdb.html/JIT-Interface.html
+// Debuggers set a breakpoint on __jit_debug_register_code, and read the in-memory object files of newly (un)registered
+// code from __jit_debug_descriptor when it's hit.
+const (
+	jitNoAction = iota
+	jitRegisterFn
+	jitUnregisterFn
+)
+
+type jitCodeEntry struct {
+	next        *jitCodeEntry
+	prev        *jitCodeEntry
+	symfileAddr *byte
+	symfileSize uint64
+}
+
+type jitDescriptor struct {
+	version       uint32
+	actionFlag    uint32
+	relevantEntry *jitCodeEntry
+	firstEntry    *jitCodeEntry
+}
+
+//go:linkname jitDebugDescriptor __jit_debug_descriptor
+var jitDebugDescriptor = jitDescriptor{version: 1}
+
+var jitDebugLock sync.Mutex
+
+// jitDebugRegisterCode is where debuggers set their breakpoint, so must not be inlined
+//
+//go:linkname jitDebugRegisterCode __jit_debug_register_code
+//go:noinline
+func jitDebugRegisterCode() {}
+
+// registerJITDebugObject notifies any attached debugger of an object file describing newly loaded code
+func registerJITDebugObject(symfile []byte) *jitCodeEntry {
+	entry := &jitCodeEntry{symfileAddr: &symfile[0], symfileSize: uint64(len(symfile))}
+	jitDebugLock.Lock()
+	defer jitDebugLock.Unlock()
+	entry.next = jitDebugDescriptor.firstEntry
+	if entry.next != nil {
+		entry.next.prev = entry
+	}
+	jitDebugDescriptor.firstEntry = entry
+	jitDebugDescriptor.relevantEntry = entry
+	jitDebugDescriptor.actionFlag = jitRegisterFn
+	jitDebugRegisterCode()
+	jitDebugDescriptor.actionFlag = jitNoAction
+	return entry
+}
+
+// unregisterJITDebugObject notifies any attached debugger that the code described by entry is being unloaded
+func unregisterJITDebugObject(entry *jitCodeEntry) {
+	jitDebugLock.Lock()
+	defer jitDebugLock.Unlock()
+	if entry.prev != nil {
+		entry.prev.next = entry.next
+	} else {
+		jitDebugDescriptor.firstEntry = entry.next
+	}
+	if entry.next != nil {
+		entry.next.prev = entry.prev
+	}
+	jitDebugDescriptor.relevantEntry = entry
+	jitDebugDescriptor.actionFlag = jitUnregisterFn
+	jitDebugRegisterCode()
+	jitDebugDescriptor.actionFlag = jitNoAction
+	jitDebugDescriptor.relevantEntry = nil
+}
@@ -0,0 +1,72 @@
+//go:build go1.18 && !go1.23
+// +build go1.18,!go1.23
+
+package goloader
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// funcval is the representation of a func value, see $GOROOT/src/runtime/runtime2.go
+type funcval struct {
+	fn uintptr
+	// variable-size, fn-specific data here
+}
+
+// labelMap is the representation of a goroutine's pprof labels, see $GOROOT/src/runtime/pprof/label.go
+type labelMap map[string]string
+
+//go:linkname getProfLabel runtime/pprof.runtime_getProfLabel
+func getProfLabel() unsafe.Pointer
+
+//go:linkname setProfLabel runtime/pprof.runtime_setProfLabel
+func setProfLabel(labels unsafe.Pointer)
+
+// newprocTrampoline returns the address which calls to runtime.newproc (i.e. go statements) in a module's code are
+// relocated to
+func newprocTrampoline() uintptr {
+	return getFunctionPtr(moduleNewproc)
+}
+
+// moduleNewproc has the same signature as runtime.newproc (since go1.18), and starts fn in a new goroutine labelled
+// with the calling module's label, counted in the module's Stats.
+// Tracebacks of these goroutines show them as created by goloader.moduleNewproc, running goloader.moduleNewproc.func1.
+func moduleNewproc(fn *funcval) {
+	f := *(*func())(unsafe.Pointer(&fn))
+	var pcs [1]uintptr
+	var cm *CodeModule
+	if runtime.Callers(2, pcs[:]) == 1 {
+		cm = moduleForPC(pcs[0])
+	}
+	if cm == nil {
+		go f()
+		return
+	}
+	labels := cm.goroutineLabels(getProfLabel())
+	atomic.AddInt64(&cm.goroutinesStarted, 1)
+	atomic.AddInt64(&cm.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&cm.goroutines, -1)
+		setProfLabel(labels)
+		f()
+	}()
+}
+
+// goroutineLabels returns the labels of the calling goroutine (as returned by getProfLabel) with the module's label added
+func (cm *CodeModule) goroutineLabels(parent unsafe.Pointer) unsafe.Pointer {
+	if parent == nil {
+		return unsafe.Pointer(&labelMap{ModuleLabelKey: cm.label})
+	}
+	parentLabels := *(*labelMap)(parent)
+	if parentLabels[ModuleLabelKey] == cm.label {
+		return parent
+	}
+	labels := make(labelMap, len(parentLabels)+1)
+	for k, v := range parentLabels {
+		labels[k] = v
+	}
+	labels[ModuleLabelKey] = cm.label
+	return unsafe.Pointer(&labels)
+}
@@ -0,0 +1,292 @@
+package goloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ModuleLabelKey is the pprof label set on goroutines started by a module's code (and inherited by any goroutines they
+// start in turn), whose value identifies the module, see CodeModule.Label
+const ModuleLabelKey = "goloader.module"
+
+const newprocSymName = "runtime.newproc"
+
+var moduleSeq int64
+
+// ModuleStats is a snapshot of the resources used by a module
+type ModuleStats struct {
+	Goroutines        int64 // Goroutines started by the module's code which are still running
+	GoroutinesStarted int64 // Goroutines started by the module's code since it was loaded
+	CPUSamples        int64 // CPU profile samples labelled with the module, as passed to AccountCPUProfile
+	CPUTime           int64 // CPU time in nanoseconds of CPUSamples
+	CodeBytes         int   // Size of the module's text
+	DataBytes         int   // Size of the module's data and noptrdata
+	BSSBytes          int   // Size of the module's bss and noptrbss
+	MappedCodeBytes   int   // Size of the memory mapped for the module's text (a multiple of the page size)
+	MappedDataBytes   int   // Size of the memory mapped for the module's data, noptrdata, bss and noptrbss
+}
+
+// Label returns the pprof label identifying the module on goroutines started by its code, for use with
+// pprof.Labels or to filter profiles with e.g. 'go tool pprof -tagfocus'
+func (cm *CodeModule) Label() (key, value string) {
+	return ModuleLabelKey, cm.label
+}
+
+// Stats returns a snapshot of the resources used by the module.
+// Goroutines are only counted if started with a go statement in the module's code (goroutines started on its behalf
+// by host packages, e.g. net/http, are labelled but not counted), which requires go1.18 or later.
+func (cm *CodeModule) Stats() ModuleStats {
+	return ModuleStats{
+		Goroutines:        atomic.LoadInt64(&cm.goroutines),
+		GoroutinesStarted: atomic.LoadInt64(&cm.goroutinesStarted),
+		CPUSamples:        atomic.LoadInt64(&cm.cpuSamples),
+		CPUTime:           atomic.LoadInt64(&cm.cpuTime),
+		CodeBytes:         cm.codeLen,
+		DataBytes:         cm.dataLen + cm.noptrdataLen,
+		BSSBytes:          cm.bssLen + cm.noptrbssLen,
+		MappedCodeBytes:   cm.maxCodeLength,
+		MappedDataBytes:   cm.maxDataLength,
+	}
+}
+
+func (cm *CodeModule) initLabel(mainPkgPath string) {
+	cm.label = fmt.Sprintf("%s#%d", mainPkgPath, atomic.AddInt64(&moduleSeq, 1))
+}
+
+// moduleForPC returns the loaded module whose text contains pc, if any
+func moduleForPC(pc uintptr) *CodeModule {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	for cm := range modules {
+		if pc >= uintptr(cm.codeBase) && pc < uintptr(cm.codeBase+cm.codeLen) {
+			return cm
+		}
+	}
+	return nil
+}
+
+// AccountCPUProfile attributes the samples of a CPU profile (as written by pprof.StartCPUProfile) to the loaded
+// modules whose label they carry, adding them to the CPUSamples and CPUTime of each module's Stats.
+// Each profile should only be accounted once.
+func AccountCPUProfile(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to decompress CPU profile: %w", err)
+		}
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return fmt.Errorf("failed to decompress CPU profile: %w", err)
+		}
+	}
+	samples, err := decodeLabelledSamples(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode CPU profile: %w", err)
+	}
+
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	byLabel := make(map[string]*CodeModule, len(modules))
+	for cm := range modules {
+		byLabel[cm.label] = cm
+	}
+	for label, s := range samples {
+		if cm, ok := byLabel[label]; ok {
+			atomic.AddInt64(&cm.cpuSamples, s.count)
+			atomic.AddInt64(&cm.cpuTime, s.nanos)
+		}
+	}
+	return nil
+}
+
+type sampleTotal struct {
+	count, nanos int64
+}
+
+// decodeLabelledSamples totals the samples and cpu nanoseconds of a CPU profile by their ModuleLabelKey label, see
+// $GOROOT/src/runtime/pprof/protobuf.go and the profile.proto it encodes
+func decodeLabelledSamples(data []byte) (map[string]sampleTotal, error) {
+	const (
+		profileSampleType  = 1
+		profileSample      = 2
+		profileStringTable = 6
+		valueTypeType      = 1
+		sampleValue        = 2
+		sampleLabel        = 3
+		labelKey           = 1
+		labelStr           = 2
+	)
+	type sample struct {
+		values []int64
+		labels [][2]int64
+	}
+	var sampleTypes []int64
+	var samples []sample
+	var stringTable []string
+
+	err := walkProto(data, func(field int, wireType int, v uint64, b []byte) error {
+		switch field {
+		case profileSampleType:
+			var typ int64
+			err := walkProto(b, func(field int, _ int, v uint64, _ []byte) error {
+				if field == valueTypeType {
+					typ = int64(v)
+				}
+				return nil
+			})
+			sampleTypes = append(sampleTypes, typ)
+			return err
+		case profileSample:
+			var s sample
+			err := walkProto(b, func(field int, wireType int, v uint64, b []byte) error {
+				switch field {
+				case sampleValue:
+					values, err := protoVarints(wireType, v, b)
+					s.values = append(s.values, values...)
+					return err
+				case sampleLabel:
+					var label [2]int64
+					err := walkProto(b, func(field int, _ int, v uint64, _ []byte) error {
+						switch field {
+						case labelKey:
+							label[0] = int64(v)
+						case labelStr:
+							label[1] = int64(v)
+						}
+						return nil
+					})
+					s.labels = append(s.labels, label)
+					return err
+				}
+				return nil
+			})
+			samples = append(samples, s)
+			return err
+		case profileStringTable:
+			stringTable = append(stringTable, string(b))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	str := func(i int64) string {
+		if i < 0 || i >= int64(len(stringTable)) {
+			return ""
+		}
+		return stringTable[i]
+	}
+	countIndex, nanosIndex := -1, -1
+	for i, typ := range sampleTypes {
+		switch str(typ) {
+		case "samples":
+			countIndex = i
+		case "cpu":
+			nanosIndex = i
+		}
+	}
+	if countIndex < 0 && nanosIndex < 0 {
+		return nil, errors.New("not a CPU profile")
+	}
+
+	totals := map[string]sampleTotal{}
+	for _, s := range samples {
+		for _, label := range s.labels {
+			if str(label[0]) != ModuleLabelKey {
+				continue
+			}
+			total := totals[str(label[1])]
+			if countIndex >= 0 && countIndex < len(s.values) {
+				total.count += s.values[countIndex]
+			}
+			if nanosIndex >= 0 && nanosIndex < len(s.values) {
+				total.nanos += s.values[nanosIndex]
+			}
+			totals[str(label[1])] = total
+		}
+	}
+	return totals, nil
+}
+
+// walkProto calls fn for each field of an encoded protobuf message, with the value of varint fields in v and the bytes
+// of length-delimited fields in b
+func walkProto(data []byte, fn func(field int, wireType int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := protoVarint(data)
+		if n <= 0 {
+			return errors.New("truncated field key")
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+		var v uint64
+		var b []byte
+		switch wireType {
+		case 0:
+			v, n = protoVarint(data)
+			if n <= 0 {
+				return fmt.Errorf("truncated varint in field %d", field)
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("truncated fixed64 in field %d", field)
+			}
+			data = data[8:]
+		case 2:
+			l, n := protoVarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return fmt.Errorf("truncated bytes in field %d", field)
+			}
+			b = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("truncated fixed32 in field %d", field)
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+		if err := fn(field, wireType, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoVarints decodes a repeated integer field, which may or may not be packed
+func protoVarints(wireType int, v uint64, b []byte) ([]int64, error) {
+	if wireType == 0 {
+		return []int64{int64(v)}, nil
+	}
+	var values []int64
+	for len(b) > 0 {
+		v, n := protoVarint(b)
+		if n <= 0 {
+			return nil, errors.New("truncated packed varint")
+		}
+		values = append(values, int64(v))
+		b = b[n:]
+	}
+	return values, nil
+}
+
+func protoVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
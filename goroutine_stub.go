@@ -0,0 +1,10 @@
+//go:build !go1.18 || go1.23
+// +build !go1.18 go1.23
+
+package goloader
+
+// Goroutines started by modules are only labelled and counted from go1.18, since runtime.newproc had a different
+// signature before
+func newprocTrampoline() uintptr {
+	return 0
+}
@@ -0,0 +1,74 @@
+package goloader
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync/atomic"
+)
+
+// Handle is a counted reference to a CodeModule, for sharing a module between several owners. The module is unloaded
+// once all its Handles have been released, provided no goroutines are executing its code and nothing in the host's
+// globals references it (see Unload and WithFailOnReferences). Otherwise, releasing the last Handle returns the error
+// and leaves the module loaded, and it can be unloaded later with Unload or UnloadWait, or by acquiring and releasing
+// another Handle.
+//
+// A Handle which is garbage collected without being released is released by its finalizer, which logs a warning.
+type Handle struct {
+	cm       *CodeModule
+	released int32
+}
+
+// Acquire returns a new Handle to the module. It panics if the module has been unloaded.
+func (cm *CodeModule) Acquire() *Handle {
+	cm.handleLock.Lock()
+	defer cm.handleLock.Unlock()
+	if atomic.LoadInt32(&cm.unloaded) != 0 {
+		panic(fmt.Sprintf("goloader: Acquire called on module %s after it was unloaded", cm.label))
+	}
+	cm.handles++
+	h := &Handle{cm: cm}
+	runtime.SetFinalizer(h, (*Handle).finalize)
+	return h
+}
+
+// Module returns the module, and panics if the Handle has been released
+func (h *Handle) Module() *CodeModule {
+	if atomic.LoadInt32(&h.released) != 0 {
+		panic(fmt.Sprintf("goloader: use of Handle for module %s after it was released", h.cm.label))
+	}
+	return h.cm
+}
+
+// Release releases the Handle, unloading the module if it was the last one, and returns any error from unloading it.
+// It panics if the Handle has already been released.
+func (h *Handle) Release() error {
+	if !atomic.CompareAndSwapInt32(&h.released, 0, 1) {
+		panic(fmt.Sprintf("goloader: Handle for module %s released twice", h.cm.label))
+	}
+	runtime.SetFinalizer(h, nil)
+	return h.cm.release()
+}
+
+func (h *Handle) finalize() {
+	if atomic.CompareAndSwapInt32(&h.released, 0, 1) {
+		log.Printf("goloader: Handle for module %s was garbage collected without being released\n", h.cm.label)
+		if err := h.cm.release(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (cm *CodeModule) release() error {
+	cm.handleLock.Lock()
+	defer cm.handleLock.Unlock()
+	cm.handles--
+	if cm.handles > 0 {
+		return nil
+	}
+	err := cm.unload([]UnloadOptFunc{WithFailOnReferences()})
+	if err != nil {
+		return fmt.Errorf("failed to unload module %s after releasing its last Handle: %w", cm.label, err)
+	}
+	return nil
+}
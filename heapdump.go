@@ -0,0 +1,268 @@
+package goloader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+// Record tags and field kinds of the heap dump format written by debug.WriteHeapDump, see
+// $GOROOT/src/runtime/heapdump.go and https://golang.org/s/go15heapdump
+const (
+	heapDumpHeader        = "go1.7 heap dump\n"
+	dumpFieldKindEol      = 0
+	dumpTagEOF            = 0
+	dumpTagObject         = 1
+	dumpTagOtherRoot      = 2
+	dumpTagType           = 3
+	dumpTagGoroutine      = 4
+	dumpTagStackFrame     = 5
+	dumpTagParams         = 6
+	dumpTagFinalizer      = 7
+	dumpTagItab           = 8
+	dumpTagOSThread       = 9
+	dumpTagMemStats       = 10
+	dumpTagQueuedFinalize = 11
+	dumpTagData           = 12
+	dumpTagBSS            = 13
+	dumpTagDefer          = 14
+	dumpTagPanic          = 15
+)
+
+// heapObject is an allocated heap object containing pointers (or code addresses)
+type heapObject struct {
+	addr, size uintptr
+	ptrs       []heapPointer
+}
+
+type heapPointer struct {
+	offset, value uintptr
+}
+
+// rootPointer is a pointer held outside the heap, in a global, stack frame or runtime structure
+type rootPointer struct {
+	root        string
+	addr, value uintptr
+}
+
+// heapDump is the subset of a heap dump needed to find what the heap keeps reachable
+type heapDump struct {
+	objects []heapObject // Sorted by address
+	roots   []rootPointer
+}
+
+// writeHeapDump writes a heap dump of the process to a temporary file and reads it back.
+// The dump's data and bss segments (of the host only) are skipped, as globals are scanned directly.
+// Words for which isCode returns true are treated as pointers, since func values (e.g. those created by
+// buildExports) may be code addresses in objects the GC doesn't scan.
+func writeHeapDump(isCode func(addr uintptr) bool) (*heapDump, error) {
+	f, err := os.CreateTemp("", "goloader_heapdump_*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create heap dump file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	runtime.GC()
+	debug.WriteHeapDump(f.Fd())
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seek heap dump file: %w", err)
+	}
+	dump, err := readHeapDump(bufio.NewReaderSize(f, 1<<20), isCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read heap dump: %w", err)
+	}
+	return dump, nil
+}
+
+type heapDumpReader struct {
+	r         *bufio.Reader
+	byteOrder binary.ByteOrder
+	ptrSize   int
+	err       error
+}
+
+func (d *heapDumpReader) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var v uint64
+	v, d.err = binary.ReadUvarint(d.r)
+	return v
+}
+
+func (d *heapDumpReader) bytes() []byte {
+	n := d.uint()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return b
+}
+
+func (d *heapDumpReader) skip(n int) {
+	for i := 0; i < n; i++ {
+		d.uint()
+	}
+}
+
+func (d *heapDumpReader) word(b []byte) uintptr {
+	if d.ptrSize == 4 {
+		return uintptr(d.byteOrder.Uint32(b))
+	}
+	return uintptr(d.byteOrder.Uint64(b))
+}
+
+// pointers reads a field list, returning the pointers at its offsets within contents
+func (d *heapDumpReader) pointers(contents []byte) []heapPointer {
+	var ptrs []heapPointer
+	for d.err == nil {
+		kind := d.uint()
+		if kind == dumpFieldKindEol {
+			break
+		}
+		offset := d.uint()
+		if offset+uint64(d.ptrSize) > uint64(len(contents)) {
+			continue
+		}
+		if value := d.word(contents[offset:]); value != 0 {
+			ptrs = append(ptrs, heapPointer{offset: uintptr(offset), value: value})
+		}
+	}
+	return ptrs
+}
+
+// readHeapDump reads records up to the memory statistics, which follow all the objects and roots
+func readHeapDump(r *bufio.Reader, isCode func(addr uintptr) bool) (*heapDump, error) {
+	header := make([]byte, len(heapDumpHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header) != heapDumpHeader {
+		return nil, fmt.Errorf("unsupported heap dump header %q", header)
+	}
+	d := &heapDumpReader{r: r, byteOrder: binary.LittleEndian, ptrSize: 8}
+	dump := &heapDump{}
+	var goid uint64
+	addRoot := func(root string, values ...uint64) {
+		for _, v := range values {
+			if v != 0 {
+				dump.roots = append(dump.roots, rootPointer{root: root, value: uintptr(v)})
+			}
+		}
+	}
+
+	for d.err == nil {
+		tag := d.uint()
+		switch tag {
+		case dumpTagEOF, dumpTagMemStats:
+			sort.Slice(dump.objects, func(i, j int) bool {
+				return dump.objects[i].addr < dump.objects[j].addr
+			})
+			return dump, d.err
+		case dumpTagParams:
+			if d.uint() != 0 {
+				d.byteOrder = binary.BigEndian
+			}
+			d.ptrSize = int(d.uint())
+			d.skip(2) // arena start, end
+			d.bytes() // GOARCH
+			d.bytes() // version
+			d.skip(1) // ncpu
+		case dumpTagType:
+			d.skip(2) // address, size
+			d.bytes() // name
+			d.skip(1) // indirect
+		case dumpTagItab:
+			d.skip(2)
+		case dumpTagObject:
+			addr := d.uint()
+			contents := d.bytes()
+			ptrs := d.pointers(contents)
+			for offset := 0; offset+d.ptrSize <= len(contents); offset += d.ptrSize {
+				if value := d.word(contents[offset:]); isCode(value) && !hasPointerAt(ptrs, uintptr(offset)) {
+					ptrs = append(ptrs, heapPointer{offset: uintptr(offset), value: value})
+				}
+			}
+			if len(ptrs) > 0 {
+				dump.objects = append(dump.objects, heapObject{addr: uintptr(addr), size: uintptr(len(contents)), ptrs: ptrs})
+			}
+		case dumpTagOtherRoot:
+			description := d.bytes()
+			addRoot(string(description), d.uint())
+		case dumpTagGoroutine:
+			d.skip(1) // g
+			d.skip(1) // sp
+			goid = d.uint()
+			d.skip(5) // gopc, status, system, background, waitsince
+			d.bytes() // wait reason
+			d.skip(4) // ctxt, m, defer, panic
+		case dumpTagStackFrame:
+			sp := d.uint()
+			d.skip(2) // depth, child sp
+			contents := d.bytes()
+			d.skip(3) // entry, pc, continuation pc
+			name := d.bytes()
+			root := fmt.Sprintf("goroutine %d frame %s", goid, name)
+			for _, ptr := range d.pointers(contents) {
+				dump.roots = append(dump.roots, rootPointer{root: root, addr: uintptr(sp) + ptr.offset, value: ptr.value})
+			}
+		case dumpTagDefer:
+			d.skip(4) // defer, g, sp, pc
+			fn, fnPC := d.uint(), d.uint()
+			d.skip(1) // link
+			addRoot(fmt.Sprintf("goroutine %d defer", goid), fn, fnPC)
+		case dumpTagPanic:
+			d.skip(2) // panic, g
+			typ, data := d.uint(), d.uint()
+			d.skip(2) // defer, link
+			addRoot(fmt.Sprintf("goroutine %d panic", goid), typ, data)
+		case dumpTagOSThread:
+			d.skip(3)
+		case dumpTagData, dumpTagBSS:
+			d.skip(1) // address
+			d.pointers(d.bytes())
+		case dumpTagFinalizer, dumpTagQueuedFinalize:
+			obj := d.uint()
+			fn, fnPC, fint, ot := d.uint(), d.uint(), d.uint(), d.uint()
+			// Objects with finalizers are kept alive, along with everything they reference
+			addRoot(fmt.Sprintf("finalizer of 0x%x", obj), obj, fn, fnPC, fint, ot)
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("unknown heap dump record tag %d", tag)
+			}
+		}
+	}
+	if errors.Is(d.err, io.EOF) {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return nil, d.err
+}
+
+// findObject returns the index of the object containing addr, or -1
+func (dump *heapDump) findObject(addr uintptr) int {
+	i := sort.Search(len(dump.objects), func(i int) bool {
+		return dump.objects[i].addr+dump.objects[i].size > addr
+	})
+	if i < len(dump.objects) && dump.objects[i].addr <= addr {
+		return i
+	}
+	return -1
+}
+
+func hasPointerAt(ptrs []heapPointer, offset uintptr) bool {
+	for _, ptr := range ptrs {
+		if ptr.offset == offset {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,378 @@
+package goloader
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"unsafe"
+
+	"github.com/eh-steve/goloader/obj"
+)
+
+const (
+	imageMagic   = "goloader image"
+	imageVersion = 2
+)
+
+// imageHeader is decoded (and checked) before the rest of the image, so that a mismatched image is rejected
+// without having to decode it in full
+type imageHeader struct {
+	Magic       string
+	Version     int
+	HostBuildID string
+	GoVersion   string
+	Arch        string
+}
+
+// imageSym is an obj.Sym whose relocations refer to other symbols by index into imageBody.Syms,
+// since relocation targets are shared (and can be cyclic) and gob can't encode either
+type imageSym struct {
+	Name   string
+	Kind   int
+	Offset int
+	Size   int
+	Pkg    string
+	Func   *obj.Func
+	Reloc  []imageReloc
+}
+
+type imageReloc struct {
+	Offset         int
+	Sym            int
+	Size           int
+	Type           int
+	Add            int
+	EpilogueOffset int
+	EpilogueSize   int
+}
+
+// imageObjSym keeps only the parts of an obj.ObjSymbol which are still needed once symbols have been laid out
+type imageObjSym struct {
+	Kind int
+	Size int64
+	Type string
+	Pkg  string
+}
+
+type imagePkg struct {
+	PkgPath     string
+	AutoLib     []string
+	Exports     map[string]obj.ExportSymType
+	TextHeader  string
+	RaceEnabled bool
+}
+
+type imageBody struct {
+	Code      []byte
+	Data      []byte
+	Noptrdata []byte
+	Bss       []byte
+	Noptrbss  []byte
+	Covctrs   []byte // Already appended to Noptrbss, but Load needs to know where they start
+
+	CUFiles     []obj.CompilationUnitFiles
+	Syms        []imageSym
+	SymMap      map[string]int
+	ObjSyms     map[string]imageObjSym
+	Cutab       []uint32
+	Filetab     []byte
+	Funcnametab []byte
+	Functab     []byte
+	Pctab       []byte
+	Funcs       [][]byte
+
+	InitFuncs        []string
+	SymNameOrder     []string
+	HeapStrings      map[string]string
+	ReachableTypes   []string
+	ReachableSymbols []string
+	Pkgs             []imagePkg
+
+	SkipTypeDeduplicationForPackages []string
+	ExpectedFuncSignatures           map[string]FuncSignature
+	InlinedCallers                   map[string][]string
+	BuildInfo                        *debug.BuildInfo
+}
+
+// WriteImage serializes a fully linked (but not yet loaded) Linker, so that it can later be restored with ReadImage and
+// passed to Load without needing the original archives or a Go toolchain.
+// The image is only valid for the host binary which produced it (its build ID is recorded and checked by ReadImage),
+// since external symbols were resolved and types deduplicated against that binary's symbol table.
+// WriteImage must be called before the Linker is loaded. Images don't carry the compiler's DWARF, so Linkers linked
+// WithDebugInfo can't be written.
+func (linker *Linker) WriteImage(w io.Writer) error {
+	hostBuildID, err := HostBuildID()
+	if err != nil {
+		return fmt.Errorf("could not write image: %w", err)
+	}
+	if linker.Arch == nil {
+		return fmt.Errorf("could not write image: linker has no objects")
+	}
+	if linker.options.DebugInfo {
+		return fmt.Errorf("could not write image: images don't carry DWARF, so can't be linked WithDebugInfo")
+	}
+
+	symIndex := map[*obj.Sym]int{}
+	var syms []*obj.Sym
+	var indexOf func(sym *obj.Sym) int
+	indexOf = func(sym *obj.Sym) int {
+		if i, ok := symIndex[sym]; ok {
+			return i
+		}
+		symIndex[sym] = len(syms)
+		syms = append(syms, sym)
+		return symIndex[sym]
+	}
+
+	body := imageBody{
+		Code:                             linker.code,
+		Data:                             linker.data,
+		Noptrdata:                        linker.noptrdata,
+		Bss:                              linker.bss,
+		Noptrbss:                         linker.noptrbss,
+		Covctrs:                          linker.covctrs,
+		CUFiles:                          linker.cuFiles,
+		SymMap:                           make(map[string]int, len(linker.symMap)),
+		ObjSyms:                          make(map[string]imageObjSym, len(linker.objsymbolMap)),
+		Cutab:                            linker.cutab,
+		Filetab:                          linker.filetab,
+		Funcnametab:                      linker.funcnametab,
+		Functab:                          linker.functab,
+		Pctab:                            linker.pctab,
+		InitFuncs:                        linker.initFuncs,
+		SymNameOrder:                     linker.symNameOrder,
+		HeapStrings:                      make(map[string]string, len(linker.heapStringMap)),
+		SkipTypeDeduplicationForPackages: linker.options.SkipTypeDeduplicationForPackages,
+		ExpectedFuncSignatures:           linker.expectedFuncSignatures,
+		InlinedCallers:                   linker.inlinedCallers,
+		BuildInfo:                        linker.options.BuildInfo,
+	}
+	for name, sym := range linker.symMap {
+		body.SymMap[name] = indexOf(sym)
+	}
+	// Relocation targets may not be in the symMap (e.g. TLS or CALLIND placeholders), so keep walking as the table grows
+	for i := 0; i < len(syms); i++ {
+		for _, reloc := range syms[i].Reloc {
+			indexOf(reloc.Sym)
+		}
+	}
+	body.Syms = make([]imageSym, len(syms))
+	for i, sym := range syms {
+		imgSym := imageSym{
+			Name:   sym.Name,
+			Kind:   sym.Kind,
+			Offset: sym.Offset,
+			Size:   sym.Size,
+			Pkg:    sym.Pkg,
+			Func:   sym.Func,
+			Reloc:  make([]imageReloc, len(sym.Reloc)),
+		}
+		for j, reloc := range sym.Reloc {
+			imgSym.Reloc[j] = imageReloc{
+				Offset:         reloc.Offset,
+				Sym:            symIndex[reloc.Sym],
+				Size:           reloc.Size,
+				Type:           reloc.Type,
+				Add:            reloc.Add,
+				EpilogueOffset: reloc.EpilogueOffset,
+				EpilogueSize:   reloc.EpilogueSize,
+			}
+		}
+		body.Syms[i] = imgSym
+	}
+	for name, objSym := range linker.objsymbolMap {
+		body.ObjSyms[name] = imageObjSym{Kind: objSym.Kind, Size: objSym.Size, Type: objSym.Type, Pkg: objSym.Pkg}
+	}
+	for _, f := range linker._func {
+		body.Funcs = append(body.Funcs, append([]byte(nil), (*[_FuncSize]byte)(unsafe.Pointer(f))[:]...))
+	}
+	for name, str := range linker.heapStringMap {
+		body.HeapStrings[name] = *str
+	}
+	for name := range linker.reachableTypes {
+		body.ReachableTypes = append(body.ReachableTypes, name)
+	}
+	for name := range linker.reachableSymbols {
+		body.ReachableSymbols = append(body.ReachableSymbols, name)
+	}
+	for _, pkg := range linker.pkgs {
+		body.Pkgs = append(body.Pkgs, imagePkg{
+			PkgPath:     pkg.PkgPath,
+			AutoLib:     pkg.AutoLib,
+			Exports:     pkg.Exports,
+			TextHeader:  pkg.TextHeader,
+			RaceEnabled: pkg.RaceEnabled,
+		})
+	}
+
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(imageHeader{
+		Magic:       imageMagic,
+		Version:     imageVersion,
+		HostBuildID: hostBuildID,
+		GoVersion:   runtime.Version(),
+		Arch:        linker.Arch.Name,
+	})
+	if err != nil {
+		return fmt.Errorf("could not write image header: %w", err)
+	}
+	err = enc.Encode(body)
+	if err != nil {
+		return fmt.Errorf("could not write image: %w", err)
+	}
+	return nil
+}
+
+// ReadImage restores a Linker written by WriteImage, ready to be passed to Load (which relocates it against the
+// current symbol table). Images written by a different host binary or Go version are rejected, as are images of
+// packages whose build settings don't match the host's (see ArchiveMismatchError). Since images don't carry the
+// compiler's DWARF, they can't be read WithDebugInfo.
+func ReadImage(r io.Reader, linkerOpts ...LinkerOptFunc) (*Linker, error) {
+	hostBuildID, err := HostBuildID()
+	if err != nil {
+		return nil, fmt.Errorf("could not read image: %w", err)
+	}
+	dec := gob.NewDecoder(r)
+	var header imageHeader
+	err = dec.Decode(&header)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image header: %w", err)
+	}
+	if header.Magic != imageMagic {
+		return nil, fmt.Errorf("not a goloader image")
+	}
+	if header.Version != imageVersion {
+		return nil, fmt.Errorf("unsupported image version %d, expected %d", header.Version, imageVersion)
+	}
+	if header.GoVersion != runtime.Version() {
+		return nil, fmt.Errorf("image was built with Go version %s, but host is %s", header.GoVersion, runtime.Version())
+	}
+	if header.HostBuildID != hostBuildID {
+		return nil, fmt.Errorf("image was linked against host build ID %s, but host build ID is %s", header.HostBuildID, hostBuildID)
+	}
+	if header.Arch != runtime.GOARCH {
+		return nil, fmt.Errorf("image was built for arch %s, but host is %s", header.Arch, runtime.GOARCH)
+	}
+
+	var body imageBody
+	err = dec.Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image: %w", err)
+	}
+
+	linker, err := initLinker(linkerOpts)
+	if err != nil {
+		return nil, err
+	}
+	if linker.options.DebugInfo {
+		return nil, fmt.Errorf("could not read image: images don't carry DWARF, so can't be loaded WithDebugInfo")
+	}
+	linker.Arch = getArch(header.Arch)
+	linker.code = body.Code
+	linker.data = body.Data
+	linker.noptrdata = body.Noptrdata
+	linker.bss = body.Bss
+	linker.noptrbss = body.Noptrbss
+	linker.covctrs = body.Covctrs
+	linker.cuFiles = body.CUFiles
+	linker.cutab = body.Cutab
+	linker.filetab = body.Filetab
+	linker.funcnametab = body.Funcnametab
+	linker.functab = body.Functab
+	linker.pctab = body.Pctab
+	linker.initFuncs = body.InitFuncs
+	linker.symNameOrder = body.SymNameOrder
+	linker.expectedFuncSignatures = body.ExpectedFuncSignatures
+	linker.inlinedCallers = body.InlinedCallers
+	if linker.options.SkipTypeDeduplicationForPackages == nil {
+		linker.options.SkipTypeDeduplicationForPackages = body.SkipTypeDeduplicationForPackages
+	}
+	if linker.options.BuildInfo == nil {
+		linker.options.BuildInfo = body.BuildInfo
+	}
+
+	syms := make([]*obj.Sym, len(body.Syms))
+	for i, imgSym := range body.Syms {
+		syms[i] = &obj.Sym{
+			Name:   imgSym.Name,
+			Kind:   imgSym.Kind,
+			Offset: imgSym.Offset,
+			Size:   imgSym.Size,
+			Pkg:    imgSym.Pkg,
+			Func:   imgSym.Func,
+		}
+	}
+	for i, imgSym := range body.Syms {
+		if len(imgSym.Reloc) == 0 {
+			continue
+		}
+		syms[i].Reloc = make([]obj.Reloc, len(imgSym.Reloc))
+		for j, reloc := range imgSym.Reloc {
+			if reloc.Sym < 0 || reloc.Sym >= len(syms) {
+				return nil, fmt.Errorf("corrupt image: symbol %s has reloc to invalid symbol index %d", imgSym.Name, reloc.Sym)
+			}
+			syms[i].Reloc[j] = obj.Reloc{
+				Offset:         reloc.Offset,
+				Sym:            syms[reloc.Sym],
+				Size:           reloc.Size,
+				Type:           reloc.Type,
+				Add:            reloc.Add,
+				EpilogueOffset: reloc.EpilogueOffset,
+				EpilogueSize:   reloc.EpilogueSize,
+			}
+		}
+	}
+	for name, index := range body.SymMap {
+		if index < 0 || index >= len(syms) {
+			return nil, fmt.Errorf("corrupt image: symbol %s has invalid index %d", name, index)
+		}
+		linker.symMap[name] = syms[index]
+	}
+	for name, objSym := range body.ObjSyms {
+		linker.objsymbolMap[name] = &obj.ObjSymbol{Name: name, Kind: objSym.Kind, Size: objSym.Size, Type: objSym.Type, Pkg: objSym.Pkg}
+	}
+	for _, funcBytes := range body.Funcs {
+		if len(funcBytes) != _FuncSize {
+			return nil, fmt.Errorf("corrupt image: _func of size %d, expected %d", len(funcBytes), _FuncSize)
+		}
+		f := &_func{}
+		copy((*[_FuncSize]byte)(unsafe.Pointer(f))[:], funcBytes)
+		linker._func = append(linker._func, f)
+	}
+	for name, str := range body.HeapStrings {
+		s := str
+		linker.heapStringMap[name] = &s
+	}
+	for _, name := range body.ReachableTypes {
+		linker.reachableTypes[name] = struct{}{}
+	}
+	for _, name := range body.ReachableSymbols {
+		linker.reachableSymbols[name] = struct{}{}
+	}
+	linker.pkgsByName = make(map[string]*obj.Pkg, len(body.Pkgs))
+	for _, imgPkg := range body.Pkgs {
+		pkg := &obj.Pkg{
+			PkgPath:     imgPkg.PkgPath,
+			AutoLib:     imgPkg.AutoLib,
+			Exports:     imgPkg.Exports,
+			TextHeader:  imgPkg.TextHeader,
+			RaceEnabled: imgPkg.RaceEnabled,
+		}
+		if err = checkArchiveHeader(pkg, ""); err != nil {
+			return nil, fmt.Errorf("could not read image: %w", err)
+		}
+		linker.pkgs = append(linker.pkgs, pkg)
+		linker.pkgsByName[pkg.PkgPath] = pkg
+	}
+	return linker, nil
+}
+
+// MainPkgPath returns the package path of the last (main) package linked
+func (linker *Linker) MainPkgPath() string {
+	if len(linker.pkgs) == 0 {
+		return EmptyString
+	}
+	return linker.pkgs[len(linker.pkgs)-1].PkgPath
+}
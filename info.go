@@ -0,0 +1,164 @@
+package goloader
+
+import (
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eh-steve/goloader/objabi/symkind"
+)
+
+// ModuleInfo is a report of what a module contains and how it was linked, see CodeModule.Info.
+// It's serializable to JSON.
+type ModuleInfo struct {
+	Label             string
+	ImportPath        string
+	LoadTime          time.Time
+	GoVersion         string           // Go version the main package was compiled with, from its archive header
+	BuildInfo         *debug.BuildInfo // Build settings and dependency versions, if linked WithBuildInfo (as jit does)
+	Packages          []PackageInfo    // Packages linked into the module, in Autolib (initialization) order
+	DeduplicatedTypes []string         // Types whose descriptors were deduplicated against the host's or another module's
+	PatchedTypes      []PatchedType    // Host types whose unreachable methods were patched to call the module's code
+	HeapStrings       int              // String constants copied to the heap, which are retained after the module is unloaded
+	HeapStringBytes   int
+	InitTasks         []string // Init tasks run when the module was loaded, by symbol name
+}
+
+// PackageInfo describes a package linked into a module, and the size of its symbols in each of the module's segments
+type PackageInfo struct {
+	Path           string
+	ImportedBy     []string // The linked packages which import it, empty for the main package
+	CodeBytes      int
+	DataBytes      int
+	NoPtrDataBytes int
+	BSSBytes       int
+	NoPtrBSSBytes  int
+}
+
+// PatchedType is a host type whose methods (which the host's linker found unreachable) have been patched to call
+// a module's implementations until it's unloaded
+type PatchedType struct {
+	Type             string
+	InterfaceMethods []string // Methods whose ifn (used for interface calls) was patched
+	Methods          []string // Methods whose tfn (used for direct calls) was patched
+}
+
+// WithBuildInfo records the build settings and dependency versions of the code being linked, as reported by
+// CodeModule.Info
+func WithBuildInfo(info *debug.BuildInfo) func(*LinkerOptions) {
+	return func(options *LinkerOptions) {
+		options.BuildInfo = info
+	}
+}
+
+// packageInfo returns the linked packages in Autolib order, with the sizes of their symbols
+func (linker *Linker) packageInfo() []PackageInfo {
+	var paths []string
+	seen := make(map[string]struct{}, len(linker.pkgs))
+	for _, pkgPath := range linker.Autolib() {
+		if _, ok := seen[pkgPath]; !ok {
+			seen[pkgPath] = struct{}{}
+			paths = append(paths, pkgPath)
+		}
+	}
+	for _, pkg := range linker.pkgs {
+		if _, ok := seen[pkg.PkgPath]; !ok {
+			seen[pkg.PkgPath] = struct{}{}
+			paths = append(paths, pkg.PkgPath)
+		}
+	}
+	packages := make([]PackageInfo, len(paths))
+	byPath := make(map[string]*PackageInfo, len(paths))
+	for i, pkgPath := range paths {
+		packages[i].Path = pkgPath
+		byPath[pkgPath] = &packages[i]
+	}
+	for _, pkg := range linker.pkgs {
+		for _, imported := range pkg.AutoLib {
+			if info := byPath[imported]; info != nil && imported != pkg.PkgPath {
+				info.ImportedBy = append(info.ImportedBy, pkg.PkgPath)
+			}
+		}
+	}
+	for _, sym := range linker.symMap {
+		info := byPath[sym.Pkg]
+		if info == nil || sym.Offset == InvalidOffset || strings.HasPrefix(sym.Name, TypeStringPrefix) {
+			continue
+		}
+		switch sym.Kind {
+		case symkind.STEXT:
+			info.CodeBytes += sym.Size
+		case symkind.SDATA:
+			info.DataBytes += sym.Size
+		case symkind.SNOPTRDATA, symkind.SRODATA:
+			info.NoPtrDataBytes += sym.Size
+		case symkind.SBSS:
+			info.BSSBytes += sym.Size
+		case symkind.SNOPTRBSS, symkind.SCOVERAGE_AUXVAR, symkind.SCOVERAGE_COUNTER:
+			info.NoPtrBSSBytes += sym.Size
+		}
+	}
+	for i := range packages {
+		sort.Strings(packages[i].ImportedBy)
+	}
+	return packages
+}
+
+// mainGoVersion returns the Go version recorded in the main package's archive header
+func (linker *Linker) mainGoVersion() string {
+	if len(linker.pkgs) == 0 {
+		return EmptyString
+	}
+	h, _ := parseObjHeader(linker.pkgs[len(linker.pkgs)-1].TextHeader)
+	return h.version
+}
+
+// Info returns a report of the packages linked into the module and what it shares with (or changed in) the host
+func (cm *CodeModule) Info() *ModuleInfo {
+	info := &ModuleInfo{
+		Label:      cm.label,
+		ImportPath: cm.importPath,
+		LoadTime:   cm.loadTime,
+		GoVersion:  cm.goVersion,
+		BuildInfo:  cm.buildInfo,
+		Packages:   cm.packages,
+		InitTasks:  cm.initTasks,
+	}
+	for typeName := range cm.deduplicatedTypes {
+		info.DeduplicatedTypes = append(info.DeduplicatedTypes, typeName)
+	}
+	sort.Strings(info.DeduplicatedTypes)
+
+	patched := map[*_type]*PatchedType{}
+	patchedMethods := func(patchedMethods map[*_type]map[int]struct{}, names func(*PatchedType) *[]string) {
+		for t, indices := range patchedMethods {
+			p := patched[t]
+			if p == nil {
+				p = &PatchedType{Type: resolveFullyQualifiedSymbolName(t)}
+				patched[t] = p
+			}
+			methods := t.uncommon().methods()
+			sorted := make([]int, 0, len(indices))
+			for i := range indices {
+				sorted = append(sorted, i)
+			}
+			sort.Ints(sorted)
+			for _, i := range sorted {
+				*names(p) = append(*names(p), t.nameOff(methods[i].name).name())
+			}
+		}
+	}
+	patchedMethods(cm.patchedTypeMethodsIfn, func(p *PatchedType) *[]string { return &p.InterfaceMethods })
+	patchedMethods(cm.patchedTypeMethodsTfn, func(p *PatchedType) *[]string { return &p.Methods })
+	for _, p := range patched {
+		info.PatchedTypes = append(info.PatchedTypes, *p)
+	}
+	sort.Slice(info.PatchedTypes, func(i, j int) bool { return info.PatchedTypes[i].Type < info.PatchedTypes[j].Type })
+
+	for _, s := range cm.heapStrings {
+		info.HeapStrings++
+		info.HeapStringBytes += len(*s)
+	}
+	return info
+}
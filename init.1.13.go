@@ -37,10 +37,13 @@ func (linker *Linker) doInitialize(codeModule *CodeModule, symbolMap map[string]
 					shouldSkipDedup = true
 				}
 			}
+			x := (*initTask)(unsafe.Pointer(taskPtr))
 			if shouldSkipDedup {
-				x := (*initTask)(unsafe.Pointer(taskPtr))
 				x.state = 0 // Reset the inittask state in order to rerun the init function for the new version of the package
 			}
+			if x.state == 0 {
+				codeModule.initTasks = append(codeModule.initTasks, name)
+			}
 			doInit(adduintptr(taskPtr, 0))
 		}
 	}
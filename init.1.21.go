@@ -57,6 +57,9 @@ func (linker *Linker) doInitialize(codeModule *CodeModule, symbolMap map[string]
 				// Linker is expected to have stripped inittasks with no funcs
 				continue
 			}
+			if x.state == 0 {
+				codeModule.initTasks = append(codeModule.initTasks, name)
+			}
 			doInit1(adduintptr(taskPtr, 0))
 		}
 	}
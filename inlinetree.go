@@ -25,6 +25,10 @@ func (linker *Linker) addInlineTree(_f *_func, symbol *obj.ObjSymbol) (err error
 		}
 		linker.pctab = append(linker.pctab, symbol.Func.PCInline...)
 		for _, inl := range symbol.Func.InlTree {
+			callers := linker.inlinedCallers[inl.Func]
+			if len(callers) == 0 || callers[len(callers)-1] != funcname {
+				linker.inlinedCallers[inl.Func] = append(callers, funcname)
+			}
 			if _, ok := linker.namemap[inl.Func]; !ok {
 				linker.namemap[inl.Func] = len(linker.funcnametab)
 				linker.funcnametab = append(linker.funcnametab, []byte(inl.Func)...)
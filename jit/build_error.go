@@ -0,0 +1,159 @@
+package jit
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SnippetFileName is the file name reported in diagnostics for code built by BuildGoText
+const SnippetFileName = "snippet.go"
+
+// Diagnostic is a single error reported by the go command or compiler
+type Diagnostic struct {
+	File    string // File name as given by the caller (or a virtual name), empty if the error has no position
+	Line    int
+	Column  int
+	Message string
+	Package string // Import path of the package the error occurred in, if known
+	Stage   BuildStage
+}
+
+func (d Diagnostic) String() string {
+	switch {
+	case d.File == "":
+		return d.Message
+	case d.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	case d.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	default:
+		return fmt.Sprintf("%s: %s", d.File, d.Message)
+	}
+}
+
+// BuildError is returned (possibly wrapped) by the Build* functions when the go command or the linker fails,
+// and can be retrieved with errors.As
+type BuildError struct {
+	Stage       BuildStage
+	Diagnostics []Diagnostic
+	Output      string // Raw output of the failing command, if any
+	Err         error
+}
+
+func (e *BuildError) Error() string {
+	if len(e.Diagnostics) == 0 {
+		if e.Output != "" {
+			return fmt.Sprintf("jit build failed during %s stage: %s\n%s", e.Stage, e.Err, e.Output)
+		}
+		return fmt.Sprintf("jit build failed during %s stage: %s", e.Stage, e.Err)
+	}
+	lines := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		lines = append(lines, d.String())
+	}
+	return fmt.Sprintf("jit build failed during %s stage with %d error(s):\n%s", e.Stage, len(e.Diagnostics), strings.Join(lines, "\n"))
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+var diagnosticPos = regexp.MustCompile(`^(.+?\.(?:go|s|c|h|mod|sum)):(\d+)(?::(\d+))?(?:: (.*))?$`)
+
+func parsePos(pos string) (file string, line, column int, rest string, ok bool) {
+	m := diagnosticPos.FindStringSubmatch(pos)
+	if m == nil {
+		return "", 0, 0, "", false
+	}
+	line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		column, _ = strconv.Atoi(m[3])
+	}
+	return m[1], line, column, m[4], true
+}
+
+// displayFileName maps a path printed by the go command (which may be relative to workDir) back to the name the caller used
+func (config *BuildConfig) displayFileName(workDir, file string) string {
+	absFile := file
+	if !filepath.IsAbs(absFile) && workDir != "" {
+		absFile = filepath.Join(workDir, file)
+	}
+	if name, ok := config.fileNames[filepath.Clean(absFile)]; ok {
+		return name
+	}
+	if name, ok := config.fileNames[file]; ok {
+		return name
+	}
+	return absFile
+}
+
+// parseDiagnostics parses compiler/go command output of the form:
+//
+//	# some/package
+//	./file.go:12:3: undefined: foo
+//		continuation of previous message
+func (config *BuildConfig) parseDiagnostics(output string, stage BuildStage, workDir, pkgPath string) []Diagnostic {
+	var diagnostics []Diagnostic
+	currentPkg := pkgPath
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "# ") {
+			currentPkg = strings.Fields(line[2:])[0]
+			continue
+		}
+		if file, lineNo, column, message, ok := parsePos(line); ok && message != "" {
+			diagnostics = append(diagnostics, Diagnostic{
+				File:    config.displayFileName(workDir, file),
+				Line:    lineNo,
+				Column:  column,
+				Message: message,
+				Package: currentPkg,
+				Stage:   stage,
+			})
+			continue
+		}
+		if (strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "  ")) && len(diagnostics) > 0 {
+			last := &diagnostics[len(diagnostics)-1]
+			last.Message += "\n" + strings.TrimSpace(line)
+		}
+	}
+	return diagnostics
+}
+
+func (config *BuildConfig) newOutputBuildError(stage BuildStage, workDir, pkgPath, output string, err error) *BuildError {
+	return &BuildError{
+		Stage:       stage,
+		Diagnostics: config.parseDiagnostics(output, stage, workDir, pkgPath),
+		Output:      output,
+		Err:         config.offlineError(output, err),
+	}
+}
+
+func (config *BuildConfig) newPackageBuildError(stage BuildStage, workDir string, pkg *Package, pkgErrors []*PackageError) *BuildError {
+	buildErr := &BuildError{Stage: stage}
+	var messages []string
+	for _, pkgErr := range pkgErrors {
+		d := Diagnostic{Message: pkgErr.Err, Stage: stage, Package: pkg.ImportPath}
+		if len(pkgErr.ImportStack) > 0 {
+			d.Package = pkgErr.ImportStack[len(pkgErr.ImportStack)-1]
+		}
+		if file, line, column, _, ok := parsePos(pkgErr.Pos); ok {
+			d.File = config.displayFileName(workDir, file)
+			d.Line = line
+			d.Column = column
+			// Some errors repeat their own position at the start of the message
+			if _, _, _, message, ok := parsePos(pkgErr.Err); ok && message != "" {
+				d.Message = message
+			}
+		}
+		buildErr.Diagnostics = append(buildErr.Diagnostics, d)
+		messages = append(messages, pkgErr.Err)
+	}
+	buildErr.Err = config.offlineError(strings.Join(messages, "\n"), fmt.Errorf("package %s has errors: %s", pkg.ImportPath, strings.Join(messages, "; ")))
+	return buildErr
+}
@@ -0,0 +1,264 @@
+package jit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/eh-steve/goloader"
+	"github.com/eh-steve/goloader/obj"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BuildCache is a persistent on-disk cache of dependency archives, shared between builds via BuildConfig.BuildCache.
+// Archives are keyed by import path, module version, Go toolchain version, build flags and the host binary's build ID,
+// and are partitioned by host build ID, so a rebuilt host binary or different toolchain never reuses stale archives.
+// Packages without a module version (the main module, or modules replaced by a local directory) are never cached,
+// since their contents can change without their key changing.
+// Parsed archives are also kept in memory, so repeated links of the same dependency skip re-reading the archive.
+type BuildCache struct {
+	dir     string
+	hostDir string
+
+	pkgsMutex sync.Mutex
+	pkgs      map[pkgCacheKey]*obj.Pkg
+
+	archiveHits   int64
+	archiveMisses int64
+	pkgHits       int64
+	pkgMisses     int64
+}
+
+type pkgCacheKey struct {
+	file    string
+	pkgPath string
+}
+
+type BuildCacheStats struct {
+	ArchiveHits   int64 // Dependency archives reused from disk instead of running go build
+	ArchiveMisses int64 // Dependency archives which had to be built
+	PkgHits       int64 // Parsed archives reused from memory
+	PkgMisses     int64 // Archives which had to be parsed
+}
+
+func NewBuildCache(dir string) (*BuildCache, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path of build cache dir %s: %w", dir, err)
+	}
+	hostBuildID, err := goloader.HostBuildID()
+	if err != nil {
+		return nil, fmt.Errorf("build cache requires the host binary's build ID: %w", err)
+	}
+	h := sha256.Sum256([]byte(hostBuildID))
+	hostDir := filepath.Join(absDir, "host_"+hex.EncodeToString(h[:8]))
+	err = os.MkdirAll(hostDir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("could not create build cache dir %s: %w", hostDir, err)
+	}
+	return &BuildCache{
+		dir:     absDir,
+		hostDir: hostDir,
+		pkgs:    map[pkgCacheKey]*obj.Pkg{},
+	}, nil
+}
+
+func (c *BuildCache) Dir() string {
+	return c.dir
+}
+
+func (c *BuildCache) Stats() BuildCacheStats {
+	return BuildCacheStats{
+		ArchiveHits:   atomic.LoadInt64(&c.archiveHits),
+		ArchiveMisses: atomic.LoadInt64(&c.archiveMisses),
+		PkgHits:       atomic.LoadInt64(&c.pkgHits),
+		PkgMisses:     atomic.LoadInt64(&c.pkgMisses),
+	}
+}
+
+// Prune deletes archives built for any host binary other than the running one
+func (c *BuildCache) Prune() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("could not read build cache dir %s: %w", c.dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(c.dir, entry.Name())
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "host_") && path != c.hostDir {
+			err = os.RemoveAll(path)
+			if err != nil {
+				return fmt.Errorf("could not prune build cache dir %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Clear deletes all archives for the running host binary and forgets all parsed archives
+func (c *BuildCache) Clear() error {
+	c.pkgsMutex.Lock()
+	c.pkgs = map[pkgCacheKey]*obj.Pkg{}
+	c.pkgsMutex.Unlock()
+	err := os.RemoveAll(c.hostDir)
+	if err != nil {
+		return fmt.Errorf("could not clear build cache dir %s: %w", c.hostDir, err)
+	}
+	return os.MkdirAll(c.hostDir, os.ModePerm)
+}
+
+func (c *BuildCache) LoadPkg(file, pkgPath string) (*obj.Pkg, bool) {
+	if !strings.HasPrefix(file, c.hostDir) {
+		return nil, false
+	}
+	c.pkgsMutex.Lock()
+	pkg, ok := c.pkgs[pkgCacheKey{file: file, pkgPath: pkgPath}]
+	c.pkgsMutex.Unlock()
+	if ok {
+		atomic.AddInt64(&c.pkgHits, 1)
+	} else {
+		atomic.AddInt64(&c.pkgMisses, 1)
+	}
+	return pkg, ok
+}
+
+func (c *BuildCache) StorePkg(file, pkgPath string, pkg *obj.Pkg) {
+	// Only archives inside the cache are immutable, anything else (e.g. the main package) may be rebuilt under the same path
+	if !strings.HasPrefix(file, c.hostDir) {
+		return
+	}
+	c.pkgsMutex.Lock()
+	c.pkgs[pkgCacheKey{file: file, pkgPath: pkgPath}] = pkg
+	c.pkgsMutex.Unlock()
+}
+
+func (c *BuildCache) archiveKey(config BuildConfig, pkg *Package) (string, bool) {
+	var moduleVersion string
+	if pkg.Standard {
+		moduleVersion = "std"
+	} else {
+		module := pkg.Module
+		if module == nil {
+			return "", false
+		}
+		if module.Replace != nil {
+			module = module.Replace
+		}
+		if module.Version == "" {
+			return "", false
+		}
+		moduleVersion = module.Path + "@" + module.Version
+	}
+	toolchainVersion, err := goToolchainVersion(config.GoBinary)
+	if err != nil {
+		return "", false
+	}
+	hostBuildID, err := goloader.HostBuildID()
+	if err != nil {
+		return "", false
+	}
+
+	h := sha256.New()
+	for _, part := range [][]string{
+		{pkg.ImportPath, moduleVersion, toolchainVersion, hostBuildID},
+		cacheRelevantBuildFlags(mergeBuildFlags(config.extraBuildFlags(), config.Dynlink)),
+		cacheRelevantEnv(config.buildEnv()),
+	} {
+		for _, s := range part {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+func (c *BuildCache) archivePath(key string) string {
+	return filepath.Join(c.hostDir, key[:2], key+".a")
+}
+
+func (c *BuildCache) lookupArchive(key string) (string, bool) {
+	path := c.archivePath(key)
+	if _, err := os.Stat(path); err == nil {
+		atomic.AddInt64(&c.archiveHits, 1)
+		return path, true
+	}
+	atomic.AddInt64(&c.archiveMisses, 1)
+	return path, false
+}
+
+// tempArchivePath returns a path to build into, which is then atomically renamed by commitArchive,
+// so that concurrent or interrupted builds never leave a partially written archive under its final name
+func (c *BuildCache) tempArchivePath(key string) (string, error) {
+	dir := filepath.Dir(c.archivePath(key))
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("could not create build cache dir %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, key+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp archive in build cache dir %s: %w", dir, err)
+	}
+	_ = f.Close()
+	return f.Name(), nil
+}
+
+func (c *BuildCache) commitArchive(tmpPath, key string) error {
+	err := os.Rename(tmpPath, c.archivePath(key))
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("could not move built archive into build cache: %w", err)
+	}
+	return nil
+}
+
+var toolchainVersions sync.Map
+
+func goToolchainVersion(goBinary string) (string, error) {
+	if version, ok := toolchainVersions.Load(goBinary); ok {
+		return version.(string), nil
+	}
+	env, err := goEnv(goBinary)
+	if err != nil {
+		return "", err
+	}
+	version := env["GOVERSION"]
+	if version == "" {
+		return "", fmt.Errorf("could not determine GOVERSION of %s", goBinary)
+	}
+	toolchainVersions.Store(goBinary, version)
+	return version, nil
+}
+
+func cacheRelevantEnv(env []string) []string {
+	var relevant []string
+	for _, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		switch key {
+		case "GOPATH", "GOCACHE", "GOMODCACHE", "GOTMPDIR", "GOENV", "GOROOT":
+			continue
+		case "CC", "CXX":
+		default:
+			if !strings.HasPrefix(key, "GO") && !strings.HasPrefix(key, "CGO_") {
+				continue
+			}
+		}
+		relevant = append(relevant, kv)
+	}
+	sort.Strings(relevant)
+	return relevant
+}
+
+func cacheRelevantBuildFlags(buildFlags []string) []string {
+	var relevant []string
+	for _, flag := range buildFlags {
+		// Overlays only ever replace files of the (uncacheable) main module, and their path is random per build
+		if strings.HasPrefix(flag, "-overlay") {
+			continue
+		}
+		relevant = append(relevant, flag)
+	}
+	return relevant
+}
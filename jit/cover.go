@@ -0,0 +1,21 @@
+package jit
+
+import (
+	"strings"
+)
+
+// coverFlags returns the flags to build packages with coverage instrumentation, which CodeModule.Coverage() reads
+func (config *BuildConfig) coverFlags() []string {
+	if !config.Cover {
+		return nil
+	}
+	mode := config.CoverMode
+	if mode == "" {
+		mode = "atomic"
+	}
+	flags := []string{"-cover", "-covermode=" + mode}
+	if len(config.CoverPackages) > 0 {
+		flags = append(flags, "-coverpkg="+strings.Join(config.CoverPackages, ","))
+	}
+	return flags
+}
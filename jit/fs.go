@@ -0,0 +1,264 @@
+package jit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// goOverlay is the JSON format accepted by the go command's -overlay flag
+type goOverlay struct {
+	Replace map[string]string
+}
+
+// virtualPathError rewrites the on-disk paths used to build an in-memory file tree back to their virtual names
+type virtualPathError struct {
+	err      error
+	replacer *strings.Replacer
+}
+
+func (e *virtualPathError) Error() string {
+	return e.replacer.Replace(e.err.Error())
+}
+
+func (e *virtualPathError) Unwrap() error {
+	return e.err
+}
+
+// BuildGoFS builds the package importPath from a tree of files in fsys, which must contain a go.mod at its root,
+// and may contain any number of other packages within that module.
+// Apart from go.mod and go.sum (which the go command may need to update), files are passed to the go command via
+// -overlay rather than being written into a module directory, and the build uses -trimpath, so file names in
+// errors and stack traces are the virtual module paths (e.g. example.com/mymodule/pkg/file.go).
+func BuildGoFS(config BuildConfig, fsys fs.FS, importPath string) (*LoadableUnit, error) {
+	return BuildGoFSContext(context.Background(), config, fsys, importPath)
+}
+
+// BuildGoFSContext is like BuildGoFS, but kills any running go commands and stops the build when ctx is done.
+func BuildGoFSContext(ctx context.Context, config BuildConfig, fsys fs.FS, importPath string) (*LoadableUnit, error) {
+	files := map[string][]byte{}
+	err := fs.WalkDir(fsys, ".", func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			return err
+		}
+		files[filePath] = data
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read files from fs: %w", err)
+	}
+	return BuildGoFileMapContext(ctx, config, files, importPath)
+}
+
+// BuildGoFileMap is like BuildGoFS, but takes a map of slash separated file paths (relative to the module root) to contents
+func BuildGoFileMap(config BuildConfig, files map[string][]byte, importPath string) (*LoadableUnit, error) {
+	return BuildGoFileMapContext(context.Background(), config, files, importPath)
+}
+
+// BuildGoFileMapContext is like BuildGoFileMap, but kills any running go commands and stops the build when ctx is done.
+func BuildGoFileMapContext(ctx context.Context, config BuildConfig, files map[string][]byte, importPath string) (*LoadableUnit, error) {
+	if _, ok := files["go.mod"]; !ok {
+		return nil, fmt.Errorf("no go.mod found at the root of the files for %s", importPath)
+	}
+
+	if config.GoBinary == "" {
+		config.GoBinary = "go"
+	}
+	err := PatchGC(config.GoBinary, config.DebugLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch gc: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(importPath))
+	hexHash := hex.EncodeToString(h.Sum(nil))
+
+	if config.TmpDir != "" {
+		absPathBuildDir, err := filepath.Abs(config.TmpDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path of tmp dir at %s: %w", config.TmpDir, err)
+		}
+		config.TmpDir = absPathBuildDir
+		_, err = os.Stat(config.TmpDir)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.MkdirAll(config.TmpDir, os.ModePerm)
+			if err != nil {
+				return nil, fmt.Errorf("could not create new temp dir at %s: %w", config.TmpDir, err)
+			}
+			if !config.KeepTempFiles {
+				defer os.RemoveAll(config.TmpDir)
+			}
+		}
+	}
+
+	rootBuildDir1, err := os.MkdirTemp(config.TmpDir, hexHash+"_*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create new tmp directory: %w", err)
+	}
+	rootBuildDir, err := filepath.Abs(rootBuildDir1)
+	if err != nil {
+		return nil, fmt.Errorf("could not get absolute path of root build %s: %w", rootBuildDir, err)
+	}
+	if !config.KeepTempFiles {
+		defer os.RemoveAll(rootBuildDir)
+	}
+
+	moduleDir := filepath.Join(rootBuildDir, "module")
+	overlayFile, fileNames, replacer, err := writeOverlay(files, moduleDir, filepath.Join(rootBuildDir, "overlay"))
+	if err != nil {
+		return nil, err
+	}
+	config.fileNames = fileNames
+
+	if config.ModuleSource != nil && config.ModuleSource.VendorDir != "" {
+		if _, ok := files["vendor/modules.txt"]; !ok {
+			vendorDir, err := filepath.Abs(config.ModuleSource.VendorDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get absolute path of vendor dir %s: %w", config.ModuleSource.VendorDir, err)
+			}
+			err = os.Symlink(vendorDir, filepath.Join(moduleDir, "vendor"))
+			if err != nil {
+				return nil, fmt.Errorf("could not link vendor dir into module: %w", err)
+			}
+		}
+	}
+
+	unit, err := buildOverlay(ctx, config, moduleDir, rootBuildDir, overlayFile, importPath)
+	if err != nil {
+		return nil, &virtualPathError{err: err, replacer: replacer}
+	}
+	return unit, nil
+}
+
+// writeOverlay writes go.mod/go.sum into moduleDir, and the contents of all other files into blobDir along with an
+// overlay file mapping their would-be paths inside moduleDir to their contents
+func writeOverlay(files map[string][]byte, moduleDir, blobDir string) (overlayFile string, fileNames map[string]string, replacer *strings.Replacer, err error) {
+	for _, dir := range []string{moduleDir, blobDir} {
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("could not create directory %s: %w", dir, err)
+		}
+	}
+	sortedNames := make([]string, 0, len(files))
+	for fileName := range files {
+		sortedNames = append(sortedNames, fileName)
+	}
+	sort.Strings(sortedNames)
+
+	overlay := goOverlay{Replace: map[string]string{}}
+	fileNames = map[string]string{}
+	var oldNew []string
+	for i, fileName := range sortedNames {
+		cleanName := path.Clean(fileName)
+		if path.IsAbs(cleanName) || cleanName == ".." || strings.HasPrefix(cleanName, "../") {
+			return "", nil, nil, fmt.Errorf("file %s is outside of the module root", fileName)
+		}
+		diskPath := filepath.Join(moduleDir, filepath.FromSlash(cleanName))
+		fileNames[diskPath] = cleanName
+		if cleanName == "go.mod" || cleanName == "go.sum" {
+			err = os.WriteFile(diskPath, files[fileName], 0644)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("could not write %s: %w", diskPath, err)
+			}
+			continue
+		}
+		blobPath := filepath.Join(blobDir, strconv.Itoa(i)+"_"+path.Base(cleanName))
+		err = os.WriteFile(blobPath, files[fileName], 0644)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("could not write overlay file %s: %w", blobPath, err)
+		}
+		overlay.Replace[diskPath] = blobPath
+		fileNames[blobPath] = cleanName
+		oldNew = append(oldNew, blobPath, cleanName)
+	}
+	oldNew = append(oldNew, moduleDir+string(filepath.Separator), "")
+
+	overlayJSON, err := json.Marshal(overlay)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not marshal overlay: %w", err)
+	}
+	overlayFile = filepath.Join(blobDir, "overlay.json")
+	err = os.WriteFile(overlayFile, overlayJSON, 0644)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not write overlay file %s: %w", overlayFile, err)
+	}
+	return overlayFile, fileNames, strings.NewReplacer(oldNew...), nil
+}
+
+func buildOverlay(ctx context.Context, config BuildConfig, moduleDir, buildDir, overlayFile, importPath string) (*LoadableUnit, error) {
+	overlayFlag := "-overlay=" + overlayFile
+	// Dependencies within the virtual module need the overlay too, so pass it to every build.
+	// -trimpath makes the compiler record file names relative to the module path rather than the temp dir
+	config.ExtraBuildFlags = append(append([]string{}, config.ExtraBuildFlags...), overlayFlag, "-trimpath")
+
+	if config.DebugLog {
+		log.Printf("Executing 'go list -json -x %s %s'\n", overlayFlag, importPath)
+	}
+	pkg, err := config.goList(ctx, importPath, moduleDir, overlayFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pkg.DepsErrors) > 0 {
+		if config.DebugLog {
+			log.Printf("Executing 'go get -x %s %s'\n", overlayFlag, importPath)
+		}
+		err = config.goGet(ctx, importPath, moduleDir, overlayFlag)
+		if err != nil {
+			return nil, err
+		}
+		if config.DebugLog {
+			log.Printf("Executing 'go list -json -x %s %s' (again)\n", overlayFlag, importPath)
+		}
+		pkg, err = config.goList(ctx, importPath, moduleDir, overlayFlag)
+		if err != nil {
+			return nil, err
+		}
+		if len(pkg.DepsErrors) > 0 {
+			return nil, config.newPackageBuildError(StageList, moduleDir, pkg, pkg.DepsErrors)
+		}
+	}
+
+	h := sha256.New()
+	h.Write([]byte(importPath))
+	outputFilePath := filepath.Join(buildDir, hex.EncodeToString(h.Sum(nil))+".a")
+
+	err = execBuild(ctx, config, moduleDir, outputFilePath, []string{importPath})
+	if err != nil {
+		return nil, err
+	}
+
+	linkerOpts := config.linkerOpts()
+	stdLibPkgs, err := config.goListStd(ctx)
+	if err != nil {
+		return nil, err
+	}
+	linker, err := resolveDependencies(ctx, config, moduleDir, buildDir, outputFilePath, pkg.ImportPath, pkg, linkerOpts, stdLibPkgs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoadableUnit{
+		Linker:     linker,
+		ImportPath: pkg.ImportPath,
+		Package:    pkg,
+	}, nil
+}
@@ -0,0 +1,264 @@
+package jit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eh-steve/goloader"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// expectFuncSignatures reads the export data of the non-std host packages called by the linked JIT code (as resolved
+// from workDir, i.e. the versions the JIT code was compiled against), and records on the linker the signature the JIT
+// code expects each host function to have, so that goloader.Load can compare them against the host's own signatures.
+// This is best effort: if the export data can't be read, no signatures are recorded.
+func expectFuncSignatures(ctx context.Context, config BuildConfig, workDir string, linker *goloader.Linker, stdLibPkgs map[string]struct{}) {
+	globalMutex.Lock()
+	refs := linker.HostSymbolRefs(globalSymPtr)
+	globalMutex.Unlock()
+
+	refsByPkg := map[string][]string{}
+	for symName, pkgPath := range refs {
+		if _, isStd := stdLibPkgs[pkgPath]; isStd || pkgPath == "" {
+			continue
+		}
+		refsByPkg[pkgPath] = append(refsByPkg[pkgPath], symName)
+	}
+	if len(refsByPkg) == 0 {
+		return
+	}
+	pkgPaths := make([]string, 0, len(refsByPkg))
+	for pkgPath := range refsByPkg {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	exportFiles, err := config.goListExports(ctx, workDir, pkgPaths)
+	if err != nil {
+		if config.DebugLog {
+			log.Printf("Skipping function signature verification, could not list export data: %s\n", err)
+		}
+		return
+	}
+	imp := importer.ForCompiler(token.NewFileSet(), "gc", func(path string) (io.ReadCloser, error) {
+		exportFile, ok := exportFiles[path]
+		if !ok {
+			return nil, fmt.Errorf("no export data for package %s", path)
+		}
+		return os.Open(exportFile)
+	})
+
+	sigs := map[string]goloader.FuncSignature{}
+	for _, pkgPath := range pkgPaths {
+		pkg, err := imp.Import(pkgPath)
+		if err != nil {
+			if config.DebugLog {
+				log.Printf("Skipping function signature verification for %s, could not import export data: %s\n", pkgPath, err)
+			}
+			continue
+		}
+		for _, symName := range refsByPkg[pkgPath] {
+			if sig, ok := funcSignatureFromTypes(pkg, strings.TrimPrefix(unescapeSymName(symName), pkgPath+".")); ok {
+				sigs[symName] = sig
+			}
+		}
+	}
+	linker.ExpectFuncSignatures(sigs)
+}
+
+func (config *BuildConfig) goListExports(ctx context.Context, workDir string, pkgPaths []string) (map[string]string, error) {
+	args := []string{"list", "-e", "-export", "-deps", "-json=ImportPath,Export"}
+	for _, flag := range config.extraBuildFlags() {
+		// gcflags don't affect export data
+		if !strings.HasPrefix(strings.TrimLeft(flag, " "), "-gcflags") {
+			args = append(args, flag)
+		}
+	}
+	args = append(args, pkgPaths...)
+	stdout, stderr, err := config.runGoCmd(ctx, workDir, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run 'go list -export %s': %w\n%s", strings.Join(pkgPaths, " "), err, stderr)
+	}
+	exportFiles := map[string]string{}
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	for decoder.More() {
+		var pkg Package
+		err = decoder.Decode(&pkg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response of 'go list -export %s': %w", strings.Join(pkgPaths, " "), err)
+		}
+		if pkg.Export != "" {
+			exportFiles[pkg.ImportPath] = pkg.Export
+		}
+	}
+	return exportFiles, nil
+}
+
+// funcSignatureFromTypes looks up a function or method by its linker symbol name (without the package prefix),
+// e.g. "Func", "Type.Method" or "(*Type).Method"
+func funcSignatureFromTypes(pkg *types.Package, name string) (goloader.FuncSignature, bool) {
+	if strings.ContainsAny(name, "[]") {
+		// Generic instantiations are linked by shape, not by their declared signature
+		return goloader.FuncSignature{}, false
+	}
+	var sig *types.Signature
+	var recv string
+	if dot := strings.LastIndexByte(name, '.'); dot == -1 {
+		fn, ok := pkg.Scope().Lookup(name).(*types.Func)
+		if !ok {
+			return goloader.FuncSignature{}, false
+		}
+		sig = fn.Type().(*types.Signature)
+	} else {
+		typeName, methodName := name[:dot], name[dot+1:]
+		isPtr := strings.HasPrefix(typeName, "(*") && strings.HasSuffix(typeName, ")")
+		if isPtr {
+			typeName = typeName[2 : len(typeName)-1]
+		}
+		obj, ok := pkg.Scope().Lookup(typeName).(*types.TypeName)
+		if !ok {
+			return goloader.FuncSignature{}, false
+		}
+		named, ok := obj.Type().(*types.Named)
+		if !ok || named.TypeParams().Len() > 0 {
+			return goloader.FuncSignature{}, false
+		}
+		for i := 0; i < named.NumMethods(); i++ {
+			if named.Method(i).Name() == methodName {
+				sig = named.Method(i).Type().(*types.Signature)
+				break
+			}
+		}
+		if sig == nil {
+			return goloader.FuncSignature{}, false
+		}
+		recv = linkTypeName(named)
+		if isPtr {
+			recv = "*" + recv
+		}
+	}
+
+	var result goloader.FuncSignature
+	if sig.Recv() != nil {
+		result.Params = append(result.Params, recv)
+	}
+	// Variadic params are already typed as a slice, which is how they're passed
+	for i := 0; i < sig.Params().Len(); i++ {
+		result.Params = append(result.Params, linkTypeName(sig.Params().At(i).Type()))
+	}
+	for i := 0; i < sig.Results().Len(); i++ {
+		result.Results = append(result.Results, linkTypeName(sig.Results().At(i).Type()))
+	}
+	return result, true
+}
+
+// linkTypeName spells a type the way the linker names it in DWARF, or returns "" for types whose spelling isn't
+// worth reproducing exactly (non-empty struct and interface literals, generics, function-local types)
+func linkTypeName(t types.Type) string {
+	switch t := unalias(t).(type) {
+	case *types.Basic:
+		switch t.Kind() {
+		case types.Byte:
+			return "uint8"
+		case types.Rune:
+			return "int32"
+		case types.UnsafePointer:
+			return "unsafe.Pointer"
+		}
+		if t.Info()&types.IsUntyped != 0 {
+			return ""
+		}
+		return t.Name()
+	case *types.Named:
+		obj := t.Obj()
+		if t.TypeArgs().Len() > 0 {
+			return ""
+		}
+		if obj.Pkg() == nil {
+			return obj.Name()
+		}
+		if obj.Parent() != obj.Pkg().Scope() {
+			return ""
+		}
+		return obj.Pkg().Path() + "." + obj.Name()
+	case *types.Pointer:
+		return wrapLinkTypeName("*", t.Elem(), "")
+	case *types.Slice:
+		return wrapLinkTypeName("[]", t.Elem(), "")
+	case *types.Array:
+		return wrapLinkTypeName(fmt.Sprintf("[%d]", t.Len()), t.Elem(), "")
+	case *types.Map:
+		key := linkTypeName(t.Key())
+		if key == "" {
+			return ""
+		}
+		return wrapLinkTypeName("map["+key+"]", t.Elem(), "")
+	case *types.Chan:
+		switch t.Dir() {
+		case types.SendOnly:
+			return wrapLinkTypeName("chan<- ", t.Elem(), "")
+		case types.RecvOnly:
+			return wrapLinkTypeName("<-chan ", t.Elem(), "")
+		default:
+			if elem, ok := unalias(t.Elem()).(*types.Chan); ok && elem.Dir() == types.RecvOnly {
+				return wrapLinkTypeName("chan (", t.Elem(), ")")
+			}
+			return wrapLinkTypeName("chan ", t.Elem(), "")
+		}
+	case *types.Interface:
+		if t.NumMethods() == 0 && t.NumEmbeddeds() == 0 {
+			return "interface {}"
+		}
+		return ""
+	case *types.Struct:
+		if t.NumFields() == 0 {
+			return "struct {}"
+		}
+		return ""
+	case *types.Signature:
+		var params, results []string
+		for i := 0; i < t.Params().Len(); i++ {
+			name := linkTypeName(t.Params().At(i).Type())
+			if name == "" {
+				return ""
+			}
+			if t.Variadic() && i == t.Params().Len()-1 {
+				name = "..." + strings.TrimPrefix(name, "[]")
+			}
+			params = append(params, name)
+		}
+		for i := 0; i < t.Results().Len(); i++ {
+			name := linkTypeName(t.Results().At(i).Type())
+			if name == "" {
+				return ""
+			}
+			results = append(results, name)
+		}
+		s := "func(" + strings.Join(params, ", ") + ")"
+		switch len(results) {
+		case 0:
+			return s
+		case 1:
+			return s + " " + results[0]
+		default:
+			return s + " (" + strings.Join(results, ", ") + ")"
+		}
+	default:
+		return ""
+	}
+}
+
+func wrapLinkTypeName(prefix string, elem types.Type, suffix string) string {
+	name := linkTypeName(elem)
+	if name == "" {
+		return ""
+	}
+	return prefix + name + suffix
+}
@@ -2,12 +2,14 @@ package jit
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"time"
 )
@@ -112,46 +114,61 @@ type PackageError struct {
 }
 
 func GoModDownload(goCmd, workDir string, verbose bool, args ...string) error {
-	if verbose {
-		args = append([]string{"-x"}, args...)
+	config := &BuildConfig{GoBinary: goCmd, DebugLog: verbose}
+	return config.goModDownload(context.Background(), workDir, args...)
+}
+
+// runGoCmd runs the go command in workDir, returning its stdout and stderr, and echoing both if DebugLog is set
+func (config *BuildConfig) runGoCmd(ctx context.Context, workDir string, args ...string) (stdout, stderr string, err error) {
+	env, err := config.cmdEnv()
+	if err != nil {
+		return "", "", err
+	}
+	cmd := exec.CommandContext(ctx, config.GoBinary, args...)
+	cmd.Dir = workDir
+	cmd.Env = env
+	stdoutBuf, stdErrBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	if config.DebugLog {
+		cmd.Stdout = io.MultiWriter(stdoutBuf, os.Stdout)
+		cmd.Stderr = io.MultiWriter(stdErrBuf, os.Stderr)
+	} else {
+		cmd.Stdout = stdoutBuf
+		cmd.Stderr = stdErrBuf
 	}
-	dlCmd := exec.Command(goCmd, append([]string{"mod", "download"}, args...)...)
-	if verbose {
-		dlCmd.Stdout = os.Stdout
-		dlCmd.Stderr = os.Stderr
+	err = cmd.Run()
+	return stdoutBuf.String(), stdErrBuf.String(), err
+}
+
+func (config *BuildConfig) goModDownload(ctx context.Context, workDir string, args ...string) error {
+	if config.DebugLog {
+		args = append([]string{"-x"}, args...)
 	}
-	dlCmd.Dir = workDir
-	err := dlCmd.Run()
+	_, stderr, err := config.runGoCmd(ctx, workDir, append([]string{"mod", "download"}, args...)...)
 	if err != nil {
-		return fmt.Errorf("failed to go mod download %s", args)
+		return stageError(ctx, StageDownload, config.newOutputBuildError(StageDownload, workDir, "", stderr, fmt.Errorf("failed to go mod download %s: %w", args, err)))
 	}
 
-	tidyCmd := exec.Command(goCmd, "mod", "tidy")
-	if verbose {
-		tidyCmd.Stdout = os.Stdout
-		tidyCmd.Stderr = os.Stderr
-	}
-	err = tidyCmd.Run()
+	_, stderr, err = config.runGoCmd(ctx, "", "mod", "tidy")
 	if err != nil {
-		return fmt.Errorf("failed to go mod tidy: %s", err)
+		return stageError(ctx, StageDownload, config.newOutputBuildError(StageDownload, workDir, "", stderr, fmt.Errorf("failed to go mod tidy: %w", err)))
 	}
 	return nil
 }
 
 func GoGet(goCmd, packagePath, workDir string, verbose bool) error {
+	config := &BuildConfig{GoBinary: goCmd, DebugLog: verbose}
+	return config.goGet(context.Background(), packagePath, workDir)
+}
+
+func (config *BuildConfig) goGet(ctx context.Context, packagePath, workDir string, extraArgs ...string) error {
 	var args = []string{"get"}
-	if verbose {
+	if config.DebugLog {
 		args = append(args, "-x")
 	}
-	goGetCmd := exec.Command(goCmd, append(args, packagePath)...)
-	goGetCmd.Dir = workDir
-	if verbose {
-		goGetCmd.Stderr = os.Stderr
-		goGetCmd.Stdout = os.Stdout
-	}
-	output, err := goGetCmd.CombinedOutput()
+	args = append(args, extraArgs...)
+	stdout, stderr, err := config.runGoCmd(ctx, workDir, append(args, packagePath)...)
 	if err != nil {
-		return fmt.Errorf("failed to go get %s: %s", packagePath, output)
+		return stageError(ctx, StageGet, config.newOutputBuildError(StageGet, workDir, packagePath, stderr, fmt.Errorf("failed to go get %s: %w\n%s", packagePath, err, stdout)))
 	}
 	return nil
 }
@@ -159,53 +176,94 @@ func GoGet(goCmd, packagePath, workDir string, verbose bool) error {
 var stdLibsByGoCmd sync.Map
 
 func GoListStd(goCmd string) map[string]struct{} {
-	cacheLookup, ok := stdLibsByGoCmd.Load(goCmd)
-	if ok {
-		return cacheLookup.(map[string]struct{})
-	}
-	stdLibPkgs := map[string]struct{}{}
-	cmd := exec.Command(goCmd, "list", "std")
-	output, err := cmd.CombinedOutput()
+	config := &BuildConfig{GoBinary: goCmd}
+	stdLibPkgs, err := config.goListStd(context.Background())
 	if err != nil {
 		log.Printf("goloader/jit failed to list std packages: %s\n", err)
 		return nil
 	}
-	for _, pkgName := range bytes.Split(output, []byte("\n")) {
-		stdLibPkgs[string(pkgName)] = struct{}{}
-	}
-	stdLibsByGoCmd.Store(goCmd, stdLibPkgs)
 	return stdLibPkgs
 }
 
+// goListStd lists the standard library packages with the build's environment (which may e.g. set GOROOT), caching
+// them per go command and environment
+func (config *BuildConfig) goListStd(ctx context.Context) (map[string]struct{}, error) {
+	env, err := config.cmdEnv()
+	if err != nil {
+		return nil, err
+	}
+	key := config.GoBinary + "\x00" + strings.Join(env, "\x00")
+	cacheLookup, ok := stdLibsByGoCmd.Load(key)
+	if ok {
+		return cacheLookup.(map[string]struct{}), nil
+	}
+	stdout, stderr, err := config.runGoCmd(ctx, "", "list", "std")
+	if err != nil {
+		return nil, stageError(ctx, StageList, fmt.Errorf("failed to run 'go list std': %w\n%s", err, stderr))
+	}
+	stdLibPkgs := map[string]struct{}{}
+	for _, pkgName := range strings.Fields(stdout) {
+		stdLibPkgs[pkgName] = struct{}{}
+	}
+	stdLibsByGoCmd.Store(key, stdLibPkgs)
+	return stdLibPkgs, nil
+}
+
 func GoList(goCmd, absPath, workDir string, verbose bool) (*Package, error) {
+	config := &BuildConfig{GoBinary: goCmd, DebugLog: verbose}
+	return config.goList(context.Background(), absPath, workDir)
+}
+
+func (config *BuildConfig) goList(ctx context.Context, absPath, workDir string, extraArgs ...string) (*Package, error) {
 	args := []string{"list", "-json"}
-	if verbose {
+	if config.DebugLog {
 		args = append(args, "-x")
 	}
+	args = append(args, extraArgs...)
 	args = append(args, absPath)
-	golistCmd := exec.Command(goCmd, args...)
-	golistCmd.Dir = workDir
-
-	stdoutBuf, stdErrBuf := &bytes.Buffer{}, &bytes.Buffer{}
-
-	if verbose {
-		golistCmd.Stderr = io.MultiWriter(stdErrBuf, os.Stderr)
-	} else {
-		golistCmd.Stderr = stdErrBuf
+	stdout, stderr, err := config.runGoCmd(ctx, workDir, args...)
+	if err != nil {
+		return nil, stageError(ctx, StageList, config.newOutputBuildError(StageList, workDir, "", stderr, fmt.Errorf("failed to run 'go list -json %s': %w", absPath, err)))
 	}
-	golistCmd.Stdout = stdoutBuf
 	pkg := Package{}
-
-	err := golistCmd.Run()
+	err = json.Unmarshal([]byte(stdout), &pkg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to run 'go list -json %s': %w\nstderr:\n%s", absPath, err, stdErrBuf.String())
+		return nil, fmt.Errorf("failed to decode response of 'go list -json %s': %w\nstderr:\n%s", absPath, err, stderr)
 	}
-	err = json.Unmarshal(stdoutBuf.Bytes(), &pkg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode response of 'go list -json %s': %w\nstderr:\n%s", absPath, err, stdErrBuf.String())
+	if pkg.Error != nil {
+		return nil, config.newPackageBuildError(StageList, workDir, &pkg, []*PackageError{pkg.Error})
 	}
 	if len(pkg.GoFiles)+len(pkg.CgoFiles) == 0 {
 		return nil, fmt.Errorf("no Go files found in directory %s", absPath)
 	}
 	return &pkg, nil
 }
+
+// GoListPackages runs 'go list -e -json' for several import paths at once and decodes the stream of results.
+func GoListPackages(goCmd, workDir string, verbose bool, importPaths ...string) ([]*Package, error) {
+	config := &BuildConfig{GoBinary: goCmd, DebugLog: verbose}
+	return config.goListPackages(context.Background(), workDir, importPaths...)
+}
+
+func (config *BuildConfig) goListPackages(ctx context.Context, workDir string, importPaths ...string) ([]*Package, error) {
+	args := []string{"list", "-e", "-json"}
+	if config.DebugLog {
+		args = append(args, "-x")
+	}
+	args = append(args, importPaths...)
+	stdout, stderr, err := config.runGoCmd(ctx, workDir, args...)
+	if err != nil {
+		return nil, stageError(ctx, StageList, config.newOutputBuildError(StageList, workDir, "", stderr, fmt.Errorf("failed to run 'go list -e -json %s': %w", strings.Join(importPaths, " "), err)))
+	}
+	var pkgs []*Package
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	for decoder.More() {
+		pkg := &Package{}
+		err = decoder.Decode(pkg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response of 'go list -e -json %s': %w", strings.Join(importPaths, " "), err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,323 @@
+package jit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	testMainPkgName  = "goloadertestmain"
+	testMainDir      = "goloader_testmain"
+	xTestDir         = "goloader_xtest"
+	testSuiteFunc    = "TestSuite"
+	testFileSuffix   = "_goloader.go"
+	testMainFileName = "testmain" + testFileSuffix
+)
+
+// TestUnit is a package built together with its tests by BuildGoTests.
+// Its LoadableUnit is a generated package listing the tests, which imports the package under test.
+type TestUnit struct {
+	*LoadableUnit
+	PkgPath string // Import path of the package under test
+	PkgDir  string // Directory of the package under test
+}
+
+// BuildGoTests builds the package at pathToGoPackage along with its _test.go files (like 'go test -c'), so that its
+// tests, benchmarks, fuzz seed corpora and examples can be run inside the host process by TestUnit.Run.
+// Internal test files are compiled into the package itself and external (package x_test) test files into a
+// virtual package, all via -overlay, so the package's directory isn't modified.
+// Like the go command, only functions with the signatures of tests, benchmarks, fuzz targets and examples are
+// collected. A TestMain function is never called, since it would exit the host process.
+func BuildGoTests(config BuildConfig, pathToGoPackage string) (*TestUnit, error) {
+	return BuildGoTestsContext(context.Background(), config, pathToGoPackage)
+}
+
+// BuildGoTestsContext is like BuildGoTests, but kills any running go commands and stops the build when ctx is done.
+func BuildGoTestsContext(ctx context.Context, config BuildConfig, pathToGoPackage string) (*TestUnit, error) {
+	absPath, err := filepath.Abs(pathToGoPackage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path at %s: %w", pathToGoPackage, err)
+	}
+	fileInfo, err := os.Stat(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat path at %s: %w", absPath, err)
+	}
+	if !fileInfo.IsDir() {
+		return nil, fmt.Errorf("path at %s is not a directory", absPath)
+	}
+
+	if config.GoBinary == "" {
+		config.GoBinary = "go"
+	}
+	err = PatchGC(config.GoBinary, config.DebugLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch gc: %w", err)
+	}
+
+	if config.DebugLog {
+		log.Printf("Executing 'go list -json -x %s'\n", absPath)
+	}
+	pkg, err := config.goList(ctx, absPath, absPath)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Module == nil || pkg.Module.GoMod == "" {
+		return nil, fmt.Errorf("could not find module/go.mod file for path %s", absPath)
+	}
+	if pkg.Name == "main" {
+		return nil, fmt.Errorf("can't build tests of main package %s, since it can't be imported", pkg.ImportPath)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(absPath))
+	h.Write([]byte("_test"))
+	hexHash := hex.EncodeToString(h.Sum(nil))
+
+	if config.TmpDir != "" {
+		absPathBuildDir, err := filepath.Abs(config.TmpDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path of tmp dir at %s: %w", config.TmpDir, err)
+		}
+		config.TmpDir = absPathBuildDir
+		_, err = os.Stat(config.TmpDir)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.MkdirAll(config.TmpDir, os.ModePerm)
+			if err != nil {
+				return nil, fmt.Errorf("could not create new temp dir at %s: %w", config.TmpDir, err)
+			}
+			if !config.KeepTempFiles {
+				defer os.RemoveAll(config.TmpDir)
+			}
+		}
+	}
+
+	rootBuildDir1, err := os.MkdirTemp(config.TmpDir, hexHash+"_*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create new tmp directory: %w", err)
+	}
+	rootBuildDir, err := filepath.Abs(rootBuildDir1)
+	if err != nil {
+		return nil, fmt.Errorf("could not get absolute path of root build %s: %w", rootBuildDir, err)
+	}
+	if !config.KeepTempFiles {
+		defer os.RemoveAll(rootBuildDir)
+	}
+
+	overlayFile, fileNames, err := writeTestOverlay(pkg, rootBuildDir)
+	if err != nil {
+		return nil, err
+	}
+	config.fileNames = fileNames
+
+	unit, err := buildOverlay(ctx, config, pkg.Dir, rootBuildDir, overlayFile, pkg.ImportPath+"/"+testMainDir)
+	if err != nil {
+		return nil, err
+	}
+	return &TestUnit{
+		LoadableUnit: unit,
+		PkgPath:      pkg.ImportPath,
+		PkgDir:       pkg.Dir,
+	}, nil
+}
+
+// testFuncs are the tests found in a package's _test.go files
+type testFuncs struct {
+	Tests       []testFunc
+	Benchmarks  []testFunc
+	FuzzTargets []testFunc
+	Examples    []testExample
+	ImportTest  bool
+	ImportXTest bool
+}
+
+type testFunc struct {
+	Package string // "_test" or "_xtest"
+	Name    string
+}
+
+type testExample struct {
+	testFunc
+	Output    string
+	Unordered bool
+}
+
+// writeTestOverlay writes an overlay which adds the package's test files to the package itself (internal tests) or a
+// virtual sub-package (external tests), along with a generated package listing all of them.
+// The returned file names map the overlaid paths back to the original test files for diagnostics.
+func writeTestOverlay(pkg *Package, buildDir string) (overlayFile string, fileNames map[string]string, err error) {
+	funcs := &testFuncs{}
+	overlay := goOverlay{Replace: map[string]string{}}
+	fileNames = map[string]string{}
+
+	for _, files := range []struct {
+		names   []string
+		dir     string
+		pkgName string
+	}{
+		{names: pkg.TestGoFiles, dir: pkg.Dir, pkgName: "_test"},
+		{names: pkg.XTestGoFiles, dir: filepath.Join(pkg.Dir, xTestDir), pkgName: "_xtest"},
+	} {
+		for _, name := range files.names {
+			srcPath := filepath.Join(pkg.Dir, name)
+			err = funcs.load(srcPath, files.pkgName)
+			if err != nil {
+				return "", nil, err
+			}
+			// Files ending in _test.go are ignored by go build, so rename them (keeping any GOOS/GOARCH suffix out of
+			// the last element, since go list has already applied those constraints), with a line directive so that
+			// positions in test output and stack traces still refer to the original name
+			src, err := os.ReadFile(srcPath)
+			if err != nil {
+				return "", nil, fmt.Errorf("could not read test file %s: %w", srcPath, err)
+			}
+			blobPath := filepath.Join(buildDir, strconv.Itoa(len(overlay.Replace))+"_"+name)
+			err = os.WriteFile(blobPath, append([]byte("//line "+name+":1\n"), src...), 0644)
+			if err != nil {
+				return "", nil, fmt.Errorf("could not write overlay file %s: %w", blobPath, err)
+			}
+			overlayPath := filepath.Join(files.dir, strings.TrimSuffix(name, ".go")+testFileSuffix)
+			overlay.Replace[overlayPath] = blobPath
+			fileNames[overlayPath] = srcPath
+			fileNames[blobPath] = srcPath
+		}
+	}
+
+	testMainPath := filepath.Join(buildDir, testMainFileName)
+	err = os.WriteFile(testMainPath, []byte(funcs.testMain(pkg.ImportPath)), 0644)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not write test main %s: %w", testMainPath, err)
+	}
+	overlay.Replace[filepath.Join(pkg.Dir, testMainDir, testMainFileName)] = testMainPath
+
+	overlayJSON, err := json.Marshal(overlay)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not marshal overlay: %w", err)
+	}
+	overlayFile = filepath.Join(buildDir, "overlay.json")
+	err = os.WriteFile(overlayFile, overlayJSON, 0644)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not write overlay file %s: %w", overlayFile, err)
+	}
+	return overlayFile, fileNames, nil
+}
+
+// load collects the tests in a _test.go file, following the same rules as the go command ($GOROOT/src/cmd/go/internal/load/test.go)
+func (t *testFuncs) load(fileName, pkgName string) error {
+	f, err := parser.ParseFile(token.NewFileSet(), fileName, nil, parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("failed to parse test file %s: %w", fileName, err)
+	}
+	for _, d := range f.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		name := fn.Name.String()
+		switch {
+		case isTestFunc(fn, name, "Test", "T"):
+			t.Tests = append(t.Tests, testFunc{Package: pkgName, Name: name})
+		case isTestFunc(fn, name, "Benchmark", "B"):
+			t.Benchmarks = append(t.Benchmarks, testFunc{Package: pkgName, Name: name})
+		case isTestFunc(fn, name, "Fuzz", "F"):
+			t.FuzzTargets = append(t.FuzzTargets, testFunc{Package: pkgName, Name: name})
+		default:
+			continue
+		}
+		t.markImport(pkgName)
+	}
+	for _, e := range doc.Examples(f) {
+		// Examples without an output comment are compiled but not run
+		if e.Output == "" && !e.EmptyOutput {
+			continue
+		}
+		t.Examples = append(t.Examples, testExample{
+			testFunc:  testFunc{Package: pkgName, Name: "Example" + e.Name},
+			Output:    e.Output,
+			Unordered: e.Unordered,
+		})
+		t.markImport(pkgName)
+	}
+	return nil
+}
+
+func (t *testFuncs) markImport(pkgName string) {
+	if pkgName == "_test" {
+		t.ImportTest = true
+	} else {
+		t.ImportXTest = true
+	}
+}
+
+// isTestFunc reports whether fn is named prefix followed by a non-lower case character, and takes a single *testing.<arg>
+func isTestFunc(fn *ast.FuncDecl, name, prefix, arg string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) > len(prefix) {
+		r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+		if unicode.IsLower(r) {
+			return false
+		}
+	}
+	if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 || fn.Type.Params == nil || len(fn.Type.Params.List) != 1 || len(fn.Type.Params.List[0].Names) > 1 {
+		return false
+	}
+	ptr, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	// The testing package may be imported under any name
+	switch x := ptr.X.(type) {
+	case *ast.SelectorExpr:
+		return x.Sel.Name == arg
+	case *ast.Ident:
+		return x.Name == arg
+	}
+	return false
+}
+
+// testMain generates a package with a function returning the tests, in the form accepted by testing.MainStart
+func (t *testFuncs) testMain(importPath string) string {
+	b := &strings.Builder{}
+	_, _ = fmt.Fprintf(b, "package %s\n\nimport (\n\t\"testing\"\n", testMainPkgName)
+	if t.ImportTest {
+		_, _ = fmt.Fprintf(b, "\t_test %s\n", strconv.Quote(importPath))
+	}
+	if t.ImportXTest {
+		_, _ = fmt.Fprintf(b, "\t_xtest %s\n", strconv.Quote(importPath+"/"+xTestDir))
+	}
+	_, _ = fmt.Fprintf(b, ")\n\nfunc %s() ([]testing.InternalTest, []testing.InternalBenchmark, []testing.InternalFuzzTarget, []testing.InternalExample) {\n", testSuiteFunc)
+	b.WriteString("\ttests := []testing.InternalTest{\n")
+	for _, f := range t.Tests {
+		_, _ = fmt.Fprintf(b, "\t\t{Name: %q, F: %s.%s},\n", f.Name, f.Package, f.Name)
+	}
+	b.WriteString("\t}\n\tbenchmarks := []testing.InternalBenchmark{\n")
+	for _, f := range t.Benchmarks {
+		_, _ = fmt.Fprintf(b, "\t\t{Name: %q, F: %s.%s},\n", f.Name, f.Package, f.Name)
+	}
+	b.WriteString("\t}\n\tfuzzTargets := []testing.InternalFuzzTarget{\n")
+	for _, f := range t.FuzzTargets {
+		_, _ = fmt.Fprintf(b, "\t\t{Name: %q, Fn: %s.%s},\n", f.Name, f.Package, f.Name)
+	}
+	b.WriteString("\t}\n\texamples := []testing.InternalExample{\n")
+	for _, e := range t.Examples {
+		_, _ = fmt.Fprintf(b, "\t\t{Name: %q, F: %s.%s, Output: %q, Unordered: %t},\n", e.Name, e.Package, e.Name, e.Output, e.Unordered)
+	}
+	b.WriteString("\t}\n\treturn tests, benchmarks, fuzzTargets, examples\n}\n")
+	return b.String()
+}
@@ -0,0 +1,475 @@
+package jit
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestOptions select which tests to run and how, mirroring the flags of 'go test'
+type TestOptions struct {
+	Run       string // Regexp selecting tests, examples and fuzz targets to run, as for -run (all if empty)
+	Skip      string // Regexp selecting tests, examples and fuzz targets not to run, as for -skip (requires go1.20+)
+	Bench     string // Regexp selecting benchmarks to run, as for -bench (none if empty)
+	BenchTime string // Run each benchmark for a duration or number of iterations (e.g. "2s" or "100x"), as for -benchtime
+	BenchMem  bool   // Report memory allocations of benchmarks, as for -benchmem
+	Count     int    // Run each test and benchmark this many times, as for -count
+	Short     bool   // As for -short
+	FailFast  bool   // Don't start new tests after the first failure, as for -failfast
+	Chdir     bool   // Run in the package's directory like 'go test' does, e.g. so tests can read testdata (affects the whole process)
+}
+
+// TestReport is the outcome of TestUnit.Run
+type TestReport struct {
+	Passed     bool
+	Output     string // The complete verbose output, as printed by 'go test -v'
+	Duration   time.Duration
+	Tests      []TestResult // Top level tests, benchmarks, fuzz targets and examples, in the order they were run
+	Benchmarks []BenchmarkResult
+}
+
+type TestResult struct {
+	Name     string
+	Failed   bool
+	Skipped  bool
+	Duration time.Duration // As reported by the testing package, so rounded to 10ms
+	Output   string        // Output of the test and its subtests
+}
+
+type BenchmarkResult struct {
+	Name    string             // As printed, including any sub-benchmark and GOMAXPROCS suffix, e.g. BenchmarkFoo/small-8
+	N       int                // Number of iterations
+	Metrics map[string]float64 // Per iteration measurements by unit, e.g. "ns/op", "B/op", "allocs/op" and any reported by B.ReportMetric
+}
+
+// Failed returns the results of any failed tests
+func (r *TestReport) Failed() []TestResult {
+	var failed []TestResult
+	for _, test := range r.Tests {
+		if test.Failed {
+			failed = append(failed, test)
+		}
+	}
+	return failed
+}
+
+// The testing package's flags and os.Stdout are process-wide, so only one TestUnit can run at a time
+var testRunMutex sync.Mutex
+
+// Run loads the unit into the host process (unless it already has been) and runs the tests selected by options
+// through testing.MainStart. The loaded module is left for the caller to unload.
+//
+// Panics in top level test, benchmark, fuzz target and example functions are recovered and reported as failures. A
+// panic in a subtest or sub-benchmark (started by T.Run or B.Run), in a fuzz function (passed to F.Fuzz), or in any
+// other goroutine, crashes the host process, as the testing package re-panics it on that goroutine where it can't be
+// recovered. Tests which call os.Exit or deadlock also affect the host as a whole.
+//
+// WARNING: since the testing package writes its output to os.Stdout, Run replaces the process-wide os.Stdout with a
+// pipe while the tests run, so anything else in the host writing to os.Stdout in the meantime ends up in the
+// TestReport's Output instead. It also sets the testing package's flags on flag.CommandLine (restoring them
+// afterwards), and marks flag.CommandLine as parsed if the host hasn't parsed it yet, so the host should parse its
+// flags before calling Run.
+func (u *TestUnit) Run(options TestOptions) (*TestReport, error) {
+	if u == nil || u.LoadableUnit == nil {
+		return nil, fmt.Errorf("can't run nil TestUnit")
+	}
+	if u.Module == nil {
+		_, err := u.Load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	suiteFunc, ok := u.Module.SymbolsByPkg[u.ImportPath][testSuiteFunc]
+	if !ok {
+		return nil, fmt.Errorf("could not find %s.%s in loaded module", u.ImportPath, testSuiteFunc)
+	}
+	suite, ok := suiteFunc.(func() ([]testing.InternalTest, []testing.InternalBenchmark, []testing.InternalFuzzTarget, []testing.InternalExample))
+	if !ok {
+		return nil, fmt.Errorf("%s.%s has unexpected type %T", u.ImportPath, testSuiteFunc, suiteFunc)
+	}
+	tests, benchmarks, fuzzTargets, examples := suite()
+	for i := range tests {
+		tests[i].F = recoverTest(tests[i].F)
+	}
+	for i := range benchmarks {
+		benchmarks[i].F = recoverBenchmark(benchmarks[i].F)
+	}
+	for i := range fuzzTargets {
+		fuzzTargets[i].Fn = recoverFuzzTarget(fuzzTargets[i].Fn)
+	}
+	for i := range examples {
+		examples[i].F = recoverExample(examples[i].F)
+	}
+
+	testRunMutex.Lock()
+	defer testRunMutex.Unlock()
+
+	testing.Init()
+	// M.Run would otherwise parse the host's command line arguments
+	if !flag.Parsed() {
+		_ = flag.CommandLine.Parse(nil)
+	}
+	restoreFlags, err := setTestFlags(options)
+	if err != nil {
+		return nil, err
+	}
+	defer restoreFlags()
+
+	if options.Chdir {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get working directory: %w", err)
+		}
+		err = os.Chdir(u.PkgDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to change directory to %s: %w", u.PkgDir, err)
+		}
+		defer os.Chdir(pwd)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe for test output: %w", err)
+	}
+	output := &strings.Builder{}
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(output, r)
+		_ = r.Close()
+		close(copied)
+	}()
+
+	code, duration := func() (int, time.Duration) {
+		stdout := os.Stdout
+		os.Stdout = w
+		defer func() {
+			os.Stdout = stdout
+			_ = w.Close()
+		}()
+		start := time.Now()
+		m := testing.MainStart(&testDeps{importPath: u.PkgPath}, tests, benchmarks, fuzzTargets, examples)
+		return m.Run(), time.Since(start)
+	}()
+	<-copied
+
+	names := map[string]struct{}{}
+	for _, test := range tests {
+		names[test.Name] = struct{}{}
+	}
+	for _, benchmark := range benchmarks {
+		names[benchmark.Name] = struct{}{}
+	}
+	for _, fuzzTarget := range fuzzTargets {
+		names[fuzzTarget.Name] = struct{}{}
+	}
+	for _, example := range examples {
+		names[example.Name] = struct{}{}
+	}
+	report := parseTestOutput(output.String(), names)
+	report.Passed = code == 0
+	report.Duration = duration
+	return report, nil
+}
+
+// setTestFlags sets the testing package's flags for a run, and returns a function restoring their previous values
+func setTestFlags(options TestOptions) (restore func(), err error) {
+	values := map[string]string{
+		"test.v":        "true",
+		"test.run":      options.Run,
+		"test.bench":    options.Bench,
+		"test.benchmem": strconv.FormatBool(options.BenchMem),
+		"test.short":    strconv.FormatBool(options.Short),
+		"test.failfast": strconv.FormatBool(options.FailFast),
+		"test.count":    "1",
+		"test.fuzz":     "",
+		"test.list":     "",
+		// Timeouts panic the whole process
+		"test.timeout": "0",
+		// Don't interfere with the host's own profiles, test log or coverage, if it is a test binary
+		"test.cpuprofile":   "",
+		"test.memprofile":   "",
+		"test.blockprofile": "",
+		"test.mutexprofile": "",
+		"test.trace":        "",
+		"test.coverprofile": "",
+		"test.testlogfile":  "",
+		"test.paniconexit0": "false",
+	}
+	if options.Skip != "" {
+		if flag.Lookup("test.skip") == nil {
+			return nil, errors.New("TestOptions.Skip requires go1.20+")
+		}
+		values["test.skip"] = options.Skip
+	}
+	if options.BenchTime != "" {
+		values["test.benchtime"] = options.BenchTime
+	}
+	if options.Count > 0 {
+		values["test.count"] = strconv.Itoa(options.Count)
+	}
+
+	previous := map[string]string{}
+	restore = func() {
+		for name, value := range previous {
+			_ = flag.Set(name, value)
+		}
+	}
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			continue
+		}
+		previous[name] = f.Value.String()
+		err = flag.Set(name, value)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("invalid value %q for flag -%s: %w", value, name, err)
+		}
+	}
+	return restore, nil
+}
+
+// recoverTest reports panics in a top level test as test failures, since the testing package would otherwise re-panic
+// and crash the host. Panics in its subtests happen on their own goroutines, so aren't recovered.
+func recoverTest(f func(*testing.T)) func(*testing.T) {
+	return func(t *testing.T) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Errorf("panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		f(t)
+	}
+}
+
+func recoverBenchmark(f func(*testing.B)) func(*testing.B) {
+	return func(b *testing.B) {
+		defer func() {
+			if r := recover(); r != nil {
+				b.Errorf("panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		f(b)
+	}
+}
+
+func recoverFuzzTarget(fn func(*testing.F)) func(*testing.F) {
+	return func(f *testing.F) {
+		defer func() {
+			if r := recover(); r != nil {
+				f.Errorf("panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		fn(f)
+	}
+}
+
+// recoverExample prints a panic in an example as its output instead, which then fails to match the expected output
+func recoverExample(f func()) func() {
+	return func() {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		f()
+	}
+}
+
+var testLineRegexp = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP|BENCH): (\S+)(?: \(([0-9.]+s)\))?$`)
+
+// parseTestOutput attributes the lines of verbose test output to the top level tests in names, and parses benchmark results
+func parseTestOutput(output string, names map[string]struct{}) *TestReport {
+	report := &TestReport{Output: output}
+	indexes := map[string]int{}
+	current := -1
+	// Benchmark names are printed with a -GOMAXPROCS suffix
+	find := func(name string) int {
+		name = strings.SplitN(name, "/", 2)[0]
+		if _, ok := names[name]; !ok {
+			if i := strings.LastIndexByte(name, '-'); i > 0 {
+				if _, err := strconv.Atoi(name[i+1:]); err == nil {
+					name = name[:i]
+				}
+			}
+		}
+		if _, ok := names[name]; !ok {
+			return -1
+		}
+		index, ok := indexes[name]
+		if !ok {
+			index = len(report.Tests)
+			indexes[name] = index
+			report.Tests = append(report.Tests, TestResult{Name: name})
+		}
+		return index
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(nil, len(output)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "=== "):
+			// e.g. "=== RUN   TestFoo/bar", "=== PAUSE TestFoo", "=== CONT  TestFoo" or "=== NAME  TestFoo"
+			fields := strings.Fields(line)
+			if len(fields) >= 3 {
+				current = find(fields[2])
+			}
+		case testLineRegexp.MatchString(line):
+			m := testLineRegexp.FindStringSubmatch(line)
+			current = find(m[2])
+			// Only results of top level tests (which aren't indented) determine their status
+			if current >= 0 && !strings.HasPrefix(line, " ") {
+				result := &report.Tests[current]
+				switch m[1] {
+				case "FAIL":
+					result.Failed = true
+				case "SKIP":
+					result.Skipped = true
+				}
+				if m[3] != "" {
+					result.Duration, _ = time.ParseDuration(m[3])
+				}
+			}
+		case strings.HasPrefix(line, "Benchmark"):
+			if benchmark, ok := parseBenchmarkLine(line); ok {
+				report.Benchmarks = append(report.Benchmarks, benchmark)
+				current = find(benchmark.Name)
+			} else {
+				// The name of a running benchmark is printed before its result, and its sub-benchmarks' names on their own
+				current = find(strings.TrimSpace(line))
+			}
+		case line == "PASS" || line == "FAIL" || strings.HasPrefix(line, "testing: "):
+			current = -1
+		}
+		if current >= 0 {
+			report.Tests[current].Output += line + "\n"
+		}
+	}
+	return report
+}
+
+// parseBenchmarkLine parses a result line of the form "BenchmarkFoo-8   	 1000	 1234 ns/op	  16 B/op	 1 allocs/op"
+func parseBenchmarkLine(line string) (BenchmarkResult, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || len(fields)%2 != 0 {
+		return BenchmarkResult{}, false
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return BenchmarkResult{}, false
+	}
+	result := BenchmarkResult{Name: fields[0], N: n, Metrics: map[string]float64{}}
+	for i := 2; i < len(fields); i += 2 {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return BenchmarkResult{}, false
+		}
+		result.Metrics[fields[i+1]] = value
+	}
+	return result, true
+}
+
+// corpusEntry is the same type as internal/fuzz.CorpusEntry, see $GOROOT/src/testing/fuzz.go
+type corpusEntry = struct {
+	Parent     string
+	Path       string
+	Data       []byte
+	Values     []interface{}
+	Generation int
+	IsSeed     bool
+}
+
+var errFuzzingUnsupported = errors.New("fuzzing is not supported by goloader/jit")
+
+// testDeps implements the testing package's testDeps interface (a superset of its methods across Go versions), like
+// $GOROOT/src/testing/internal/testdeps/deps.go does for test binaries
+type testDeps struct {
+	importPath string
+	mu         sync.Mutex
+	regexps    map[string]*regexp.Regexp
+}
+
+func (d *testDeps) MatchString(pat, str string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	re, ok := d.regexps[pat]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pat)
+		if err != nil {
+			return false, err
+		}
+		if d.regexps == nil {
+			d.regexps = map[string]*regexp.Regexp{}
+		}
+		d.regexps[pat] = re
+	}
+	return re.MatchString(str), nil
+}
+
+func (d *testDeps) StartCPUProfile(w io.Writer) error {
+	return pprof.StartCPUProfile(w)
+}
+
+func (d *testDeps) StopCPUProfile() {
+	pprof.StopCPUProfile()
+}
+
+func (d *testDeps) WriteProfileTo(name string, w io.Writer, debug int) error {
+	return pprof.Lookup(name).WriteTo(w, debug)
+}
+
+func (d *testDeps) ImportPath() string {
+	return d.importPath
+}
+
+func (d *testDeps) ModulePath() string {
+	return ""
+}
+
+func (d *testDeps) StartTestLog(io.Writer) {}
+
+func (d *testDeps) StopTestLog() error {
+	return nil
+}
+
+func (d *testDeps) SetPanicOnExit0(bool) {}
+
+func (d *testDeps) CoordinateFuzzing(time.Duration, int64, time.Duration, int64, int, []corpusEntry, []reflect.Type, string, string) error {
+	return errFuzzingUnsupported
+}
+
+func (d *testDeps) RunFuzzWorker(func(corpusEntry) error) error {
+	return errFuzzingUnsupported
+}
+
+// ReadCorpus returns no entries, so fuzz targets only run their seed corpus added by F.Add
+func (d *testDeps) ReadCorpus(string, []reflect.Type) ([]corpusEntry, error) {
+	return nil, nil
+}
+
+func (d *testDeps) CheckCorpus([]interface{}, []reflect.Type) error {
+	return nil
+}
+
+func (d *testDeps) ResetCoverage() {}
+
+func (d *testDeps) SnapshotCoverage() {}
+
+func (d *testDeps) InitRuntimeCoverage() (mode string, tearDown func(coverprofile string, gocoverdir string) (string, error), snapcov func() float64) {
+	return "", nil, nil
+}
@@ -0,0 +1,85 @@
+package jit
+
+import (
+	"github.com/eh-steve/goloader"
+	"os"
+	"strings"
+)
+
+// hostBuildEnvKeys are the build settings recorded in the host binary which are passed to the go command as
+// environment variables. All of them change the generated code or the ABI, so JIT code must be built with the same.
+var hostBuildEnvKeys = []string{
+	"GOOS", "GOARCH", "CGO_ENABLED", "GOEXPERIMENT",
+	"GO386", "GOAMD64", "GOARM", "GOARM64", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64", "GOWASM",
+}
+
+// hostBuildFlags returns the build flags the host binary was built with which also need to be used to build JIT code
+func hostBuildFlags() []string {
+	settings := goloader.HostBuildSettings()
+	var flags []string
+	for _, boolFlag := range []string{"-race", "-msan", "-asan", "-trimpath"} {
+		if settings[boolFlag] == "true" {
+			flags = append(flags, boolFlag)
+		}
+	}
+	if tags := settings["-tags"]; tags != "" {
+		flags = append(flags, "-tags="+tags)
+	}
+	return flags
+}
+
+// hostBuildEnv returns the build environment the host binary was built with
+func hostBuildEnv() []string {
+	settings := goloader.HostBuildSettings()
+	var env []string
+	for _, key := range hostBuildEnvKeys {
+		if value, ok := settings[key]; ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env
+}
+
+func buildFlagName(flag string) string {
+	return strings.SplitN(strings.TrimLeft(flag, " "), "=", 2)[0]
+}
+
+// extraBuildFlags returns any coverage and debug flags and the host's build flags (unless IgnoreHostBuildSettings is
+// set), followed by ExtraBuildFlags.
+// Host flags which are also present in ExtraBuildFlags are dropped, so the user supplied ones take precedence.
+func (config *BuildConfig) extraBuildFlags() []string {
+	flags := config.coverFlags()
+	if config.Debug {
+		flags = append(flags, "-gcflags=-N -l")
+	}
+	if !config.IgnoreHostBuildSettings {
+		userFlags := make(map[string]struct{}, len(config.ExtraBuildFlags))
+		for _, flag := range config.ExtraBuildFlags {
+			userFlags[buildFlagName(flag)] = struct{}{}
+		}
+		for _, flag := range hostBuildFlags() {
+			if _, ok := userFlags[buildFlagName(flag)]; !ok {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return append(flags, config.ExtraBuildFlags...)
+}
+
+// buildEnv returns the host's build environment (unless IgnoreHostBuildSettings is set), followed by BuildEnv, whose
+// values take precedence since exec uses the last value of duplicate keys
+func (config *BuildConfig) buildEnv() []string {
+	if config.IgnoreHostBuildSettings {
+		return config.BuildEnv
+	}
+	return append(hostBuildEnv(), config.BuildEnv...)
+}
+
+// cmdEnv returns the full environment for a go command
+func (config *BuildConfig) cmdEnv() ([]string, error) {
+	moduleSourceEnv, err := config.moduleSourceEnv()
+	if err != nil {
+		return nil, err
+	}
+	return append(append(os.Environ(), config.buildEnv()...), moduleSourceEnv...), nil
+}
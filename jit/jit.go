@@ -3,6 +3,7 @@ package jit
 import (
 	"bytes"
 	"cmd/objfile/objabi"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -18,6 +19,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"strings"
 	"sync"
@@ -108,6 +110,21 @@ type BuildConfig struct {
 	SkipTypeDeduplicationForPackages []string
 	UnsafeBlindlyUseFirstmoduleTypes bool
 	Dynlink                          bool
+	BuildCache                       *BuildCache   // Optional persistent cache of built dependency archives, shared between builds
+	SkipFuncSignatureVerification    bool          // Don't check that host functions called by JIT code have the signatures it was compiled against
+	AllowNoHostDWARF                 bool          // Load without checking those signatures if the host was built without DWARF, instead of failing
+	ModuleSource                     *ModuleSource // Optional local source of modules for builds without network access
+	IgnoreHostBuildSettings          bool          // Don't build with the host binary's own build settings (-race, -tags, GOEXPERIMENT, GOAMD64 etc.)
+	Cover                            bool          // Build with coverage instrumentation, so CodeModule.Coverage() can report which code has run (go1.20+)
+	CoverMode                        string        // Coverage counter mode: "set", "count" or "atomic" (the default)
+	CoverPackages                    []string      // Patterns of packages to instrument (as for -coverpkg), defaults to the packages in the main module
+	Policy                           *Policy       // Optional restrictions on what the code being built may import, reference and contain
+	Debug                            bool          // Build without optimisations or inlining (-N -l), and register the code's DWARF with debuggers (see goloader.WithDebugInfo)
+	PerfMap                          bool          // Write the loaded code's symbols to /tmp/perf-<pid>.map for Linux perf (see goloader.WithPerfMap)
+	PerfJITDump                      bool          // Write the loaded code and its line info to a jitdump for Linux perf (see goloader.WithPerfJITDump)
+	PerfJITDumpDir                   string        // Directory to write the jitdump to, defaults to os.TempDir() (not TmpDir, which builds may remove)
+
+	fileNames map[string]string // Maps temporary on-disk file paths back to the names reported in diagnostics
 }
 
 func mergeBuildFlags(extraBuildFlags []string, dynlink bool) []string {
@@ -137,18 +154,53 @@ func mergeBuildFlags(extraBuildFlags []string, dynlink bool) []string {
 	return buildFlags
 }
 
-func execBuild(config BuildConfig, workDir, outputFilePath string, targets []string) error {
+// BuildStage identifies which part of the build pipeline was running when a build failed or was cancelled
+type BuildStage string
+
+const (
+	StageList     BuildStage = "list"
+	StageDownload BuildStage = "download"
+	StageGet      BuildStage = "get"
+	StageCompile  BuildStage = "compile"
+	StageDeps     BuildStage = "build dependencies"
+	StageLink     BuildStage = "link"
+)
+
+// stageError replaces err with the context's error (wrapped with the stage which was interrupted) if the context is done,
+// since a killed go command's own error is just "signal: killed"
+func stageError(ctx context.Context, stage BuildStage, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("jit build interrupted during %s stage: %w", stage, ctxErr)
+	}
+	return err
+}
+
+func execBuild(ctx context.Context, config BuildConfig, workDir, outputFilePath string, targets []string) error {
 	var args = []string{"build"}
-	args = append(args, mergeBuildFlags(config.ExtraBuildFlags, config.Dynlink)...)
+	args = append(args, mergeBuildFlags(config.extraBuildFlags(), config.Dynlink)...)
 
 	args = append(args, "-o", outputFilePath)
 	args = append(args, targets...)
 	if config.GoBinary == "" {
 		config.GoBinary = "go"
 	}
-	cmd := exec.Command(config.GoBinary, args...)
+	if config.Policy != nil {
+		stdLibPkgs, err := config.goListStd(ctx)
+		if err != nil {
+			return err
+		}
+		err = config.checkPolicySources(ctx, workDir, targets, stdLibPkgs)
+		if err != nil {
+			return err
+		}
+	}
+	env, err := config.cmdEnv()
+	if err != nil {
+		return &BuildError{Stage: StageCompile, Err: err}
+	}
+	cmd := exec.CommandContext(ctx, config.GoBinary, args...)
 	cmd.Dir = workDir
-	cmd.Env = append(os.Environ(), config.BuildEnv...)
+	cmd.Env = env
 
 	bufStdout := &bytes.Buffer{}
 	bufStdErr := &bytes.Buffer{}
@@ -161,23 +213,26 @@ func execBuild(config BuildConfig, workDir, outputFilePath string, targets []str
 		cmd.Stderr = bufStdErr
 	}
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		var stdoutStr string
 		if bufStdout.Len() > 0 {
 			stdoutStr = fmt.Sprintf("stdout:\n%s", bufStdout.String())
 		}
-		return fmt.Errorf("could not build with cmd:\n'%s': %w. %s\nstderr:\n%s", strings.Join(cmd.Args, " "), err, stdoutStr, bufStdErr.String())
+		return stageError(ctx, StageCompile, config.newOutputBuildError(StageCompile, workDir, "", bufStdErr.String(), fmt.Errorf("could not build with cmd:\n'%s': %w. %s", strings.Join(cmd.Args, " "), err, stdoutStr)))
 	}
 	return nil
 }
 
-func resolveDependencies(config BuildConfig, workDir, buildDir string, outputFilePath, packageName string, pkg *Package, linkerOpts []goloader.LinkerOptFunc, stdLibPkgs map[string]struct{}) (*goloader.Linker, error) {
+func resolveDependencies(ctx context.Context, config BuildConfig, workDir, buildDir string, outputFilePath, packageName string, pkg *Package, linkerOpts []goloader.LinkerOptFunc, stdLibPkgs map[string]struct{}) (*goloader.Linker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, stageError(ctx, StageLink, err)
+	}
 	// Now check whether all imported packages are available in the main binary, otherwise we need to build and load them too
 	linker, err := goloader.ReadObjs([]string{outputFilePath}, []string{packageName}, globalSymPtr, linkerOpts...)
 
 	if err != nil {
-		return nil, fmt.Errorf("could not read symbols from object file '%s': %w", outputFilePath, err)
+		return nil, &BuildError{Stage: StageLink, Err: fmt.Errorf("could not read symbols from object file '%s': %w", outputFilePath, err)}
 	}
 
 	globalMutex.Lock()
@@ -204,31 +259,118 @@ func resolveDependencies(config BuildConfig, workDir, buildDir string, outputFil
 		if config.DebugLog {
 			log.Printf("%d unresolved external symbols missing from main binary, will attempt to build dependencies\n", len(externalSymbolsWithoutSkip))
 		}
-		errDeps := buildAndLoadDeps(config, workDir, buildDir, sortedDeps, externalSymbols, externalSymbolsWithoutSkip, seen, &depImportPaths, &depBinaries, 0, linkerOpts, stdLibPkgs)
+		errDeps := buildAndLoadDeps(ctx, config, workDir, buildDir, sortedDeps, externalSymbols, externalSymbolsWithoutSkip, seen, &depImportPaths, &depBinaries, 0, linkerOpts, stdLibPkgs)
 		if errDeps != nil {
 			return nil, errDeps
 		}
 
+		if err = ctx.Err(); err != nil {
+			return nil, stageError(ctx, StageLink, err)
+		}
 		depsLinker, err := goloader.ReadObjs(depBinaries, depImportPaths, globalSymPtr, linkerOpts...)
 		if err != nil {
-			return nil, fmt.Errorf("could not read symbols from dependency object files '%s': %w", depImportPaths, err)
+			return nil, &BuildError{Stage: StageLink, Err: fmt.Errorf("could not read symbols from dependency object files '%s': %w", depImportPaths, err)}
 		}
 
 		requiredBy := depsLinker.UnresolvedExternalSymbolUsers(globalSymPtr)
 		if len(requiredBy) > 0 {
 			unresolvedList := make([]string, 0, len(requiredBy))
+			diagnostics := make([]Diagnostic, 0, len(requiredBy))
 			for symName, requiredByList := range requiredBy {
 				unresolvedList = append(unresolvedList, fmt.Sprintf("%s     required by: \n    %s\n", symName, strings.Join(requiredByList, "\n    ")))
+				diagnostics = append(diagnostics, Diagnostic{
+					Message: fmt.Sprintf("unresolved external symbol %s, required by: %s", symName, strings.Join(requiredByList, ", ")),
+					Stage:   StageLink,
+				})
 			}
 			sort.Strings(unresolvedList)
-			return nil, fmt.Errorf("still have %d unresolved external symbols despite building and linking dependencies...: \n%s", len(requiredBy), strings.Join(unresolvedList, "\n"))
+			sort.Slice(diagnostics, func(i, j int) bool {
+				return diagnostics[i].Message < diagnostics[j].Message
+			})
+			return nil, &BuildError{
+				Stage:       StageLink,
+				Diagnostics: diagnostics,
+				Err:         fmt.Errorf("still have %d unresolved external symbols despite building and linking dependencies...: \n%s", len(requiredBy), strings.Join(unresolvedList, "\n")),
+			}
 		}
 		linker.UnloadStrings()
 		linker = depsLinker
 	}
+	if config.Policy != nil {
+		err = config.checkPolicySymbols(workDir, linker, stdLibPkgs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !config.SkipFuncSignatureVerification {
+		expectFuncSignatures(ctx, config, workDir, linker, stdLibPkgs)
+	}
+	linker.Opts(goloader.WithBuildInfo(config.buildInfo(ctx, workDir, pkg, linker, stdLibPkgs)))
 	return linker, nil
 }
 
+// buildInfo describes how the linked packages were built - the toolchain, build flags and environment - and the
+// versions of the modules providing them, for CodeModule.Info
+func (config *BuildConfig) buildInfo(ctx context.Context, workDir string, pkg *Package, linker *goloader.Linker, stdLibPkgs map[string]struct{}) *debug.BuildInfo {
+	info := &debug.BuildInfo{Path: pkg.ImportPath}
+	if version, err := goToolchainVersion(config.GoBinary); err == nil {
+		info.GoVersion = version
+	}
+	for _, buildFlag := range mergeBuildFlags(config.extraBuildFlags(), config.Dynlink) {
+		kv := strings.SplitN(strings.TrimLeft(buildFlag, " "), "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "true")
+		}
+		info.Settings = append(info.Settings, debug.BuildSetting{Key: kv[0], Value: kv[1]})
+	}
+	for _, env := range config.buildEnv() {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 && (strings.HasPrefix(kv[0], "GO") || kv[0] == "CGO_ENABLED") {
+			info.Settings = append(info.Settings, debug.BuildSetting{Key: kv[0], Value: kv[1]})
+		}
+	}
+	if pkg.Module != nil {
+		info.Main = *debugModule(pkg.Module)
+	}
+
+	var deps []string
+	for _, pkgPath := range linker.Autolib() {
+		if _, ok := stdLibPkgs[pkgPath]; !ok && pkgPath != pkg.ImportPath {
+			deps = append(deps, pkgPath)
+		}
+	}
+	if len(deps) == 0 {
+		return info
+	}
+	listed, err := config.goListPackages(ctx, workDir, deps...)
+	if err != nil {
+		if config.DebugLog {
+			log.Printf("could not list dependencies' modules for build info: %s\n", err)
+		}
+		return info
+	}
+	seen := map[string]struct{}{info.Main.Path: {}}
+	for _, dep := range listed {
+		if dep.Module == nil {
+			continue
+		}
+		if _, ok := seen[dep.Module.Path]; !ok {
+			seen[dep.Module.Path] = struct{}{}
+			info.Deps = append(info.Deps, debugModule(dep.Module))
+		}
+	}
+	sort.Slice(info.Deps, func(i, j int) bool { return info.Deps[i].Path < info.Deps[j].Path })
+	return info
+}
+
+func debugModule(module *Module) *debug.Module {
+	m := &debug.Module{Path: module.Path, Version: module.Version}
+	if module.Replace != nil {
+		m.Replace = debugModule(module.Replace)
+	}
+	return m
+}
+
 var escapes = make(map[string]string)
 
 func init() {
@@ -308,7 +450,7 @@ func addCGoSymbols(externalUnresolvedSymbols map[string]*obj.Sym) {
 	}
 }
 
-func buildAndLoadDeps(config BuildConfig,
+func buildAndLoadDeps(ctx context.Context, config BuildConfig,
 	workDir, buildDir string,
 	sortedDeps []string,
 	unresolvedSymbols, unresolvedSymbolsWithoutSkip map[string]*obj.Sym,
@@ -329,7 +471,6 @@ func buildAndLoadDeps(config BuildConfig,
 	wg := sync.WaitGroup{}
 	var errs []error
 	var errsMutex sync.Mutex
-	wg.Add(len(missingDeps))
 
 	missingDepsSorted := make([]string, 0, len(missingDeps))
 	for k := range missingDeps {
@@ -337,7 +478,75 @@ func buildAndLoadDeps(config BuildConfig,
 	}
 	sort.Strings(missingDepsSorted)
 
+	if config.GoBinary == "" {
+		config.GoBinary = "go"
+	}
+	env, err := config.cmdEnv()
+	if err != nil {
+		return &BuildError{Stage: StageDeps, Err: err}
+	}
+
+	var missingDepPkgs = map[string]*Package{}
+	if config.BuildCache != nil {
+		// Module versions are needed to key the cache
+		listedPkgs, err := config.goListPackages(ctx, workDir, missingDepsSorted...)
+		if err != nil {
+			return fmt.Errorf("failed to list dependencies for build cache lookup: %w", err)
+		}
+		for _, listedPkg := range listedPkgs {
+			missingDepPkgs[listedPkg.ImportPath] = listedPkg
+		}
+	}
+
 	concurrencyLimit := make(chan struct{}, runtime.GOMAXPROCS(0))
+	buildDep := func(filename, missingDep, cacheKey string) {
+		defer func() {
+			wg.Done()
+			<-concurrencyLimit
+		}()
+		if config.DebugLog {
+			log.Printf("Building dependency '%s' (%s)\n", missingDep, filename)
+		}
+		outputPath := filename
+		if cacheKey != "" {
+			tmpPath, err := config.BuildCache.tempArchivePath(cacheKey)
+			if err != nil {
+				errsMutex.Lock()
+				errs = append(errs, err)
+				errsMutex.Unlock()
+				return
+			}
+			outputPath = tmpPath
+		}
+
+		args := []string{"build"}
+		args = append(args, mergeBuildFlags(config.extraBuildFlags(), config.Dynlink)...)
+		args = append(args, "-o", outputPath, missingDep)
+		command := exec.CommandContext(ctx, config.GoBinary, args...)
+		command.Dir = workDir
+		command.Env = env
+		bufStdout := &bytes.Buffer{}
+		bufStdErr := &bytes.Buffer{}
+		if config.DebugLog {
+			command.Stdout = io.MultiWriter(os.Stdout, bufStdout)
+			command.Stderr = io.MultiWriter(os.Stderr, bufStdErr)
+		} else {
+			command.Stdout = bufStdout
+			command.Stderr = bufStdErr
+		}
+
+		err := command.Run()
+		if err == nil && cacheKey != "" {
+			err = config.BuildCache.commitArchive(outputPath, cacheKey)
+		} else if err != nil && cacheKey != "" {
+			_ = os.Remove(outputPath)
+		}
+		if err != nil {
+			errsMutex.Lock()
+			errs = append(errs, config.newOutputBuildError(StageCompile, workDir, missingDep, bufStdErr.String(), fmt.Errorf("failed to build dependency '%s': %w\nstdout:\n %s", missingDep, err, bufStdout.String())))
+			errsMutex.Unlock()
+		}
+	}
 	for _, missingDep := range missingDepsSorted {
 		if _, ok := seen[missingDep]; ok {
 			continue
@@ -347,43 +556,30 @@ func buildAndLoadDeps(config BuildConfig,
 
 		filename := filepath.Join(buildDir, hex.EncodeToString(h.Sum(nil))+"___pkg___.a")
 
-		concurrencyLimit <- struct{}{}
-		go func(filename, missingDep string) {
-			if config.DebugLog {
-				log.Printf("Building dependency '%s' (%s)\n", missingDep, filename)
-			}
-			if config.GoBinary == "" {
-				config.GoBinary = "go"
+		var cacheKey string
+		var cached bool
+		if depPkg := missingDepPkgs[missingDep]; depPkg != nil {
+			if key, ok := config.BuildCache.archiveKey(config, depPkg); ok {
+				cacheKey = key
+				filename, cached = config.BuildCache.lookupArchive(key)
+				if cached && config.DebugLog {
+					log.Printf("Using cached dependency '%s' (%s)\n", missingDep, filename)
+				}
 			}
+		}
 
-			args := []string{"build"}
-			args = append(args, mergeBuildFlags(config.ExtraBuildFlags, config.Dynlink)...)
-			args = append(args, "-o", filename, missingDep)
-			command := exec.Command(config.GoBinary, args...)
-			if config.DebugLog {
-				command.Stderr = os.Stderr
-				command.Stderr = os.Stdout
+		if !cached {
+			// Stop spawning new builds as soon as the context is done, but still wait for running ones to be killed
+			select {
+			case concurrencyLimit <- struct{}{}:
+			case <-ctx.Done():
 			}
-			command.Dir = workDir
-			bufStdout := &bytes.Buffer{}
-			bufStdErr := &bytes.Buffer{}
-			if config.DebugLog {
-				command.Stdout = io.MultiWriter(os.Stdout, bufStdout)
-				command.Stderr = io.MultiWriter(os.Stderr, bufStdErr)
-			} else {
-				command.Stdout = bufStdout
-				command.Stderr = bufStdErr
+			if ctx.Err() != nil {
+				break
 			}
-
-			err := command.Run()
-			if err != nil {
-				errsMutex.Lock()
-				errs = append(errs, fmt.Errorf("failed to build dependency '%s': %w\nstdout:\n %s\nstderr:\n%s", missingDep, err, bufStdout.String(), bufStdErr.String()))
-				errsMutex.Unlock()
-			}
-			wg.Done()
-			<-concurrencyLimit
-		}(filename, missingDep)
+			wg.Add(1)
+			go buildDep(filename, missingDep, cacheKey)
+		}
 		existingImport := false
 		for _, existing := range *builtPackageImportPaths {
 			if missingDep == existing {
@@ -397,17 +593,27 @@ func buildAndLoadDeps(config BuildConfig,
 		}
 	}
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return stageError(ctx, StageDeps, err)
+	}
 	if len(errs) > 0 {
 		var extra string
 		if len(errs) > 1 {
 			extra = fmt.Sprintf(". (extra errors: %s)", errs)
 		}
-		return fmt.Errorf("got %d during build of dependencies: %w%s", len(errs), errs[0], extra)
+		buildErr := &BuildError{Stage: StageCompile, Err: fmt.Errorf("got %d during build of dependencies: %w%s", len(errs), errs[0], extra)}
+		for _, err := range errs {
+			var depErr *BuildError
+			if errors.As(err, &depErr) {
+				buildErr.Diagnostics = append(buildErr.Diagnostics, depErr.Diagnostics...)
+			}
+		}
+		return buildErr
 	}
 
 	linker, err := goloader.ReadObjs(*buildPackageFilePaths, *builtPackageImportPaths, globalSymPtr, linkerOpts...)
 	if err != nil {
-		return fmt.Errorf("linker failed to read symbols from dependency object files (%s): %w", *builtPackageImportPaths, err)
+		return &BuildError{Stage: StageLink, Err: fmt.Errorf("linker failed to read symbols from dependency object files (%s): %w", *builtPackageImportPaths, err)}
 	}
 
 	globalMutex.Lock()
@@ -442,7 +648,7 @@ func buildAndLoadDeps(config BuildConfig,
 			}
 			log.Printf("Still have %d unresolved symbols \n[\n  %s\n]\n after building dependencies. Recursing further to build: \n[\n  %s\n]\n", len(nextUnresolvedSymbols), strings.Join(missingSyms, ",\n  "), strings.Join(missingList, ",\n  "))
 		}
-		return buildAndLoadDeps(config, workDir, buildDir, newSortedDeps, nextUnresolvedSymbols, nextUnresolvedSymbols, seen, builtPackageImportPaths, buildPackageFilePaths, depth+1, linkerOpts, stdLibPkgs)
+		return buildAndLoadDeps(ctx, config, workDir, buildDir, newSortedDeps, nextUnresolvedSymbols, nextUnresolvedSymbols, seen, builtPackageImportPaths, buildPackageFilePaths, depth+1, linkerOpts, stdLibPkgs)
 	}
 	return nil
 }
@@ -464,19 +670,41 @@ func (config *BuildConfig) linkerOpts() []goloader.LinkerOptFunc {
 	if len(config.SkipTypeDeduplicationForPackages) > 0 {
 		linkerOpts = append(linkerOpts, goloader.WithSkipTypeDeduplicationForPackages(config.SkipTypeDeduplicationForPackages))
 	}
+	if config.BuildCache != nil {
+		linkerOpts = append(linkerOpts, goloader.WithPkgCache(config.BuildCache))
+	}
+	if config.AllowNoHostDWARF {
+		linkerOpts = append(linkerOpts, goloader.WithAllowNoHostDWARF())
+	}
+	if config.Debug {
+		linkerOpts = append(linkerOpts, goloader.WithDebugInfo())
+	}
+	if config.PerfMap {
+		linkerOpts = append(linkerOpts, goloader.WithPerfMap())
+	}
+	if config.PerfJITDump {
+		linkerOpts = append(linkerOpts, goloader.WithPerfJITDump(config.PerfJITDumpDir))
+	}
 	return linkerOpts
 }
 
 func BuildGoFiles(config BuildConfig, pathToGoFile string, extraFiles ...string) (*LoadableUnit, error) {
+	return BuildGoFilesContext(context.Background(), config, pathToGoFile, extraFiles...)
+}
+
+// BuildGoFilesContext is like BuildGoFiles, but kills any running go commands and stops the build when ctx is done.
+func BuildGoFilesContext(ctx context.Context, config BuildConfig, pathToGoFile string, extraFiles ...string) (*LoadableUnit, error) {
 	absPath, err := filepath.Abs(pathToGoFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get absolute path at %s: %w", pathToGoFile, err)
 	}
+	config.fileNames = map[string]string{absPath: pathToGoFile}
 	for i := range extraFiles {
 		newPath, err := filepath.Abs(extraFiles[i])
 		if err != nil {
 			return nil, fmt.Errorf("failed to get absolute path at %s: %w", extraFiles[i], err)
 		}
+		config.fileNames[newPath] = extraFiles[i]
 		extraFiles[i] = newPath
 	}
 	workDir := filepath.Dir(absPath)
@@ -489,11 +717,16 @@ func BuildGoFiles(config BuildConfig, pathToGoFile string, extraFiles ...string)
 		return nil, fmt.Errorf("failed to patch gc: %w", err)
 	}
 
+	err = config.checkVendorDir(workDir)
+	if err != nil {
+		return nil, err
+	}
+
 	if config.DebugLog {
 		log.Printf("Executing 'go list -json -x %s'\n", absPath)
 	}
 
-	pkg, err := GoList(config.GoBinary, absPath, workDir, config.DebugLog)
+	pkg, err := config.goList(ctx, absPath, workDir)
 	if err != nil {
 		return nil, err
 	}
@@ -503,14 +736,14 @@ func BuildGoFiles(config BuildConfig, pathToGoFile string, extraFiles ...string)
 			log.Printf("Executing 'go mod download -x'\n")
 		}
 
-		err = GoModDownload(config.GoBinary, workDir, config.DebugLog)
+		err = config.goModDownload(ctx, workDir)
 		if err != nil {
 			return nil, err
 		}
 		if config.DebugLog {
 			log.Printf("Executing 'go get -x %s'\n", workDir)
 		}
-		err = GoGet(config.GoBinary, workDir, workDir, config.DebugLog)
+		err = config.goGet(ctx, workDir, workDir)
 		if err != nil {
 			return nil, err
 		}
@@ -518,12 +751,12 @@ func BuildGoFiles(config BuildConfig, pathToGoFile string, extraFiles ...string)
 			log.Printf("Executing 'go list -json -x %s' (again)\n", absPath)
 		}
 
-		pkg, err = GoList(config.GoBinary, absPath, "", config.DebugLog)
+		pkg, err = config.goList(ctx, absPath, "")
 		if err != nil {
 			return nil, err
 		}
 		if len(pkg.DepsErrors) > 0 {
-			return nil, fmt.Errorf("could not resolve dependency errors after go mod download + go get: %s", pkg.DepsErrors[0].Err)
+			return nil, config.newPackageBuildError(StageList, workDir, pkg, pkg.DepsErrors)
 		}
 	}
 
@@ -558,15 +791,18 @@ func BuildGoFiles(config BuildConfig, pathToGoFile string, extraFiles ...string)
 	h.Write([]byte(strings.Join(files, "|")))
 	outputFilePath := filepath.Join(buildDir, hex.EncodeToString(h.Sum(nil))+".a")
 
-	err = execBuild(config, workDir, outputFilePath, files)
+	err = execBuild(ctx, config, workDir, outputFilePath, files)
 	if err != nil {
 		return nil, err
 	}
 
 	linkerOpts := config.linkerOpts()
-	stdLibPkgs := GoListStd(config.GoBinary)
+	stdLibPkgs, err := config.goListStd(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	linker, err := resolveDependencies(config, workDir, buildDir, outputFilePath, pkg.ImportPath, pkg, linkerOpts, stdLibPkgs)
+	linker, err := resolveDependencies(ctx, config, workDir, buildDir, outputFilePath, pkg.ImportPath, pkg, linkerOpts, stdLibPkgs)
 	if err != nil {
 		return nil, err
 	}
@@ -579,6 +815,11 @@ func BuildGoFiles(config BuildConfig, pathToGoFile string, extraFiles ...string)
 }
 
 func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
+	return BuildGoTextContext(context.Background(), config, goText)
+}
+
+// BuildGoTextContext is like BuildGoText, but kills any running go commands and stops the build when ctx is done.
+func BuildGoTextContext(ctx context.Context, config BuildConfig, goText string) (*LoadableUnit, error) {
 	h := sha256.New()
 	h.Write([]byte(goText))
 	hexHash := hex.EncodeToString(h.Sum(nil))
@@ -600,6 +841,7 @@ func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
 	}
 
 	tmpFilePath := filepath.Join(buildDir, hexHash+".go")
+	config.fileNames = map[string]string{tmpFilePath: SnippetFileName}
 
 	err = os.WriteFile(tmpFilePath, []byte(goText), 0655)
 	if err != nil {
@@ -614,11 +856,16 @@ func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
 		return nil, fmt.Errorf("failed to patch gc: %w", err)
 	}
 
+	err = config.checkVendorDir(buildDir)
+	if err != nil {
+		return nil, err
+	}
+
 	if config.DebugLog {
 		log.Printf("Executing 'go list -json -x %s'\n", tmpFilePath)
 	}
 
-	pkg, err := GoList(config.GoBinary, tmpFilePath, "", config.DebugLog)
+	pkg, err := config.goList(ctx, tmpFilePath, "")
 	if err != nil {
 		return nil, err
 	}
@@ -628,7 +875,7 @@ func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
 			log.Printf("Executing 'go mod download -x'\n")
 		}
 
-		err = GoModDownload(config.GoBinary, buildDir, config.DebugLog)
+		err = config.goModDownload(ctx, buildDir)
 		if err != nil {
 			return nil, err
 		}
@@ -641,7 +888,7 @@ func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
 			log.Printf("Executing 'go get -x %s'\n", absPackagePath)
 		}
 
-		err = GoGet(config.GoBinary, absPackagePath, "", config.DebugLog)
+		err = config.goGet(ctx, absPackagePath, "")
 		if err != nil {
 			return nil, err
 		}
@@ -649,25 +896,28 @@ func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
 		if config.DebugLog {
 			log.Printf("Executing 'go list -json -x %s' (again)\n", tmpFilePath)
 		}
-		pkg, err = GoList(config.GoBinary, tmpFilePath, "", config.DebugLog)
+		pkg, err = config.goList(ctx, tmpFilePath, "")
 		if err != nil {
 			return nil, err
 		}
 		if len(pkg.DepsErrors) > 0 {
-			return nil, fmt.Errorf("could not resolve dependency errors after go mod download + go get: %s", pkg.DepsErrors[0].Err)
+			return nil, config.newPackageBuildError(StageList, buildDir, pkg, pkg.DepsErrors)
 		}
 	}
 
 	outputFilePath := filepath.Join(buildDir, hexHash+".a")
 
-	err = execBuild(config, "", outputFilePath, []string{tmpFilePath})
+	err = execBuild(ctx, config, "", outputFilePath, []string{tmpFilePath})
 	if err != nil {
 		return nil, err
 	}
 
 	linkerOpts := config.linkerOpts()
-	stdLibPkgs := GoListStd(config.GoBinary)
-	linker, err := resolveDependencies(config, "", buildDir, outputFilePath, pkg.ImportPath, pkg, linkerOpts, stdLibPkgs)
+	stdLibPkgs, err := config.goListStd(ctx)
+	if err != nil {
+		return nil, err
+	}
+	linker, err := resolveDependencies(ctx, config, "", buildDir, outputFilePath, pkg.ImportPath, pkg, linkerOpts, stdLibPkgs)
 	if err != nil {
 		return nil, err
 	}
@@ -680,6 +930,11 @@ func BuildGoText(config BuildConfig, goText string) (*LoadableUnit, error) {
 }
 
 func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit, error) {
+	return BuildGoPackageContext(context.Background(), config, pathToGoPackage)
+}
+
+// BuildGoPackageContext is like BuildGoPackage, but kills any running go commands and stops the build when ctx is done.
+func BuildGoPackageContext(ctx context.Context, config BuildConfig, pathToGoPackage string) (*LoadableUnit, error) {
 	absPath, err := filepath.Abs(pathToGoPackage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get absolute path at %s: %w", pathToGoPackage, err)
@@ -700,11 +955,16 @@ func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit,
 		return nil, fmt.Errorf("failed to patch gc: %w", err)
 	}
 
+	err = config.checkVendorDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+
 	if config.DebugLog {
 		log.Printf("Executing 'go list -json -x %s'\n", absPath)
 	}
 	// Execute list from within the package folder so that go list resolves the module correctly from that path
-	pkg, err := GoList(config.GoBinary, absPath, absPath, config.DebugLog)
+	pkg, err := config.goList(ctx, absPath, absPath)
 	if err != nil {
 		return nil, err
 	}
@@ -717,7 +977,7 @@ func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit,
 		if config.DebugLog {
 			log.Printf("Executing 'go mod download -x'\n")
 		}
-		err = GoModDownload(config.GoBinary, absPath, config.DebugLog)
+		err = config.goModDownload(ctx, absPath)
 		if err != nil {
 			return nil, err
 		}
@@ -725,7 +985,7 @@ func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit,
 		if config.DebugLog {
 			log.Printf("Executing 'go get -x %s'\n", absPath)
 		}
-		err = GoGet(config.GoBinary, absPath, absPath, config.DebugLog)
+		err = config.goGet(ctx, absPath, absPath)
 		if err != nil {
 			return nil, err
 		}
@@ -733,12 +993,12 @@ func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit,
 		if config.DebugLog {
 			log.Printf("Executing 'go list -json -x %s' (again)\n", absPath)
 		}
-		pkg, err = GoList(config.GoBinary, absPath, "", config.DebugLog)
+		pkg, err = config.goList(ctx, absPath, "")
 		if err != nil {
 			return nil, err
 		}
 		if len(pkg.DepsErrors) > 0 {
-			return nil, fmt.Errorf("could not resolve dependency errors after go mod download + go get: %s", pkg.DepsErrors[0].Err)
+			return nil, config.newPackageBuildError(StageList, absPath, pkg, pkg.DepsErrors)
 		}
 	}
 	h := sha256.New()
@@ -779,14 +1039,17 @@ func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit,
 	outputFilePath := filepath.Join(rootBuildDir, hexHash+".a")
 
 	importPath := pkg.ImportPath
-	err = execBuild(config, absPath, outputFilePath, []string{absPath})
+	err = execBuild(ctx, config, absPath, outputFilePath, []string{absPath})
 	if err != nil {
 		return nil, err
 	}
 
 	linkerOpts := config.linkerOpts()
-	stdLibPkgs := GoListStd(config.GoBinary)
-	linker, err := resolveDependencies(config, absPath, rootBuildDir, outputFilePath, importPath, pkg, linkerOpts, stdLibPkgs)
+	stdLibPkgs, err := config.goListStd(ctx)
+	if err != nil {
+		return nil, err
+	}
+	linker, err := resolveDependencies(ctx, config, absPath, rootBuildDir, outputFilePath, importPath, pkg, linkerOpts, stdLibPkgs)
 	if err != nil {
 		return nil, err
 	}
@@ -799,6 +1062,11 @@ func BuildGoPackage(config BuildConfig, pathToGoPackage string) (*LoadableUnit,
 }
 
 func BuildGoPackageRemote(config BuildConfig, goPackage string, version string) (*LoadableUnit, error) {
+	return BuildGoPackageRemoteContext(context.Background(), config, goPackage, version)
+}
+
+// BuildGoPackageRemoteContext is like BuildGoPackageRemote, but kills any running go commands and stops the build when ctx is done.
+func BuildGoPackageRemoteContext(ctx context.Context, config BuildConfig, goPackage string, version string) (*LoadableUnit, error) {
 	if config.GoBinary == "" {
 		config.GoBinary = "go"
 	}
@@ -806,13 +1074,22 @@ func BuildGoPackageRemote(config BuildConfig, goPackage string, version string)
 	if err != nil {
 		return nil, fmt.Errorf("failed to patch gc: %w", err)
 	}
+	if config.ModuleSource != nil && config.ModuleSource.VendorDir != "" {
+		return nil, fmt.Errorf("can't fetch %s from a vendor dir, the module source needs a proxy dir or module zips instead", goPackage)
+	}
+	if config.ModuleSource != nil && !config.ModuleSource.hasProxy() {
+		return nil, fmt.Errorf("can't fetch %s without a proxy dir or module zips in the module source", goPackage)
+	}
 	// Execute list from within the package folder so that go list resolves the module correctly from that path
 	workDir, err := os.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get current working director: %w", err)
 	}
 
-	stdLibPkgs := GoListStd(config.GoBinary)
+	stdLibPkgs, err := config.goListStd(ctx)
+	if err != nil {
+		return nil, err
+	}
 	_, isStdLibPkg := stdLibPkgs[goPackage]
 
 	if version == "" {
@@ -826,7 +1103,7 @@ func BuildGoPackageRemote(config BuildConfig, goPackage string, version string)
 	if config.DebugLog {
 		log.Printf("Executing 'go get -x %s'\n", goPackage+versionSuffix)
 	}
-	err = GoGet(config.GoBinary, goPackage+versionSuffix, workDir, config.DebugLog)
+	err = config.goGet(ctx, goPackage+versionSuffix, workDir)
 	if err != nil {
 		return nil, err
 	}
@@ -834,7 +1111,7 @@ func BuildGoPackageRemote(config BuildConfig, goPackage string, version string)
 	if config.DebugLog {
 		log.Printf("Executing 'go list -json -x %s'\n", goPackage)
 	}
-	pkg, err := GoList(config.GoBinary, goPackage, workDir, config.DebugLog)
+	pkg, err := config.goList(ctx, goPackage, workDir)
 	if err != nil {
 		return nil, err
 	}
@@ -847,26 +1124,26 @@ func BuildGoPackageRemote(config BuildConfig, goPackage string, version string)
 		if config.DebugLog {
 			log.Printf("Executing 'go mod download -x'\n")
 		}
-		err = GoModDownload(config.GoBinary, workDir, config.DebugLog, pkg.Module.Path)
+		err = config.goModDownload(ctx, workDir, pkg.Module.Path)
 		if err != nil {
 			return nil, err
 		}
 		if config.DebugLog {
 			log.Printf("Executing 'go get -x %s'\n", goPackage)
 		}
-		err = GoGet(config.GoBinary, goPackage, workDir, config.DebugLog)
+		err = config.goGet(ctx, goPackage, workDir)
 		if err != nil {
 			return nil, err
 		}
 		if config.DebugLog {
 			log.Printf("Executing 'go list -json -x %s' (again)\n", goPackage)
 		}
-		pkg, err = GoList(config.GoBinary, goPackage, "", config.DebugLog)
+		pkg, err = config.goList(ctx, goPackage, "")
 		if err != nil {
 			return nil, err
 		}
 		if len(pkg.DepsErrors) > 0 {
-			return nil, fmt.Errorf("could not resolve dependency errors after go mod download + go get: %s", pkg.DepsErrors[0].Err)
+			return nil, config.newPackageBuildError(StageList, workDir, pkg, pkg.DepsErrors)
 		}
 	}
 	h := sha256.New()
@@ -907,12 +1184,12 @@ func BuildGoPackageRemote(config BuildConfig, goPackage string, version string)
 	outputFilePath := filepath.Join(rootBuildDir, hexHash+".a")
 
 	importPath := pkg.ImportPath
-	err = execBuild(config, workDir, outputFilePath, []string{goPackage})
+	err = execBuild(ctx, config, workDir, outputFilePath, []string{goPackage})
 	if err != nil {
 		return nil, err
 	}
 	linkerOpts := config.linkerOpts()
-	linker, err := resolveDependencies(config, workDir, rootBuildDir, outputFilePath, importPath, pkg, linkerOpts, stdLibPkgs)
+	linker, err := resolveDependencies(ctx, config, workDir, rootBuildDir, outputFilePath, importPath, pkg, linkerOpts, stdLibPkgs)
 	if err != nil {
 		return nil, err
 	}
@@ -1,8 +1,16 @@
 package jit_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/eh-steve/goloader"
 	"github.com/eh-steve/goloader/jit"
@@ -10,6 +18,7 @@ import (
 	"github.com/eh-steve/goloader/jit/testdata/test_issue55/p"
 	"github.com/eh-steve/goloader/jit/testdata/test_type_mismatch"
 	"github.com/eh-steve/goloader/jit/testdata/test_type_mismatch/typedef"
+	"github.com/eh-steve/goloader/obj"
 	"github.com/eh-steve/goloader/unload/jsonunload"
 	"io"
 	"log"
@@ -18,16 +27,19 @@ import (
 	"net/http/httptest"
 	_ "net/http/pprof"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 	"unsafe"
 )
@@ -329,7 +341,10 @@ func TestSchedule(t *testing.T) {
 				test()
 			}
 
-			err := module.Unload()
+			// The test's goroutines may still be running their deferred calls after it returns
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := module.UnloadWait(ctx)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1743,3 +1758,1767 @@ func TestRemotePkgs(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestBuildCache(t *testing.T) {
+	conf := baseConfig
+	cache, err := jit.NewBuildCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.BuildCache = cache
+
+	data := testData{
+		files: []string{"./testdata/test_protobuf/test.go"},
+		pkg:   "./testdata/test_protobuf",
+	}
+	for i := 0; i < 2; i++ {
+		module, symbols := buildLoadable(t, conf, "BuildGoPackage", data)
+		testFunc := symbols["TestProto"].(func())
+		testFunc()
+		runtime.GC()
+		runtime.GC()
+		err = module.Unload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := cache.Stats()
+		if i == 0 && stats.ArchiveMisses == 0 {
+			t.Fatalf("expected first build to populate the cache, got %+v", stats)
+		}
+		if i == 1 && (stats.ArchiveHits == 0 || stats.PkgHits == 0) {
+			t.Fatalf("expected second build to reuse cached archives, got %+v", stats)
+		}
+	}
+	err = cache.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageRoundTrip(t *testing.T) {
+	conf := baseConfig
+
+	loadable, err := jit.BuildGoPackage(conf, "./testdata/test_simple_func")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := &bytes.Buffer{}
+	err = loadable.WriteImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageBytes := image.Bytes()
+
+	restored, err := jit.ReadImage(bytes.NewReader(imageBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ImportPath != loadable.ImportPath {
+		t.Fatalf("expected import path %s, got %s", loadable.ImportPath, restored.ImportPath)
+	}
+	module, err := restored.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFunc := module.SymbolsByPkg[restored.ImportPath]["Add"].(func(a, b int) int)
+	result := addFunc(5, 6)
+	if result != 11 {
+		t.Errorf("expected %d, got %d", 11, result)
+	}
+	if info := module.Info().BuildInfo; info == nil || info.Path != loadable.ImportPath {
+		t.Errorf("expected build info of %s to be restored from the image, got %v", loadable.ImportPath, info)
+	}
+	err = module.Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = goloader.ReadImage(bytes.NewReader(imageBytes), goloader.WithDebugInfo())
+	if err == nil {
+		t.Error("expected image to be rejected WithDebugInfo")
+	}
+
+	if goVersion(t) >= 20 {
+		// The coverage counters must still be found in a restored module's noptrbss
+		coverConf := conf
+		coverConf.Cover = true
+		loadable, err = jit.BuildGoPackage(coverConf, "./testdata/test_simple_func")
+		if err != nil {
+			t.Fatal(err)
+		}
+		image.Reset()
+		err = loadable.WriteImage(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err = jit.ReadImage(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		module, err = restored.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		module.SymbolsByPkg[restored.ImportPath]["Add"].(func(a, b int) int)(1, 2)
+		coverage, err := module.Coverage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count uint32
+		for _, pkg := range coverage.Packages {
+			for _, fn := range pkg.Funcs {
+				if fn.Name == "Add" {
+					for _, block := range fn.Blocks {
+						count += block.Count
+					}
+				}
+			}
+		}
+		if count != 1 {
+			t.Errorf("expected Add to have been covered once in restored module, got %d", count)
+		}
+		err = module.Unload()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = jit.ReadImage(bytes.NewReader([]byte("not an image")))
+	if err == nil {
+		t.Fatal("expected error reading garbage image")
+	}
+}
+
+func TestBuildGoFS(t *testing.T) {
+	conf := baseConfig
+
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/jitfs\n\ngo 1.18\n"),
+		"util/util.go": []byte(`package util
+
+//go:noinline
+func Double(x int) int { return x * 2 }
+`),
+		"gen/gen.go": []byte(`package gen
+
+import (
+	"example.com/jitfs/util"
+	"runtime"
+)
+
+func Quadruple(x int) int { return util.Double(util.Double(x)) }
+
+func WhereAmI() string {
+	_, file, _, _ := runtime.Caller(0)
+	return file
+}
+`),
+	}
+
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/jitfs/gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := module.SymbolsByPkg[loadable.ImportPath]
+	quadruple := symbols["Quadruple"].(func(int) int)
+	if result := quadruple(3); result != 12 {
+		t.Errorf("expected %d, got %d", 12, result)
+	}
+	whereAmI := symbols["WhereAmI"].(func() string)
+	if file := whereAmI(); file != "example.com/jitfs/gen/gen.go" {
+		t.Errorf("expected virtual file name %s, got %s", "example.com/jitfs/gen/gen.go", file)
+	}
+	err = module.Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files["gen/broken.go"] = []byte("package gen\n\nfunc Broken() int { return \"not an int\" }\n")
+	_, err = jit.BuildGoFS(conf, fstest.MapFS{
+		"go.mod":        {Data: files["go.mod"]},
+		"util/util.go":  {Data: files["util/util.go"]},
+		"gen/gen.go":    {Data: files["gen/gen.go"]},
+		"gen/broken.go": {Data: files["gen/broken.go"]},
+	}, "example.com/jitfs/gen")
+	if err == nil {
+		t.Fatal("expected build error")
+	}
+	if !strings.Contains(err.Error(), "gen/broken.go") {
+		t.Errorf("expected error to reference virtual file name, got: %s", err)
+	}
+}
+
+func TestBuildContextCancelled(t *testing.T) {
+	conf := baseConfig
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := jit.BuildGoPackageContext(ctx, conf, "./testdata/test_protobuf")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestBuildErrorDiagnostics(t *testing.T) {
+	conf := baseConfig
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cd into testdata dir to avoid polluting the jit package's go.mod
+	err = os.Chdir("./testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err = os.Chdir(pwd)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	goText := "package broken\n\nfunc Broken() int {\n\treturn \"not an int\"\n}\n"
+	_, err = jit.BuildGoText(conf, goText)
+	if err == nil {
+		t.Fatal("expected build error")
+	}
+	var buildErr *jit.BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("expected a *jit.BuildError, got %T: %s", err, err)
+	}
+	if buildErr.Stage != jit.StageCompile {
+		t.Errorf("expected stage %s, got %s", jit.StageCompile, buildErr.Stage)
+	}
+	if len(buildErr.Diagnostics) != 1 {
+		t.Fatalf("expected 1 diagnostic, got %d: %s", len(buildErr.Diagnostics), err)
+	}
+	d := buildErr.Diagnostics[0]
+	if d.File != jit.SnippetFileName || d.Line != 4 || d.Column == 0 || d.Message == "" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	conf := baseConfig
+
+	pkgDir, err := os.MkdirTemp("./testdata", "test_watcher_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pkgDir)
+
+	writeVersion := func(body string) {
+		err := os.WriteFile(filepath.Join(pkgDir, "test.go"), []byte("package test_watcher\n\nfunc Version() int {\n\t"+body+"\n}\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	version := func(symbols map[string]map[string]interface{}, importPath string) int {
+		return symbols[importPath]["Version"].(func() int)()
+	}
+	writeVersion("return 1")
+
+	var migrations int32
+	errs := make(chan error, 10)
+	watcher, err := jit.NewWatcher(jit.WatcherConfig{
+		BuildConfig: conf,
+		Debounce:    50 * time.Millisecond,
+		Migrate: func(oldModule, newModule *goloader.CodeModule) error {
+			atomic.AddInt32(&migrations, 1)
+			return nil
+		},
+		OnError: func(err error) {
+			errs <- err
+		},
+	}, pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importPath := watcher.ImportPath()
+
+	updates, unsubscribe := watcher.Subscribe()
+	defer unsubscribe()
+	if v := version(<-updates, importPath); v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+
+	writeVersion("return 2")
+	select {
+	case symbols := <-updates:
+		if v := version(symbols, importPath); v != 2 {
+			t.Errorf("expected version 2, got %d", v)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for reload")
+	}
+	if atomic.LoadInt32(&migrations) != 1 {
+		t.Errorf("expected 1 migration, got %d", migrations)
+	}
+
+	// A broken change should leave the last good version published
+	writeVersion("return \"broken\"")
+	select {
+	case symbols := <-updates:
+		t.Fatalf("expected failed reload, got version %d", version(symbols, importPath))
+	case err := <-errs:
+		var buildErr *jit.BuildError
+		if !errors.As(err, &buildErr) {
+			t.Errorf("expected a *jit.BuildError, got %T: %s", err, err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for reload")
+	}
+	if v := version(watcher.Symbols(), importPath); v != 2 {
+		t.Errorf("expected version 2 to still be published, got %d", v)
+	}
+
+	err = watcher.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = watcher.Module().Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherReloadBusy(t *testing.T) {
+	conf := baseConfig
+
+	pkgDir, err := os.MkdirTemp("./testdata", "test_watcher_busy_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pkgDir)
+	err = os.WriteFile(filepath.Join(pkgDir, "test.go"), []byte("package test_watcher_busy\n\n//go:noinline\nfunc Wait(ch chan struct{}) {\n\t<-ch\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := jit.NewWatcher(jit.WatcherConfig{
+		BuildConfig:   conf,
+		UnloadTimeout: 50 * time.Millisecond,
+	}, pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = watcher.Close()
+		_ = watcher.Module().Unload()
+	}()
+
+	oldModule := watcher.Module()
+	wait := oldModule.SymbolsByPkg[watcher.ImportPath()]["Wait"].(func(chan struct{}))
+	ch := make(chan struct{})
+	go wait(ch)
+	time.Sleep(50 * time.Millisecond)
+
+	// The old module is still busy, so it should be published over and unloaded later rather than failing the reload
+	err = watcher.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watcher.Module() == oldModule {
+		t.Fatal("expected new module to be published")
+	}
+	if !oldModule.UnloadTime().IsZero() {
+		t.Fatal("expected busy old module to still be loaded")
+	}
+
+	close(ch)
+	deadline := time.Now().Add(10 * time.Second)
+	for oldModule.UnloadTime().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for old module to be unloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	conf := baseConfig
+
+	loadable, err := jit.BuildGoPackage(conf, "./testdata/test_simple_func")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err = module.Unload()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	add, err := jit.Lookup[func(a, b int) int](module, loadable.ImportPath, "Add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := add(5, 6); result != 11 {
+		t.Errorf("expected %d, got %d", 11, result)
+	}
+
+	_, err = jit.Lookup[func(a int, b string) int](module, loadable.ImportPath, "Add")
+	var mismatchErr *goloader.TypeMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a *goloader.TypeMismatchError, got %T: %v", err, err)
+	}
+	if len(mismatchErr.Differences) != 1 || !strings.Contains(mismatchErr.Differences[0], "parameter 1") {
+		t.Errorf("expected a single difference in parameter 1, got %q", mismatchErr.Differences)
+	}
+
+	_, err = jit.Lookup[func()](module, loadable.ImportPath, "DoesNotExist")
+	if err == nil {
+		t.Errorf("expected error looking up missing symbol")
+	}
+}
+
+func TestFuncSignatureVerification(t *testing.T) {
+	if _, err := goloader.HostFuncSignatures(); err != nil {
+		t.Skipf("host binary has no DWARF to verify signatures against: %s", err)
+	}
+	conf := baseConfig
+
+	loadable, err := jit.BuildGoPackage(conf, "./testdata/test_simple_func")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadable.Linker.HostSymbolRefs(jit.GlobalSymPtr())["fmt.Errorf"]; !ok {
+		t.Fatal("expected fmt.Errorf to be resolved from the host")
+	}
+	// Pretend the JIT code was compiled against a different version of fmt
+	loadable.Linker.ExpectFuncSignatures(map[string]goloader.FuncSignature{
+		"fmt.Errorf": {Params: []string{"string", "int"}, Results: []string{"error"}},
+	})
+	module, err := loadable.Load()
+	if err == nil {
+		_ = module.Unload()
+		t.Fatal("expected signature mismatch error")
+	}
+	var mismatchErr *goloader.FuncSignatureMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a *goloader.FuncSignatureMismatchError, got %T: %s", err, err)
+	}
+	if len(mismatchErr.Mismatches) != 1 || mismatchErr.Mismatches[0].Func != "fmt.Errorf" || len(mismatchErr.Mismatches[0].CalledBy) == 0 {
+		t.Errorf("unexpected mismatches: %+v", mismatchErr.Mismatches)
+	}
+
+	// Changes to and from a signature with no params or results must be caught too
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/emptysig\n\ngo 1.18\n"),
+		"gc/gc.go": []byte(`package gc
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func Collect() error {
+	runtime.GC()
+	return fmt.Errorf("collected %d", 1)
+}
+`),
+	}
+	for _, expected := range []map[string]goloader.FuncSignature{
+		{"runtime.GC": {Params: []string{"int"}}},
+		{"fmt.Errorf": {}},
+	} {
+		loadable, err = jit.BuildGoFileMap(conf, files, "example.com/emptysig/gc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		loadable.Linker.ExpectFuncSignatures(expected)
+		module, err = loadable.Load()
+		if err == nil {
+			_ = module.Unload()
+			t.Fatalf("expected signature mismatch error for %v", expected)
+		}
+		if !errors.As(err, &mismatchErr) {
+			t.Fatalf("expected a *goloader.FuncSignatureMismatchError, got %T: %s", err, err)
+		}
+		for name := range expected {
+			if len(mismatchErr.Mismatches) != 1 || mismatchErr.Mismatches[0].Func != name {
+				t.Errorf("expected a mismatch of %s, got %+v", name, mismatchErr.Mismatches)
+			}
+		}
+	}
+}
+
+func TestFuncSignatureMismatchFromExportData(t *testing.T) {
+	if _, err := goloader.HostFuncSignatures(); err != nil {
+		t.Skipf("host binary has no DWARF to verify signatures against: %s", err)
+	}
+	conf := baseConfig
+
+	// A module which calls this package's GlobalSymPtr, but is compiled against a replacement of this package whose
+	// GlobalSymPtr returns an int - the host's is the real one, which returns a map[string]uintptr
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":           "module example.com/sigmismatch\n\ngo 1.18\n\nrequire github.com/eh-steve/goloader/jit v0.0.0\n\nreplace github.com/eh-steve/goloader/jit => ./jit\n",
+		"jit/go.mod":       "module github.com/eh-steve/goloader/jit\n\ngo 1.18\n",
+		"jit/jit.go":       "package jit\n\n//go:noinline\nfunc GlobalSymPtr() int { return 0 }\n",
+		"caller/caller.go": "package caller\n\nimport \"github.com/eh-steve/goloader/jit\"\n\nfunc Symbols() int { return jit.GlobalSymPtr() }\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loadable, err := jit.BuildGoPackage(conf, filepath.Join(dir, "caller"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err == nil {
+		_ = module.Unload()
+		t.Fatal("expected signature mismatch error")
+	}
+	var mismatchErr *goloader.FuncSignatureMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a *goloader.FuncSignatureMismatchError, got %T: %s", err, err)
+	}
+	if len(mismatchErr.Mismatches) != 1 {
+		t.Fatalf("expected 1 mismatch, got %+v", mismatchErr.Mismatches)
+	}
+	mismatch := mismatchErr.Mismatches[0]
+	if mismatch.Func != "github.com/eh-steve/goloader/jit.GlobalSymPtr" {
+		t.Errorf("expected mismatch of jit.GlobalSymPtr, got %s", mismatch.Func)
+	}
+	if !reflect.DeepEqual(mismatch.Expected.Results, []string{"int"}) || !reflect.DeepEqual(mismatch.Host.Results, []string{"map[string]uintptr"}) {
+		t.Errorf("expected int result from export data and map[string]uintptr from host, got %v and %v", mismatch.Expected.Results, mismatch.Host.Results)
+	}
+	found := false
+	for _, caller := range mismatch.CalledBy {
+		if caller == "example.com/sigmismatch/caller.Symbols" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected mismatch to be called by caller.Symbols, got %v", mismatch.CalledBy)
+	}
+}
+
+func TestOfflineModuleSource(t *testing.T) {
+	conf := baseConfig
+
+	// Build a module zip and matching go.sum entries for a module which doesn't exist in any real proxy
+	hash1 := func(files map[string][]byte) string {
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h := sha256.New()
+		for _, name := range names {
+			_, _ = fmt.Fprintf(h, "%x  %s\n", sha256.Sum256(files[name]), name)
+		}
+		return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	greetingGoMod := []byte("module example.com/greeting\n\ngo 1.18\n")
+	greetingFiles := map[string][]byte{
+		"example.com/greeting@v1.0.0/go.mod":      greetingGoMod,
+		"example.com/greeting@v1.0.0/greeting.go": []byte("package greeting\n\nfunc Hello() string { return \"hello from a zip\" }\n"),
+	}
+	zipPath := filepath.Join(t.TempDir(), "greeting.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for _, name := range []string{"example.com/greeting@v1.0.0/go.mod", "example.com/greeting@v1.0.0/greeting.go"} {
+		w, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(greetingFiles[name])
+	}
+	if err = zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = zipFile.Close()
+
+	conf.ModuleSource = &jit.ModuleSource{ModuleZips: []string{zipPath}}
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/offline\n\ngo 1.18\n\nrequire example.com/greeting v1.0.0\n"),
+		"go.sum": []byte(fmt.Sprintf("example.com/greeting v1.0.0 %s\nexample.com/greeting v1.0.0/go.mod %s\n",
+			hash1(greetingFiles), hash1(map[string][]byte{"go.mod": greetingGoMod}))),
+		"greet/greet.go": []byte("package greet\n\nimport \"example.com/greeting\"\n\nfunc Greet() string { return greeting.Hello() }\n"),
+	}
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/offline/greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	greet := module.SymbolsByPkg[loadable.ImportPath]["Greet"].(func() string)
+	if result := greet(); result != "hello from a zip" {
+		t.Errorf("expected %q, got %q", "hello from a zip", result)
+	}
+	err = module.Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A module missing from the source should fail immediately rather than going to the network
+	files["go.mod"] = []byte("module example.com/offline\n\ngo 1.18\n\nrequire example.com/missing v1.0.0\n")
+	files["go.sum"] = []byte("example.com/missing v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\nexample.com/missing v1.0.0/go.mod h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n")
+	files["greet/greet.go"] = []byte("package greet\n\nimport \"example.com/missing\"\n\nfunc Greet() string { return missing.Hello() }\n")
+	_, err = jit.BuildGoFileMap(conf, files, "example.com/offline/greet")
+	if !errors.Is(err, jit.ErrModuleNotAvailable) {
+		t.Errorf("expected jit.ErrModuleNotAvailable, got: %v", err)
+	}
+
+	// A module on disk can only be built from its own vendor dir
+	conf.ModuleSource = &jit.ModuleSource{VendorDir: t.TempDir()}
+	_, err = jit.BuildGoPackage(conf, "./testdata/test_simple_func")
+	if err == nil || !strings.Contains(err.Error(), "its own vendor dir") {
+		t.Errorf("expected vendor dir outside the module to be refused, got: %v", err)
+	}
+}
+
+func TestHostBuildSettingsMismatch(t *testing.T) {
+	hostLevel := goloader.HostBuildSettings()["GOAMD64"]
+	if runtime.GOARCH != "amd64" || hostLevel == "" || hostLevel == "v3" {
+		t.Skip("test requires an amd64 host built with GOAMD64 other than v3")
+	}
+	conf := baseConfig
+	conf.IgnoreHostBuildSettings = true
+	conf.BuildEnv = append(conf.BuildEnv, "GOAMD64=v3")
+
+	_, err := jit.BuildGoPackage(conf, "./testdata/test_simple_func")
+	if err == nil {
+		t.Fatal("expected archive built with a different GOAMD64 to be rejected")
+	}
+	var mismatchErr *goloader.ArchiveMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a *goloader.ArchiveMismatchError, got %T: %s", err, err)
+	}
+	if mismatchErr.Setting != "GOAMD64" || mismatchErr.Archive != "v3" || mismatchErr.Host != hostLevel {
+		t.Errorf("unexpected mismatch: %+v", mismatchErr)
+	}
+
+	conf.IgnoreHostBuildSettings = false
+	conf.BuildEnv = baseConfig.BuildEnv
+	module, symbols := buildLoadable(t, conf, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_simple_func/test.go"},
+		pkg:   "./testdata/test_simple_func",
+	})
+	if _, ok := symbols["Add"]; !ok {
+		t.Errorf("expected Add symbol, got %v", symbols)
+	}
+	_ = module.Unload()
+}
+
+// staleCache returns archives built by a different Go version, as a cache shared with another host might
+type staleCache struct{}
+
+func (staleCache) LoadPkg(file, pkgPath string) (*obj.Pkg, bool) {
+	return &obj.Pkg{
+		PkgPath:    pkgPath,
+		Arch:       runtime.GOARCH,
+		TextHeader: fmt.Sprintf("go object %s %s go1.0 X:none", runtime.GOOS, runtime.GOARCH),
+	}, true
+}
+
+func (staleCache) StorePkg(file, pkgPath string, pkg *obj.Pkg) {}
+
+func TestPkgCacheArchiveMismatch(t *testing.T) {
+	_, err := goloader.ReadObjs([]string{"stale.a"}, []string{"example.com/stale"}, jit.GlobalSymPtr(), goloader.WithPkgCache(staleCache{}))
+	var mismatchErr *goloader.ArchiveMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a *goloader.ArchiveMismatchError for a cached archive, got %T: %v", err, err)
+	}
+	if mismatchErr.Setting != "Go version" || mismatchErr.Archive != "go1.0" || mismatchErr.File != "stale.a" {
+		t.Errorf("unexpected mismatch: %+v", mismatchErr)
+	}
+}
+
+func TestRaceDetector(t *testing.T) {
+	if goloader.HostBuildSettings()["-race"] != "true" {
+		t.Skip("test requires the race detector (go test -race)")
+	}
+	if os.Getenv("GOLOADER_TEST_RACE_CHILD") == "1" {
+		module, symbols := buildLoadable(t, baseConfig, "BuildGoPackage", testData{
+			files: []string{"./testdata/test_race/test.go"},
+			pkg:   "./testdata/test_race",
+		})
+		race := symbols["Race"].(func() int)
+		if got := race(); got != 2 {
+			t.Errorf("expected 2, got %d", got)
+		}
+		err := module.Unload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// The detected race fails the test, so run it in a child process and inspect the report
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRaceDetector$", "-test.v")
+	cmd.Env = append(os.Environ(), "GOLOADER_TEST_RACE_CHILD=1", "GORACE=halt_on_error=0")
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected child test to fail with a detected race, got:\n%s", output)
+	}
+	for _, expected := range []string{"WARNING: DATA RACE", "test_race.Race.func1()", "test_race/test.go:8", "test_race.Race()", "test_race/test.go:11"} {
+		if !strings.Contains(string(output), expected) {
+			t.Errorf("expected race report to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	if goVersion(t) < 20 {
+		t.Skip("coverage of loaded modules requires go1.20+")
+	}
+	conf := baseConfig
+	conf.Cover = true
+	module, symbols := buildLoadable(t, conf, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_simple_func/test.go"},
+		pkg:   "./testdata/test_simple_func",
+	})
+	add := symbols["Add"].(func(a, b int) int)
+	add(1, 2)
+	add(3, 4)
+
+	coverage, err := module.Coverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coverage.Mode != "atomic" {
+		t.Errorf("expected atomic mode, got %s", coverage.Mode)
+	}
+	counts := map[string]uint32{}
+	for _, pkg := range coverage.Packages {
+		for _, fn := range pkg.Funcs {
+			for _, block := range fn.Blocks {
+				counts[fn.Name] += block.Count
+			}
+		}
+	}
+	if counts["Add"] != 2 {
+		t.Errorf("expected Add to have been covered twice, got %d", counts["Add"])
+	}
+	if counts["HandleBytes"] != 0 {
+		t.Errorf("expected HandleBytes not to have been covered, got %d", counts["HandleBytes"])
+	}
+
+	var profile bytes.Buffer
+	err = coverage.WriteProfile(&profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(profile.String(), "mode: atomic\n") || !strings.Contains(profile.String(), "test.go:7.") {
+		t.Errorf("unexpected coverage profile:\n%s", profile.String())
+	}
+
+	add(5, 6)
+	err = module.Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The counters are unmapped, so the coverage when the module was unloaded is returned
+	coverage, err = module.Coverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addCount uint32
+	for _, pkg := range coverage.Packages {
+		for _, fn := range pkg.Funcs {
+			if fn.Name == "Add" {
+				for _, block := range fn.Blocks {
+					addCount += block.Count
+				}
+			}
+		}
+	}
+	if addCount != 3 {
+		t.Errorf("expected Add to have been covered 3 times before unloading, got %d", addCount)
+	}
+}
+
+func TestBuildGoTests(t *testing.T) {
+	unit, err := jit.BuildGoTests(baseConfig, "./testdata/test_gotests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := unit.Run(jit.TestOptions{
+		Run:       "TestAdd|TestSubtests|TestSkipped|TestExternal|ExampleAdd",
+		Bench:     "BenchmarkAdd",
+		BenchTime: "100x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := unit.Module.Unload()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if !report.Passed {
+		t.Fatalf("expected tests to pass:\n%s", report.Output)
+	}
+	results := map[string]jit.TestResult{}
+	for _, result := range report.Tests {
+		results[result.Name] = result
+	}
+	for _, name := range []string{"TestAdd", "TestSubtests", "TestSkipped", "TestExternal", "ExampleAdd", "BenchmarkAdd"} {
+		result, ok := results[name]
+		if !ok {
+			t.Errorf("expected a result for %s:\n%s", name, report.Output)
+		} else if result.Failed {
+			t.Errorf("expected %s to pass:\n%s", name, result.Output)
+		}
+	}
+	if !results["TestSkipped"].Skipped {
+		t.Errorf("expected TestSkipped to be skipped")
+	}
+	if !strings.Contains(results["TestAdd"].Output, "added") {
+		t.Errorf("expected TestAdd's output to contain its log:\n%s", results["TestAdd"].Output)
+	}
+	if !strings.Contains(results["TestSubtests"].Output, "TestSubtests/3") {
+		t.Errorf("expected TestSubtests's output to contain its subtests:\n%s", results["TestSubtests"].Output)
+	}
+	if len(report.Benchmarks) != 1 || report.Benchmarks[0].N != 100 || report.Benchmarks[0].Metrics["ns/op"] <= 0 {
+		t.Errorf("unexpected benchmark results %+v:\n%s", report.Benchmarks, report.Output)
+	}
+
+	stdout := os.Stdout
+	report, err = unit.Run(jit.TestOptions{Run: "TestFailing|TestPanic|ExampleDivide_byZero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Passed {
+		t.Fatalf("expected tests to fail:\n%s", report.Output)
+	}
+	failed := report.Failed()
+	if len(failed) != 3 {
+		t.Fatalf("expected 3 failed tests, got %d:\n%s", len(failed), report.Output)
+	}
+	for _, result := range failed {
+		if (result.Name == "TestPanic" || result.Name == "ExampleDivide_byZero") && !strings.Contains(result.Output, "integer divide by zero") {
+			t.Errorf("expected %s's output to contain the recovered panic:\n%s", result.Name, result.Output)
+		}
+	}
+	if os.Stdout != stdout {
+		t.Errorf("expected os.Stdout to be restored after running tests")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	conf := baseConfig
+	conf.Policy = &jit.Policy{
+		DenyPackages: []string{"os/exec", "unsafe"},
+		DenySymbols:  []string{"os.Exit"},
+	}
+
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/policy\n\ngo 1.18\n"),
+		"snippet/snippet.go": []byte(`package snippet
+
+import (
+	"os/exec"
+	_ "unsafe"
+)
+
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+func Run() error {
+	return exec.Command("true").Run()
+}
+`),
+	}
+	_, err := jit.BuildGoFileMap(conf, files, "example.com/policy/snippet")
+	var policyErr *jit.PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("expected a *jit.PolicyError, got %T: %v", err, err)
+	}
+	if policyErr.Stage != jit.StageList {
+		t.Errorf("expected stage %s, got %s", jit.StageList, policyErr.Stage)
+	}
+	expected := []jit.PolicyViolation{
+		{Rule: jit.RuleImport, Line: 4, Symbol: "os/exec"},
+		{Rule: jit.RuleImport, Line: 5, Symbol: "unsafe"},
+		{Rule: jit.RuleLinkname, Line: 8, Symbol: "runtime.nanotime"},
+	}
+	if len(policyErr.Violations) != len(expected) {
+		t.Fatalf("expected %d violations, got %d: %s", len(expected), len(policyErr.Violations), err)
+	}
+	for i, v := range policyErr.Violations {
+		if v.Rule != expected[i].Rule || v.Line != expected[i].Line || v.Symbol != expected[i].Symbol || v.File != "snippet/snippet.go" || v.Package != "example.com/policy/snippet" {
+			t.Errorf("unexpected violation %+v, expected %+v", v, expected[i])
+		}
+	}
+
+	files["snippet/snippet.go"] = []byte(`package snippet
+
+import "os"
+
+func Exit() {
+	os.Exit(1)
+}
+`)
+	_, err = jit.BuildGoFileMap(conf, files, "example.com/policy/snippet")
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("expected a *jit.PolicyError, got %T: %v", err, err)
+	}
+	if policyErr.Stage != jit.StageLink || len(policyErr.Violations) != 1 {
+		t.Fatalf("expected 1 violation at stage %s, got: %s", jit.StageLink, err)
+	}
+	if v := policyErr.Violations[0]; v.Rule != jit.RuleSymbol || v.Symbol != "os.Exit" || v.User != "example.com/policy/snippet.Exit" {
+		t.Errorf("unexpected violation %+v", v)
+	}
+
+	conf.Policy.DenySymbols = nil
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/policy/snippet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = module.Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoroutineLabels(t *testing.T) {
+	module, symbols := buildLoadable(t, baseConfig, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_goroutine_labels/test.go"},
+		pkg:   "./testdata/test_goroutine_labels",
+	})
+	defer func() {
+		// Spin's goroutine may still be returning after closing its channel
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := module.UnloadWait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	block := symbols["Block"].(func(stop chan struct{}))
+	spin := symbols["Spin"].(func(d time.Duration) <-chan struct{})
+
+	stats := module.Stats()
+	if stats.Goroutines != 0 || stats.CodeBytes == 0 || stats.MappedCodeBytes < stats.CodeBytes {
+		t.Fatalf("unexpected stats before starting goroutines: %+v", stats)
+	}
+
+	stop := make(chan struct{})
+	block(stop)
+	block(stop)
+	if stats = module.Stats(); stats.Goroutines != 2 || stats.GoroutinesStarted != 2 {
+		t.Errorf("expected 2 live goroutines, got %+v", stats)
+	}
+	key, value := module.Label()
+	var goroutines bytes.Buffer
+	err := pprof.Lookup("goroutine").WriteTo(&goroutines, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("labels: {%q:%q}", key, value); strings.Count(goroutines.String(), expected) != 1 {
+		t.Errorf("expected goroutine profile to contain 2 goroutines with %s, got:\n%s", expected, goroutines.String())
+	}
+	close(stop)
+	for i := 0; i < 100 && module.Stats().Goroutines != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats = module.Stats(); stats.Goroutines != 0 || stats.GoroutinesStarted != 2 {
+		t.Errorf("expected no live goroutines, got %+v", stats)
+	}
+
+	var profile bytes.Buffer
+	err = pprof.StartCPUProfile(&profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-spin(300 * time.Millisecond)
+	pprof.StopCPUProfile()
+	err = goloader.AccountCPUProfile(&profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats = module.Stats(); stats.CPUSamples == 0 || stats.CPUTime == 0 {
+		t.Errorf("expected CPU samples to be attributed to the module, got %+v", stats)
+	}
+}
+
+func TestUnloadBusy(t *testing.T) {
+	module, symbols := buildLoadable(t, baseConfig, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_goroutine_labels/test.go"},
+		pkg:   "./testdata/test_goroutine_labels",
+	})
+	block := symbols["Block"].(func(stop chan struct{}))
+	stop := make(chan struct{})
+	block(stop)
+
+	err := module.Unload()
+	if !errors.Is(err, goloader.ErrModuleBusy) {
+		t.Fatalf("expected ErrModuleBusy, got %v", err)
+	}
+	var busyErr *goloader.ModuleBusyError
+	if !errors.As(err, &busyErr) || len(busyErr.Goroutines) != 1 {
+		t.Fatalf("expected 1 busy goroutine, got %v", err)
+	}
+	if funcs := busyErr.Goroutines[0].Functions; len(funcs) != 1 || !strings.HasSuffix(funcs[0], "test_goroutine_labels.Block.func1") {
+		t.Errorf("expected busy goroutine to be running Block.func1, got %v", funcs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = module.UnloadWait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected UnloadWait to time out, got %v", err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = module.UnloadWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recurseThen calls f at the bottom of depth frames
+//
+//go:noinline
+func recurseThen(depth int, f func()) {
+	if depth == 0 {
+		f()
+		return
+	}
+	recurseThen(depth-1, f)
+}
+
+func TestUnloadBusyDeepGeneric(t *testing.T) {
+	conf := baseConfig
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/busy\n\ngo 1.18\n"),
+		"gen/gen.go": []byte(`package gen
+
+//go:noinline
+func Call[T any](f func()) T {
+	var zero T
+	f()
+	return zero
+}
+
+// Run starts a goroutine which calls wait from a generic function
+func Run(wait func()) {
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		Call[int](wait)
+	}()
+	<-started
+}
+`),
+	}
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/busy/gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := module.SymbolsByPkg[loadable.ImportPath]["Run"].(func(wait func()))
+	stop, blocked := make(chan struct{}), make(chan struct{})
+	// The module's frames are further from the top of the stack than runtime.Stack would print
+	run(func() {
+		recurseThen(200, func() {
+			close(blocked)
+			<-stop
+		})
+	})
+	<-blocked
+
+	err = module.Unload()
+	var busyErr *goloader.ModuleBusyError
+	if !errors.As(err, &busyErr) {
+		t.Fatalf("expected ErrModuleBusy, got %v", err)
+	}
+	funcs := strings.Join(busyErr.Goroutines[0].Functions, ", ")
+	if len(busyErr.Goroutines) != 1 || !strings.Contains(funcs, "gen.Call[") || !strings.Contains(funcs, "gen.Run.func1") {
+		t.Errorf("expected busy goroutine to be running Call[int] from Run.func1, got %v", busyErr)
+	}
+
+	close(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = module.UnloadWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var heldCodePtr unsafe.Pointer
+var heldHolder *struct{ add func(a, b int) int }
+
+// holdFuncValue stores a func value for add in heldHolder, whose funcval is only referenced from heldHolder
+//
+//go:noinline
+func holdFuncValue(add func(a, b int) int) {
+	fv := new([2]uintptr) // Not a tiny allocation, so not shared with other objects
+	fv[0] = reflect.ValueOf(add).Pointer()
+	heldHolder = &struct{ add func(a, b int) int }{add: *(*func(a, b int) int)(unsafe.Pointer(&fv))}
+}
+
+func TestFindReferences(t *testing.T) {
+	module, symbols := buildLoadable(t, baseConfig, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_simple_func/test.go"},
+		pkg:   "./testdata/test_simple_func",
+	})
+	symPtr := make(map[string]uintptr)
+	err := goloader.RegSymbol(symPtr, map[string]struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := symbols["Add"].(func(a, b int) int)
+	heldCodePtr = unsafe.Pointer(reflect.ValueOf(add).Pointer())
+	holdFuncValue(add)
+
+	refs, err := module.FindReferences(goloader.WithHostSymbols(symPtr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Root != "github.com/eh-steve/goloader/jit_test.heldCodePtr" || !strings.HasSuffix(refs[0].TargetName, "test_simple_func.Add") {
+		t.Errorf("expected a reference from heldCodePtr to Add, got %v", refs)
+	}
+	err = module.Unload(goloader.WithFailOnReferences())
+	if !errors.Is(err, goloader.ErrModuleReferenced) {
+		t.Fatalf("expected ErrModuleReferenced, got %v", err)
+	}
+	heldCodePtr = nil
+
+	refs, err = module.FindReferences(goloader.WithHostSymbols(symPtr), goloader.WithHeapScan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, ref := range refs {
+		if len(ref.Path) == 2 && ref.Path[0] == "github.com/eh-steve/goloader/jit_test.heldHolder" && strings.HasSuffix(ref.TargetName, "test_simple_func.Add") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a reference to Add reachable via heldHolder, got %v", refs)
+	}
+	heldHolder = nil
+
+	err = module.Unload(goloader.WithFailOnReferences(goloader.WithHostSymbols(symPtr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindReferencesConcurrentUnload(t *testing.T) {
+	module, _ := buildLoadable(t, baseConfig, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_simple_func/test.go"},
+		pkg:   "./testdata/test_simple_func",
+	})
+	defer module.Unload()
+	var loadables []*jit.LoadableUnit
+	for i := 0; i < 4; i++ {
+		loadable, err := jit.BuildGoPackage(baseConfig, "./testdata/test_simple_func")
+		if err != nil {
+			t.Fatal(err)
+		}
+		loadables = append(loadables, loadable)
+	}
+
+	// Scanning other modules' globals mustn't read those of a module being unloaded underneath it
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for _, loadable := range loadables {
+			other, err := loadable.Load()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err = other.Unload(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case err, ok := <-errs:
+			if ok {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		if _, err := module.FindReferences(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandles(t *testing.T) {
+	module, symbols := buildLoadable(t, baseConfig, "BuildGoPackage", testData{
+		files: []string{"./testdata/test_simple_func/test.go"},
+		pkg:   "./testdata/test_simple_func",
+	})
+	add := symbols["Add"].(func(a, b int) int)
+	h1 := module.Acquire()
+	h2 := module.Acquire()
+	if err := module.Unload(); err == nil {
+		t.Fatal("expected Unload to fail with unreleased handles")
+	}
+	if err := h1.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if got := add(1, 2); got != 3 {
+		t.Errorf("expected 3, got %d", got)
+	}
+	if h2.Module() != module {
+		t.Error("expected handle to return its module")
+	}
+	if err := h2.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectPanic := func(name, message string, f func()) {
+		t.Helper()
+		defer func() {
+			r := recover()
+			if r == nil || !strings.Contains(fmt.Sprint(r), message) {
+				t.Errorf("expected %s to panic with %q, got %v", name, message, r)
+			}
+		}()
+		f()
+	}
+	expectPanic("double release", "released twice", func() { _ = h1.Release() })
+	expectPanic("use after release", "after it was released", func() { h2.Module() })
+	expectPanic("acquire after unload", "after it was unloaded", func() { module.Acquire() })
+	if err := module.Unload(); err == nil || !strings.Contains(err.Error(), "already been unloaded") {
+		t.Errorf("expected Unload after the last Handle was released to fail, got %v", err)
+	}
+}
+
+func TestReplaceFunction(t *testing.T) {
+	conf := baseConfig
+	source := func(farewell string) map[string][]byte {
+		return map[string][]byte{
+			"go.mod": []byte("module example.com/replace\n\ngo 1.18\n"),
+			"greet/greet.go": []byte(`package greet
+
+func Greet(name string) string { return "hello " + name }
+
+func GreetAll(names []string) string {
+	result := ""
+	for _, name := range names {
+		result += Greet(name) + " "
+	}
+	return result
+}
+
+//go:noinline
+func Farewell(name string) string { return "` + farewell + ` " + name }
+
+func Count(name string) int { return len(name) }
+
+func SayFarewell(name string) string { return Farewell(name) + "!" }
+`),
+		}
+	}
+	load := func(farewell string) *goloader.CodeModule {
+		t.Helper()
+		loadable, err := jit.BuildGoFileMap(conf, source(farewell), "example.com/replace/greet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		module, err := loadable.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return module
+	}
+	oldModule := load("goodbye")
+	newModule := load("farewell")
+	symbols := oldModule.SymbolsByPkg["example.com/replace/greet"]
+	sayFarewell := symbols["SayFarewell"].(func(string) string)
+	farewell := symbols["Farewell"].(func(string) string)
+
+	_, err := goloader.ReplaceFunction(oldModule, "example.com/replace/greet.Greet", newModule, "example.com/replace/greet.Greet")
+	if err == nil || !strings.Contains(err.Error(), "inlined into example.com/replace/greet.GreetAll") {
+		t.Errorf("expected inlined function to be refused, got %v", err)
+	}
+	_, err = goloader.ReplaceFunction(oldModule, "example.com/replace/greet.Farewell", newModule, "example.com/replace/greet.Count")
+	var mismatch *goloader.TypeMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Errorf("expected a TypeMismatchError, got %v", err)
+	}
+
+	replacement, err := goloader.ReplaceFunction(oldModule, "example.com/replace/greet.Farewell", newModule, "example.com/replace/greet.Farewell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sayFarewell("bob"); got != "farewell bob!" {
+		t.Errorf("expected replaced function to be called, got %q", got)
+	}
+	if got := farewell("bob"); got != "farewell bob" {
+		t.Errorf("expected func value to call replaced function, got %q", got)
+	}
+	if err = newModule.Unload(); err == nil {
+		t.Error("expected Unload of replacement module to fail while the replacement is active")
+	}
+
+	if err = replacement.Revert(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sayFarewell("bob"); got != "goodbye bob!" {
+		t.Errorf("expected original function after Revert, got %q", got)
+	}
+	if err = newModule.Unload(); err != nil {
+		t.Fatal(err)
+	}
+	if err = oldModule.Unload(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//go:noinline
+func HostPrice(quantity int) int { return quantity }
+
+func HostDiscount(price int) int { return price - 1 }
+
+var hostDiscount = HostDiscount
+
+func TestOverrideHostFunction(t *testing.T) {
+	if _, err := goloader.HostFuncSignatures(); err != nil {
+		t.Skipf("host has no DWARF: %s", err)
+	}
+	symPtr := make(map[string]uintptr)
+	err := goloader.RegSymbol(symPtr, map[string]struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/override\n\ngo 1.18\n"),
+		"pricing/pricing.go": []byte(`package pricing
+
+func Price(quantity int) int { return quantity * 100 }
+
+func Describe(quantity int) string { return "a price" }
+`),
+	}
+	loadable, err := jit.BuildGoFileMap(baseConfig, files, "example.com/override/pricing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = goloader.OverrideHostFunction(symPtr, "github.com/eh-steve/goloader/jit_test.HostPrice", module, "example.com/override/pricing.Describe")
+	if err == nil || !strings.Contains(err.Error(), "host function is func(int) int") {
+		t.Errorf("expected signature mismatch, got %v", err)
+	}
+	if HostDiscount(2) != hostDiscount(2) {
+		t.Fatal("expected HostDiscount to be inlined into the test")
+	}
+	_, err = goloader.OverrideHostFunction(symPtr, "github.com/eh-steve/goloader/jit_test.HostDiscount", module, "example.com/override/pricing.Price")
+	if err == nil || !strings.Contains(err.Error(), "inlined in the host") {
+		t.Errorf("expected inlined host function to be refused, got %v", err)
+	}
+
+	_, err = goloader.OverrideHostFunction(symPtr, "github.com/eh-steve/goloader/jit_test.HostPrice", module, "example.com/override/pricing.Price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := HostPrice(3); got != 300 {
+		t.Errorf("expected overridden host function to return 300, got %d", got)
+	}
+	err = module.Unload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := HostPrice(3); got != 3 {
+		t.Errorf("expected host function to be restored on Unload, got %d", got)
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	conf := baseConfig
+	conf.Debug = true
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/debuginfo\n\ngo 1.18\n"),
+		"calc/calc.go": []byte(`package calc
+
+type Point struct {
+	X, Y int
+}
+
+func Scale(p Point, factor int) Point {
+	scaled := Point{p.X * factor, p.Y * factor}
+	return scaled
+}
+`),
+	}
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/debuginfo/calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := module.Unload(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	f, err := elf.NewFile(bytes.NewReader(module.DebugELF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := f.DWARF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scaleAddr := module.Syms["example.com/debuginfo/calc.Scale"]
+	var unit *dwarf.Entry
+	locations := map[string]bool{}
+	var paramType dwarf.Type
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagSubprogram || e.Val(dwarf.AttrName) != "example.com/debuginfo/calc.Scale" {
+			if e.Tag == dwarf.TagCompileUnit {
+				unit = e
+			} else if e.Tag != 0 {
+				r.SkipChildren()
+			}
+			continue
+		}
+		if lowPC, _ := e.Val(dwarf.AttrLowpc).(uint64); uintptr(lowPC) != scaleAddr {
+			t.Errorf("expected Scale's low_pc to be relocated to 0x%x, got 0x%x", scaleAddr, lowPC)
+		}
+		for e.Children {
+			child, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if child.Tag == 0 {
+				break
+			}
+			name, _ := child.Val(dwarf.AttrName).(string)
+			if (child.Tag == dwarf.TagFormalParameter || child.Tag == dwarf.TagVariable) && child.Val(dwarf.AttrLocation) != nil {
+				locations[name] = true
+			}
+			if name == "p" {
+				if off, ok := child.Val(dwarf.AttrType).(dwarf.Offset); ok {
+					paramType, err = d.Type(off)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if child.Children {
+				r.SkipChildren()
+			}
+		}
+		break
+	}
+	if unit == nil {
+		t.Fatal("expected a compilation unit containing Scale")
+	}
+	for _, name := range []string{"p", "factor", "scaled"} {
+		if !locations[name] {
+			t.Errorf("expected a location for variable %s, got %v", name, locations)
+		}
+	}
+	if st, ok := paramType.(*dwarf.StructType); !ok || len(st.Field) != 2 || st.Field[1].Name != "Y" || st.Field[1].ByteOffset != 8 {
+		t.Errorf("expected p to be a struct with fields X and Y, got %v", paramType)
+	}
+
+	lines, err := d.LineReader(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line dwarf.LineEntry
+	found := false
+	for lines.Next(&line) == nil {
+		if uintptr(line.Address) >= scaleAddr && strings.HasSuffix(line.File.Name, "calc.go") && line.Line == 8 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a line table entry for line 8 of calc.go within Scale")
+	}
+}
+
+func TestPerfMap(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("perf maps are only supported on linux")
+	}
+	conf := baseConfig
+	conf.PerfMap = true
+	conf.PerfJITDump = true
+	conf.PerfJITDumpDir = t.TempDir()
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/perfmap\n\ngo 1.18\n"),
+		"calc/calc.go": []byte(`package calc
+
+func Add(a, b int) int {
+	return a + b
+}
+`),
+	}
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/perfmap/calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	perfMapPath := fmt.Sprintf("/tmp/perf-%d.map", os.Getpid())
+	entry := fmt.Sprintf("%x ", module.Syms["example.com/perfmap/calc.Add"])
+	perfMapHasAdd := func() bool {
+		data, err := os.ReadFile(perfMapPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, entry) && strings.HasSuffix(line, " example.com/perfmap/calc.Add") {
+				return true
+			}
+		}
+		return false
+	}
+	if !perfMapHasAdd() {
+		t.Errorf("expected %s to have an entry for calc.Add at %s", perfMapPath, entry)
+	}
+
+	dump, err := os.ReadFile(filepath.Join(conf.PerfJITDumpDir, fmt.Sprintf("jit-%d.dump", os.Getpid())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump) < 40 || binary.LittleEndian.Uint32(dump) != 0x4A695444 {
+		t.Fatalf("expected the jitdump to start with a header, got %d bytes", len(dump))
+	}
+	if !bytes.Contains(dump, []byte("example.com/perfmap/calc.Add\x00")) {
+		t.Errorf("expected a code load record for calc.Add in the jitdump")
+	}
+	if !bytes.Contains(dump, []byte("calc.go\x00")) {
+		t.Errorf("expected a debug info record referencing calc.go in the jitdump")
+	}
+
+	if err = module.Unload(); err != nil {
+		t.Fatal(err)
+	}
+	if perfMapHasAdd() {
+		t.Errorf("expected calc.Add's entry to be removed from %s after unloading", perfMapPath)
+	}
+}
+
+func TestLookupPC(t *testing.T) {
+	conf := baseConfig
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/lookup\n\ngo 1.18\n"),
+		"calc/calc.go": []byte(`package calc
+
+import "runtime"
+
+//go:noinline
+func callerPC() uintptr {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	return pcs[0]
+}
+
+func where() uintptr {
+	return callerPC()
+}
+
+func Compute(x int) (int, uintptr) {
+	return x * 3, where()
+}
+`),
+	}
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/lookup/calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := module.Unload(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	compute := module.SymbolsByPkg[loadable.ImportPath]["Compute"].(func(int) (int, uintptr))
+	_, pc := compute(2)
+	// pc is the return address of the call to callerPC, so step back into the call
+	info, ok := goloader.LookupPC(pc - 1)
+	if !ok {
+		t.Fatalf("expected 0x%x to be found within the module", pc)
+	}
+	if info.Module != module || info.ImportPath != "example.com/lookup/calc" || info.LoadTime.IsZero() {
+		t.Errorf("expected the PC to be attributed to the loaded module, got %s (%s) loaded at %s", info.Label, info.ImportPath, info.LoadTime)
+	}
+	if info.Function != "example.com/lookup/calc.Compute" || info.Entry != module.Syms["example.com/lookup/calc.Compute"] {
+		t.Errorf("expected the PC to be within calc.Compute at 0x%x, got %s at 0x%x", module.Syms["example.com/lookup/calc.Compute"], info.Function, info.Entry)
+	}
+	expected := []goloader.SourceFrame{
+		{Function: "example.com/lookup/calc.where", Line: 13},
+		{Function: "example.com/lookup/calc.Compute", Line: 17},
+	}
+	if len(info.Frames) != len(expected) {
+		t.Fatalf("expected frames %v, got %v", expected, info.Frames)
+	}
+	for i, frame := range info.Frames {
+		if frame.Function != expected[i].Function || frame.Line != expected[i].Line || !strings.HasSuffix(frame.File, "calc.go") {
+			t.Errorf("expected frame %d to be %s at calc.go:%d, got %s at %s:%d", i, expected[i].Function, expected[i].Line, frame.Function, frame.File, frame.Line)
+		}
+	}
+	if _, ok = goloader.LookupPC(reflect.ValueOf(TestLookupPC).Pointer()); ok {
+		t.Errorf("expected a host PC not to be found within any module")
+	}
+
+	var found bool
+	funcs := module.Functions()
+	for i, f := range funcs {
+		if i > 0 && f.Entry < funcs[i-1].Entry+uintptr(funcs[i-1].Size) {
+			t.Errorf("expected functions to be ordered by address without overlapping, got %s after %s", f.Name, funcs[i-1].Name)
+		}
+		if f.Name == "example.com/lookup/calc.Compute" {
+			found = true
+			if f.Entry != info.Entry || f.Size <= 0 || !strings.HasSuffix(f.File, "calc.go") || f.Line != 16 {
+				t.Errorf("unexpected function info for calc.Compute: %+v", f)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected calc.Compute among the module's functions")
+	}
+}
+
+func TestModuleInfo(t *testing.T) {
+	conf := baseConfig
+	files := map[string][]byte{
+		"go.mod": []byte("module example.com/info\n\ngo 1.18\n"),
+		"util/util.go": []byte(`package util
+
+//go:noinline
+func Double(x int) int {
+	return x * 2
+}
+`),
+		"calc/calc.go": []byte(`package calc
+
+import "example.com/info/util"
+
+var Counter = map[string]int{}
+
+func init() {
+	Counter["init"] = util.Double(21)
+}
+
+func Get(key string) int {
+	return Counter[key]
+}
+`),
+	}
+	loadable, err := jit.BuildGoFileMap(conf, files, "example.com/info/calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, err := loadable.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := module.Unload(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	data, err := json.Marshal(module.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info goloader.ModuleInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ImportPath != "example.com/info/calc" || info.GoVersion == "" || info.LoadTime.IsZero() {
+		t.Errorf("unexpected module details: %s built with %q loaded at %s", info.ImportPath, info.GoVersion, info.LoadTime)
+	}
+	if info.BuildInfo == nil || info.BuildInfo.Path != "example.com/info/calc" || info.BuildInfo.Main.Path != "example.com/info" || info.BuildInfo.GoVersion == "" {
+		t.Errorf("expected build info for example.com/info/calc, got %+v", info.BuildInfo)
+	}
+
+	packages := map[string]goloader.PackageInfo{}
+	var order []string
+	for _, pkg := range info.Packages {
+		packages[pkg.Path] = pkg
+		order = append(order, pkg.Path)
+	}
+	util, calc := packages["example.com/info/util"], packages["example.com/info/calc"]
+	if len(order) == 0 || order[len(order)-1] != "example.com/info/calc" {
+		t.Errorf("expected the main package to be last in autolib order, got %v", order)
+	}
+	if len(util.ImportedBy) != 1 || util.ImportedBy[0] != "example.com/info/calc" {
+		t.Errorf("expected util to be linked because calc imports it, got %+v", util)
+	}
+	if calc.CodeBytes == 0 || util.CodeBytes == 0 {
+		t.Errorf("expected both packages to have code, got calc: %+v, util: %+v", calc, util)
+	}
+	if calc.DataBytes+calc.NoPtrDataBytes+calc.BSSBytes+calc.NoPtrBSSBytes == 0 {
+		t.Errorf("expected calc to have data for Counter, got %+v", calc)
+	}
+
+	var ranInit bool
+	for _, task := range info.InitTasks {
+		if task == "example.com/info/calc..inittask" {
+			ranInit = true
+		}
+	}
+	if !ranInit {
+		t.Errorf("expected calc's init task to have run, got %v", info.InitTasks)
+	}
+	get := module.SymbolsByPkg[loadable.ImportPath]["Get"].(func(string) int)
+	if get("init") != 42 {
+		t.Errorf("expected init to have set Counter")
+	}
+}
@@ -3,6 +3,7 @@ package jit
 import (
 	"fmt"
 	"github.com/eh-steve/goloader"
+	"io"
 )
 
 type LoadableUnit struct {
@@ -25,3 +26,26 @@ func (l *LoadableUnit) Load() (module *goloader.CodeModule, err error) {
 
 	return module, nil
 }
+
+// WriteImage writes a pre-linked image of the unit, which can be loaded later by ReadImage in the same host binary
+// without a Go toolchain. It must be called before Load.
+func (l *LoadableUnit) WriteImage(w io.Writer) error {
+	if l == nil || l.Linker == nil {
+		return fmt.Errorf("can't write image of nil LoadableUnit")
+	}
+	if l.Module != nil {
+		return fmt.Errorf("can't write image of LoadableUnit %s after it has been loaded", l.ImportPath)
+	}
+	return l.Linker.WriteImage(w)
+}
+
+func ReadImage(r io.Reader) (*LoadableUnit, error) {
+	linker, err := goloader.ReadImage(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	return &LoadableUnit{
+		Linker:     linker,
+		ImportPath: linker.MainPkgPath(),
+	}, nil
+}
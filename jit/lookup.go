@@ -0,0 +1,57 @@
+package jit
+
+import (
+	"fmt"
+	"github.com/eh-steve/goloader"
+	"reflect"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Lookup returns the exported symbol name from package pkgPath in module as a T, which should be a func type for
+// functions, or a pointer type for variables (e.g. *int for a var of type int).
+// Types defined inside the JIT module can be requested using structurally equal types defined in the host.
+// If the symbol's type doesn't match T, the returned error (a wrapped *goloader.TypeMismatchError) describes
+// how the types differ.
+func Lookup[T any](module *goloader.CodeModule, pkgPath, name string) (T, error) {
+	var zero T
+	if module == nil {
+		return zero, fmt.Errorf("can't look up %s.%s in nil module", pkgPath, name)
+	}
+	pkgSyms, ok := module.SymbolsByPkg[pkgPath]
+	if !ok {
+		pkgs := make([]string, 0, len(module.SymbolsByPkg))
+		for pkg := range module.SymbolsByPkg {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		return zero, fmt.Errorf("package %s not found in module (packages with exported symbols: %s)", pkgPath, strings.Join(pkgs, ", "))
+	}
+	sym, ok := pkgSyms[name]
+	if !ok {
+		return zero, fmt.Errorf("symbol %s not found in package %s", name, pkgPath)
+	}
+
+	if typed, ok := sym.(T); ok {
+		return typed, nil
+	}
+
+	expected := reflect.TypeOf((*T)(nil)).Elem()
+	actual := reflect.TypeOf(sym)
+	err := goloader.TypeMismatch(expected, actual)
+	if err != nil {
+		return zero, fmt.Errorf("symbol %s.%s has the wrong type: %w", pkgPath, name, err)
+	}
+
+	// The types are equal but have different type descriptors (e.g. a type defined in the JIT module
+	// is being looked up using the host's equivalent type), so reinterpret the symbol's pointer as a T
+	switch expected.Kind() {
+	case reflect.Func, reflect.Ptr:
+		var typed T
+		*(*unsafe.Pointer)(unsafe.Pointer(&typed)) = (*[2]unsafe.Pointer)(unsafe.Pointer(&sym))[1]
+		return typed, nil
+	default:
+		return zero, fmt.Errorf("symbol %s.%s can't be looked up as %s, only func and pointer-to-variable types are supported", pkgPath, name, expected)
+	}
+}
@@ -0,0 +1,324 @@
+package jit
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ErrModuleNotAvailable is wrapped by build errors caused by a module missing from an offline ModuleSource
+var ErrModuleNotAvailable = errors.New("module not available from offline module source")
+
+// ModuleSource provides modules from local files for builds on hosts without network access. When set on a
+// BuildConfig, every go command runs with GOPROXY pointing only at these sources, and with checksum database lookups,
+// VCS fetches and toolchain downloads disabled, so a missing module fails the build immediately.
+type ModuleSource struct {
+	ProxyDir   string   // Directory in GOPROXY format (<module>/@v/<version>.{info,mod,zip}), e.g. $GOMODCACHE/cache/download
+	ModuleZips []string // Module zip files (as served by a module proxy), whose module path and version are read from their contents
+	// Vendor directory of the module being built (as created by 'go mod vendor'), used via -mod=vendor. The go command
+	// only uses the vendor directory at the root of the module, so BuildGoFS and BuildGoFileMap link it into the module
+	// they lay out, while the builders of modules on disk refuse any other directory
+	VendorDir string
+}
+
+func (s *ModuleSource) String() string {
+	var sources []string
+	if s.ProxyDir != "" {
+		sources = append(sources, "proxy dir "+s.ProxyDir)
+	}
+	if len(s.ModuleZips) > 0 {
+		sources = append(sources, fmt.Sprintf("%d module zip(s)", len(s.ModuleZips)))
+	}
+	if s.VendorDir != "" {
+		sources = append(sources, "vendor dir "+s.VendorDir)
+	}
+	return strings.Join(sources, ", ")
+}
+
+func (s *ModuleSource) hasProxy() bool {
+	return s.ProxyDir != "" || len(s.ModuleZips) > 0
+}
+
+// env returns the environment overrides for go commands using this source, on top of baseEnv
+func (s *ModuleSource) env(baseEnv []string) ([]string, error) {
+	var proxies []string
+	if s.ProxyDir != "" {
+		absDir, err := filepath.Abs(s.ProxyDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path of module proxy dir %s: %w", s.ProxyDir, err)
+		}
+		proxies = append(proxies, fileURL(absDir))
+	}
+	if len(s.ModuleZips) > 0 {
+		zipProxyDir, err := moduleZipProxy(s.ModuleZips)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, fileURL(zipProxyDir))
+	}
+	goProxy := "off"
+	if len(proxies) > 0 {
+		goProxy = strings.Join(proxies, ",")
+	}
+	env := []string{
+		"GOPROXY=" + goProxy,
+		"GOSUMDB=off", // Existing go.sum entries are still verified
+		"GOVCS=*:off", // Modules matching GOPRIVATE/GONOPROXY would otherwise be fetched directly from VCS
+		"GOTOOLCHAIN=local",
+	}
+	if s.VendorDir != "" {
+		goFlags := lookupEnv(baseEnv, "GOFLAGS")
+		env = append(env, strings.TrimSpace("GOFLAGS="+goFlags+" -mod=vendor"))
+	}
+	return env, nil
+}
+
+// checkVendorDir fails if the ModuleSource has a VendorDir which isn't the vendor directory of the module enclosing dir,
+// since the go command would silently use that module's own vendor directory (or fail) instead
+func (config *BuildConfig) checkVendorDir(dir string) error {
+	if config.ModuleSource == nil || config.ModuleSource.VendorDir == "" {
+		return nil
+	}
+	vendorDir, err := filepath.Abs(config.ModuleSource.VendorDir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path of vendor dir %s: %w", config.ModuleSource.VendorDir, err)
+	}
+	moduleDir := dir
+	for {
+		if _, err = os.Stat(filepath.Join(moduleDir, "go.mod")); err == nil {
+			break
+		}
+		parent := filepath.Dir(moduleDir)
+		if parent == moduleDir {
+			return fmt.Errorf("could not find module/go.mod file for path %s to use vendor dir %s", dir, vendorDir)
+		}
+		moduleDir = parent
+	}
+	if vendorDir != filepath.Join(moduleDir, "vendor") {
+		return fmt.Errorf("can't use vendor dir %s for module at %s, which can only be built from its own vendor dir", vendorDir, moduleDir)
+	}
+	return nil
+}
+
+func lookupEnv(env []string, key string) string {
+	value := os.Getenv(key)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			value = strings.TrimPrefix(kv, key+"=")
+		}
+	}
+	return value
+}
+
+func fileURL(absPath string) string {
+	return "file://" + filepath.ToSlash(absPath)
+}
+
+// moduleSourceEnv returns environment overrides to pass to every go command, or nil if there's no ModuleSource
+func (config *BuildConfig) moduleSourceEnv() ([]string, error) {
+	if config.ModuleSource == nil {
+		return nil, nil
+	}
+	env, err := config.ModuleSource.env(config.BuildEnv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid module source: %w", err)
+	}
+	return env, nil
+}
+
+var missingModuleMessages = []string{
+	"GOVCS disallows",
+	"module lookup disabled by GOPROXY=off",
+	"cannot find module providing package",
+	"is not in vendor/modules.txt",
+	"inconsistent vendoring",
+	"reading file://",
+}
+
+// offlineError marks a go command failure as a missing module if the build is offline and the output says so
+func (config *BuildConfig) offlineError(output string, err error) error {
+	if config.ModuleSource == nil {
+		return err
+	}
+	for _, message := range missingModuleMessages {
+		if strings.Contains(output, message) {
+			return fmt.Errorf("%w (using %s): %s", ErrModuleNotAvailable, config.ModuleSource, err)
+		}
+	}
+	return err
+}
+
+var zipProxies sync.Map
+
+// moduleZipProxy lays out module zips as a GOPROXY-format directory, reusing a previous layout of the same zips
+func moduleZipProxy(zipPaths []string) (string, error) {
+	h := sha256.New()
+	sortedPaths := make([]string, 0, len(zipPaths))
+	for _, zipPath := range zipPaths {
+		absPath, err := filepath.Abs(zipPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to get absolute path of module zip %s: %w", zipPath, err)
+		}
+		sortedPaths = append(sortedPaths, absPath)
+	}
+	sort.Strings(sortedPaths)
+	for _, zipPath := range sortedPaths {
+		info, err := os.Stat(zipPath)
+		if err != nil {
+			return "", fmt.Errorf("could not stat module zip %s: %w", zipPath, err)
+		}
+		_, _ = fmt.Fprintf(h, "%s\x00%d\x00%d\x00", zipPath, info.Size(), info.ModTime().UnixNano())
+	}
+	key := hex.EncodeToString(h.Sum(nil))[:16]
+	if dir, ok := zipProxies.Load(key); ok {
+		return dir.(string), nil
+	}
+
+	dir := filepath.Join(os.TempDir(), "goloader_module_zips_"+key)
+	if _, err := os.Stat(dir); err == nil {
+		zipProxies.Store(key, dir)
+		return dir, nil
+	}
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "goloader_module_zips_"+key+"_*")
+	if err != nil {
+		return "", fmt.Errorf("could not create module proxy dir: %w", err)
+	}
+	versionsByModule := map[string][]string{}
+	for _, zipPath := range sortedPaths {
+		modPath, version, err := addModuleZip(tmpDir, zipPath)
+		if err != nil {
+			_ = os.RemoveAll(tmpDir)
+			return "", err
+		}
+		versionsByModule[modPath] = append(versionsByModule[modPath], version)
+	}
+	for modPath, versions := range versionsByModule {
+		escapedPath, _ := escapeModulePath(modPath)
+		listFile := filepath.Join(tmpDir, filepath.FromSlash(escapedPath), "@v", "list")
+		err = os.WriteFile(listFile, []byte(strings.Join(versions, "\n")+"\n"), 0644)
+		if err != nil {
+			_ = os.RemoveAll(tmpDir)
+			return "", fmt.Errorf("could not write module version list %s: %w", listFile, err)
+		}
+	}
+	err = os.Rename(tmpDir, dir)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		// Another process may have laid out the same zips concurrently
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return "", fmt.Errorf("could not move module proxy dir into place: %w", err)
+		}
+	}
+	zipProxies.Store(key, dir)
+	return dir, nil
+}
+
+// addModuleZip copies a module zip into proxyDir, along with the .mod and .info files the go command also needs
+func addModuleZip(proxyDir, zipPath string) (modPath, version string, err error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not open module zip %s: %w", zipPath, err)
+	}
+	defer r.Close()
+	if len(r.File) == 0 {
+		return "", "", fmt.Errorf("module zip %s is empty", zipPath)
+	}
+	// Every file in a module zip is prefixed with module@version/ (and module paths can contain slashes)
+	name := r.File[0].Name
+	if at := strings.IndexByte(name, '@'); at > 0 {
+		if slash := strings.IndexByte(name[at:], '/'); slash > 1 {
+			modPath, version = name[:at], name[at+1:at+slash]
+		}
+	}
+	if modPath == "" || version == "" {
+		return "", "", fmt.Errorf("module zip %s doesn't contain files prefixed with module@version/", zipPath)
+	}
+
+	goMod := []byte(fmt.Sprintf("module %s\n", modPath))
+	for _, f := range r.File {
+		if f.Name == modPath+"@"+version+"/go.mod" {
+			rc, err := f.Open()
+			if err != nil {
+				return "", "", fmt.Errorf("could not open go.mod in module zip %s: %w", zipPath, err)
+			}
+			goMod, err = io.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				return "", "", fmt.Errorf("could not read go.mod in module zip %s: %w", zipPath, err)
+			}
+			break
+		}
+	}
+
+	escapedPath, err := escapeModulePath(modPath)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid module path in zip %s: %w", zipPath, err)
+	}
+	escapedVersion, err := escapeModulePath(version)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid module version in zip %s: %w", zipPath, err)
+	}
+	versionDir := filepath.Join(proxyDir, filepath.FromSlash(escapedPath), "@v")
+	err = os.MkdirAll(versionDir, os.ModePerm)
+	if err != nil {
+		return "", "", fmt.Errorf("could not create module proxy dir %s: %w", versionDir, err)
+	}
+	info, _ := json.Marshal(struct{ Version string }{Version: version})
+	for ext, data := range map[string][]byte{".mod": goMod, ".info": info} {
+		err = os.WriteFile(filepath.Join(versionDir, escapedVersion+ext), data, 0644)
+		if err != nil {
+			return "", "", fmt.Errorf("could not write module %s file for %s: %w", ext, zipPath, err)
+		}
+	}
+	err = copyFile(zipPath, filepath.Join(versionDir, escapedVersion+".zip"))
+	if err != nil {
+		return "", "", err
+	}
+	return modPath, version, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", dst, err)
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err != nil {
+		return fmt.Errorf("could not copy %s to %s: %w", src, dst, err)
+	}
+	return closeErr
+}
+
+// escapeModulePath applies the module proxy protocol's case encoding, where each upper case letter becomes '!' followed
+// by the lower case letter
+func escapeModulePath(path string) (string, error) {
+	var b strings.Builder
+	for _, r := range path {
+		switch {
+		case r == '!' || r >= unicode.MaxASCII:
+			return "", fmt.Errorf("invalid character %q in %s", r, path)
+		case 'A' <= r && r <= 'Z':
+			b.WriteByte('!')
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,304 @@
+package jit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eh-steve/goloader"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policy restricts what the code being built may do, for building code from untrusted sources.
+// It's checked before building, against the import graph from 'go list' and a scan of the source files, and after
+// building, against the symbols the compiled code references from outside itself.
+//
+// The standard library and packages matching TrustedPackages are exempt, so that e.g. "unsafe" can be denied to the
+// untrusted code while the trusted packages it imports still use it internally. All other packages (including any
+// modules the untrusted code depends on) are subject to the policy.
+//
+// Package patterns are as for the go command, e.g. "os/exec" or "net/..." (which also matches "net").
+// Symbol patterns are fully qualified symbol names, where * matches any run of characters, e.g. "os.Exit" or
+// "os.(*Process).*".
+type Policy struct {
+	AllowPackages   []string // If not empty, untrusted packages may only import packages matching these patterns
+	DenyPackages    []string // Packages which untrusted packages may neither import nor reference symbols from, e.g. "os/exec", "syscall", "unsafe"
+	AllowSymbols    []string // If not empty, untrusted packages may only reference external symbols matching these patterns (including the runtime functions the compiler calls)
+	DenySymbols     []string // External symbols which untrusted packages may not reference, e.g. "os.Exit"
+	TrustedPackages []string // Packages exempt from the policy, in addition to the standard library
+	AllowLinkname   bool     // Allow //go:linkname directives
+	AllowAsm        bool     // Allow assembly (.s) files
+	AllowCgo        bool     // Allow cgo (import "C"), and C/C++/Objective-C/Fortran/SWIG/.syso files
+}
+
+// PolicyRule identifies which rule of a Policy was violated
+type PolicyRule string
+
+const (
+	RuleImport   PolicyRule = "import"
+	RuleSymbol   PolicyRule = "symbol"
+	RuleLinkname PolicyRule = "linkname"
+	RuleAsm      PolicyRule = "asm"
+	RuleCgo      PolicyRule = "cgo"
+)
+
+// PolicyViolation is a single breach of a Policy
+type PolicyViolation struct {
+	Rule    PolicyRule
+	Package string // Import path of the offending package
+	File    string // File containing the violation, if known
+	Line    int    // Line of the violation within File, if known
+	Symbol  string // The imported package, referenced symbol or linknamed symbol which broke the rule, if any
+	User    string // For symbol violations, the symbol containing the reference
+	Message string
+}
+
+func (v PolicyViolation) String() string {
+	return Diagnostic{File: v.File, Line: v.Line, Message: v.Message}.String()
+}
+
+// PolicyError is wrapped by the BuildError returned by the Build* functions when the code being built violates
+// BuildConfig.Policy, and can be retrieved with errors.As
+type PolicyError struct {
+	Stage      BuildStage // StageList for violations found before building, or StageLink for those found after
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	lines := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		lines = append(lines, v.String())
+	}
+	return fmt.Sprintf("%d policy violation(s):\n%s", len(e.Violations), strings.Join(lines, "\n"))
+}
+
+func (p *Policy) trusted(pkgPath string, stdLibPkgs map[string]struct{}) bool {
+	if _, ok := stdLibPkgs[pkgPath]; ok {
+		return true
+	}
+	return matchAnyPackage(p.TrustedPackages, pkgPath)
+}
+
+// importAllowed reports whether untrusted packages may import pkgPath
+func (p *Policy) importAllowed(pkgPath string) bool {
+	if matchAnyPackage(p.DenyPackages, pkgPath) {
+		return false
+	}
+	return len(p.AllowPackages) == 0 || matchAnyPackage(p.AllowPackages, pkgPath)
+}
+
+func (p *Policy) symbolAllowed(symName string) bool {
+	if matchAnySymbol(p.DenySymbols, symName) {
+		return false
+	}
+	return len(p.AllowSymbols) == 0 || matchAnySymbol(p.AllowSymbols, symName)
+}
+
+// matchPackage matches an import path against a package pattern, as in $GOROOT/src/cmd/go/internal/search/search.go
+func matchPackage(pattern, pkgPath string) bool {
+	if pattern == pkgPath {
+		return true
+	}
+	if !strings.Contains(pattern, "...") {
+		return false
+	}
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	// Special case: foo/... matches foo too
+	if strings.HasSuffix(re, `/.*`) {
+		re = re[:len(re)-len(`/.*`)] + `(/.*)?`
+	}
+	matched, _ := regexp.MatchString("^"+re+"$", pkgPath)
+	return matched
+}
+
+func matchAnyPackage(patterns []string, pkgPath string) bool {
+	for _, pattern := range patterns {
+		if matchPackage(pattern, pkgPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnySymbol(patterns []string, symName string) bool {
+	for _, pattern := range patterns {
+		re := strings.Replace(regexp.QuoteMeta(pattern), `\*`, `.*`, -1)
+		if matched, _ := regexp.MatchString("^"+re+"$", symName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicySources checks the import graph and source files of the packages about to be built against config.Policy
+func (config *BuildConfig) checkPolicySources(ctx context.Context, workDir string, targets []string, stdLibPkgs map[string]struct{}) error {
+	policy := config.Policy
+	args := append([]string{"list", "-e", "-deps", "-json"}, config.extraBuildFlags()...)
+	args = append(args, targets...)
+	stdout, stderr, err := config.runGoCmd(ctx, workDir, args...)
+	if err != nil {
+		return stageError(ctx, StageList, config.newOutputBuildError(StageList, workDir, "", stderr, fmt.Errorf("failed to list packages for policy check: %w", err)))
+	}
+	overlay, err := config.overlayReplacements()
+	if err != nil {
+		return &BuildError{Stage: StageList, Err: err}
+	}
+
+	var violations []PolicyViolation
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	for decoder.More() {
+		pkg := &Package{}
+		err = decoder.Decode(pkg)
+		if err != nil {
+			return &BuildError{Stage: StageList, Err: fmt.Errorf("failed to decode 'go list' output for policy check: %w", err)}
+		}
+		if pkg.Standard || policy.trusted(pkg.ImportPath, stdLibPkgs) {
+			continue
+		}
+		violation := func(rule PolicyRule, file string, line int, symbol, message string) {
+			if file != "" {
+				file = config.displayFileName(workDir, file)
+			}
+			violations = append(violations, PolicyViolation{Rule: rule, Package: pkg.ImportPath, File: file, Line: line, Symbol: symbol, Message: message})
+		}
+
+		if !policy.AllowAsm {
+			for _, name := range pkg.SFiles {
+				violation(RuleAsm, filepath.Join(pkg.Dir, name), 0, "", fmt.Sprintf("package %s contains assembly", pkg.ImportPath))
+			}
+		}
+		if !policy.AllowCgo {
+			for _, files := range [][]string{pkg.CgoFiles, pkg.CFiles, pkg.CXXFiles, pkg.MFiles, pkg.FFiles, pkg.SwigFiles, pkg.SwigCXXFiles, pkg.SysoFiles} {
+				for _, name := range files {
+					violation(RuleCgo, filepath.Join(pkg.Dir, name), 0, "", fmt.Sprintf("package %s uses cgo or non-Go code", pkg.ImportPath))
+				}
+			}
+		}
+		for _, name := range append(append([]string{}, pkg.GoFiles...), pkg.CgoFiles...) {
+			fileName := filepath.Join(pkg.Dir, name)
+			src, err := readOverlayFile(overlay, fileName)
+			if err != nil {
+				return &BuildError{Stage: StageList, Err: fmt.Errorf("failed to read %s for policy check: %w", fileName, err)}
+			}
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, fileName, src, parser.ImportsOnly)
+			if err != nil {
+				// The compiler will report a better error
+				continue
+			}
+			for _, spec := range f.Imports {
+				importPath, _ := strconv.Unquote(spec.Path.Value)
+				if importPath == "C" {
+					continue
+				}
+				if mapped, ok := pkg.ImportMap[importPath]; ok {
+					importPath = mapped
+				}
+				if !policy.importAllowed(importPath) {
+					violation(RuleImport, fileName, fset.Position(spec.Pos()).Line, importPath, fmt.Sprintf("package %s imports %s", pkg.ImportPath, importPath))
+				}
+			}
+			if !policy.AllowLinkname {
+				// Like all compiler directives, //go:linkname must start at the beginning of a line
+				scanner := bufio.NewScanner(bytes.NewReader(src))
+				for line := 1; scanner.Scan(); line++ {
+					text := scanner.Text()
+					if strings.HasPrefix(text, "//go:linkname ") {
+						var symbol string
+						if fields := strings.Fields(text); len(fields) > 2 {
+							symbol = fields[2]
+						}
+						violation(RuleLinkname, fileName, line, symbol, fmt.Sprintf("package %s uses %s", pkg.ImportPath, text))
+					}
+				}
+			}
+		}
+	}
+	return policyError(StageList, violations)
+}
+
+// checkPolicySymbols checks the external symbols referenced by the untrusted packages in linker against config.Policy
+func (config *BuildConfig) checkPolicySymbols(workDir string, linker *goloader.Linker, stdLibPkgs map[string]struct{}) error {
+	policy := config.Policy
+	var violations []PolicyViolation
+	for _, ref := range linker.ExternalSymbolRefs() {
+		if ref.UserPkg == "" || policy.trusted(ref.UserPkg, stdLibPkgs) {
+			continue
+		}
+		var message string
+		switch {
+		// AllowPackages isn't applied here, since the compiler inserts calls into the runtime and other packages
+		case ref.Pkg != "" && matchAnyPackage(policy.DenyPackages, ref.Pkg):
+			message = fmt.Sprintf("%s references %s from package %s", ref.User, ref.Sym, ref.Pkg)
+		case !policy.symbolAllowed(ref.Sym):
+			message = fmt.Sprintf("%s references %s", ref.User, ref.Sym)
+		default:
+			continue
+		}
+		// Files are recorded relative to their module if built with -trimpath
+		file := ref.File
+		if filepath.IsAbs(file) {
+			file = config.displayFileName(workDir, file)
+		}
+		violations = append(violations, PolicyViolation{Rule: RuleSymbol, Package: ref.UserPkg, File: file, Symbol: ref.Sym, User: ref.User, Message: message})
+	}
+	return policyError(StageLink, violations)
+}
+
+func policyError(stage BuildStage, violations []PolicyViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		if violations[i].File != violations[j].File {
+			return violations[i].File < violations[j].File
+		}
+		return violations[i].Line < violations[j].Line
+	})
+	diagnostics := make([]Diagnostic, 0, len(violations))
+	for _, v := range violations {
+		diagnostics = append(diagnostics, Diagnostic{File: v.File, Line: v.Line, Message: v.Message, Package: v.Package, Stage: stage})
+	}
+	return &BuildError{Stage: stage, Diagnostics: diagnostics, Err: &PolicyError{Stage: stage, Violations: violations}}
+}
+
+// overlayReplacements returns the file replacements of any -overlay build flag, so that files can be read as the go
+// command sees them
+func (config *BuildConfig) overlayReplacements() (map[string]string, error) {
+	replace := map[string]string{}
+	for _, flag := range config.extraBuildFlags() {
+		if !strings.HasPrefix(flag, "-overlay=") {
+			continue
+		}
+		overlayFile := strings.TrimPrefix(flag, "-overlay=")
+		data, err := os.ReadFile(overlayFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read overlay file %s: %w", overlayFile, err)
+		}
+		overlay := goOverlay{}
+		err = json.Unmarshal(data, &overlay)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode overlay file %s: %w", overlayFile, err)
+		}
+		for from, to := range overlay.Replace {
+			replace[filepath.Clean(from)] = to
+		}
+	}
+	return replace, nil
+}
+
+func readOverlayFile(overlay map[string]string, fileName string) ([]byte, error) {
+	if replacement, ok := overlay[filepath.Clean(fileName)]; ok {
+		return os.ReadFile(replacement)
+	}
+	return os.ReadFile(fileName)
+}
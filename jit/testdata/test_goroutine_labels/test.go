@@ -0,0 +1,24 @@
+package test_goroutine_labels
+
+import "time"
+
+// Block starts a goroutine which blocks until stop is closed
+func Block(stop chan struct{}) {
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		<-stop
+	}()
+	<-started
+}
+
+// Spin starts a goroutine which burns CPU for d, and returns a channel closed once it's done
+func Spin(d time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for start := time.Now(); time.Since(start) < d; {
+		}
+	}()
+	return done
+}
@@ -0,0 +1,9 @@
+package test_gotests
+
+func Add(a, b int) int {
+	return a + b
+}
+
+func Divide(a, b int) int {
+	return a / b
+}
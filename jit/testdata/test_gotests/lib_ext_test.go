@@ -0,0 +1,23 @@
+package test_gotests_test
+
+import (
+	"fmt"
+	"github.com/eh-steve/goloader/jit/testdata/test_gotests"
+	"testing"
+)
+
+func TestExternal(t *testing.T) {
+	if test_gotests.Divide(6, 3) != 2 {
+		t.Fatal("expected 6 / 3 == 2")
+	}
+}
+
+func ExampleAdd() {
+	fmt.Println(test_gotests.Add(2, 3))
+	// Output: 5
+}
+
+func ExampleDivide_byZero() {
+	fmt.Println(test_gotests.Divide(1, 0))
+	// Output: 0
+}
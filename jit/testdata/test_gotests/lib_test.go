@@ -0,0 +1,42 @@
+package test_gotests
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	if Add(1, 2) != 3 {
+		t.Fatal("expected 1 + 2 == 3")
+	}
+	t.Log("added")
+}
+
+func TestSubtests(t *testing.T) {
+	for _, n := range []int{1, 2, 3} {
+		n := n
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			if Add(n, -n) != 0 {
+				t.Errorf("expected %d - %d == 0", n, n)
+			}
+		})
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	t.Skip("not today")
+}
+
+func TestFailing(t *testing.T) {
+	t.Error("expected failure")
+}
+
+func TestPanic(t *testing.T) {
+	Divide(1, 0)
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Add(i, i)
+	}
+}
@@ -0,0 +1,14 @@
+package test_race
+
+var counter int
+
+func Race() int {
+	done := make(chan struct{})
+	go func() {
+		counter++
+		close(done)
+	}()
+	counter++
+	<-done
+	return counter
+}
@@ -0,0 +1,385 @@
+package jit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eh-steve/goloader"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MigrateFunc is called by a Watcher once a rebuilt package has been loaded, before the new module is published and
+// the old one unloaded. It should move any live state (e.g. with goloader.ConvertTypesAcrossModules) from oldModule
+// to newModule, and stop anything still executing code from oldModule. Returning an error (or panicking) rolls back
+// the reload: newModule is unloaded and oldModule stays published.
+type MigrateFunc func(oldModule, newModule *goloader.CodeModule) error
+
+type WatcherConfig struct {
+	BuildConfig  BuildConfig
+	Debounce     time.Duration // How long to wait for changes to settle before rebuilding, defaults to 200ms
+	PollInterval time.Duration // How often to poll for changes if the platform has no file notifications, defaults to 1s
+	ForcePolling bool          // Poll for changes even if file notifications are available
+	Migrate      MigrateFunc
+	OnError      func(err error) // Called with any error from a background reload, which has been rolled back
+	// How long a reload waits for goroutines to leave the old module's code before unloading it in the background
+	// instead, defaults to 5s
+	UnloadTimeout time.Duration
+}
+
+// Watcher watches a package directory, and when files change, rebuilds and loads the package, migrates state
+// from the old module via WatcherConfig.Migrate, publishes the new module's symbols to subscribers and unloads the
+// old module. If any of those steps fail, the old module remains loaded and published.
+type Watcher struct {
+	config  WatcherConfig
+	pkgDir  string
+	current atomic.Value // *watchedVersion
+
+	reloadMutex sync.Mutex
+
+	subsMutex sync.Mutex
+	subs      map[chan map[string]map[string]interface{}]struct{}
+
+	changed chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type watchedVersion struct {
+	module *goloader.CodeModule
+	unit   *LoadableUnit
+}
+
+// NewWatcher builds and loads the package at pathToGoPackage, then watches its directory for changes until Close.
+func NewWatcher(config WatcherConfig, pathToGoPackage string) (*Watcher, error) {
+	pkgDir, err := filepath.Abs(pathToGoPackage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path at %s: %w", pathToGoPackage, err)
+	}
+	if config.Debounce <= 0 {
+		config.Debounce = 200 * time.Millisecond
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	if config.UnloadTimeout <= 0 {
+		config.UnloadTimeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		config:  config,
+		pkgDir:  pkgDir,
+		subs:    map[chan map[string]map[string]interface{}]struct{}{},
+		changed: make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	version, err := w.buildAndLoad()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w.current.Store(version)
+
+	notifier, err := w.newNotifier()
+	if err != nil {
+		cancel()
+		_ = version.module.Unload()
+		return nil, err
+	}
+
+	w.wg.Add(2)
+	go func() {
+		defer w.wg.Done()
+		notifier.run(ctx, w.notifyChanged)
+	}()
+	go func() {
+		defer w.wg.Done()
+		w.run(ctx)
+	}()
+	return w, nil
+}
+
+// Module returns the currently published module
+func (w *Watcher) Module() *goloader.CodeModule {
+	return w.current.Load().(*watchedVersion).module
+}
+
+// Symbols returns the SymbolsByPkg of the currently published module
+func (w *Watcher) Symbols() map[string]map[string]interface{} {
+	return w.Module().SymbolsByPkg
+}
+
+// ImportPath returns the import path of the watched package
+func (w *Watcher) ImportPath() string {
+	return w.current.Load().(*watchedVersion).unit.ImportPath
+}
+
+// Subscribe returns a channel which immediately receives the current symbols, and then the symbols of each newly
+// published module. Slow subscribers only ever see the latest version. The returned func unsubscribes.
+func (w *Watcher) Subscribe() (<-chan map[string]map[string]interface{}, func()) {
+	ch := make(chan map[string]map[string]interface{}, 1)
+	w.subsMutex.Lock()
+	ch <- w.Symbols()
+	w.subs[ch] = struct{}{}
+	w.subsMutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.subsMutex.Lock()
+			delete(w.subs, ch)
+			w.subsMutex.Unlock()
+		})
+	}
+}
+
+func (w *Watcher) publish(version *watchedVersion) {
+	w.subsMutex.Lock()
+	defer w.subsMutex.Unlock()
+	w.current.Store(version)
+	for ch := range w.subs {
+		// Replace any version the subscriber hasn't received yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- version.module.SymbolsByPkg
+	}
+}
+
+// Reload immediately rebuilds the package and swaps in the new module, regardless of whether any files have changed.
+// If goroutines are still executing the old module's code after WatcherConfig.UnloadTimeout, it's unloaded in the
+// background once they've left it (or left loaded if the Watcher is closed first).
+func (w *Watcher) Reload() error {
+	w.reloadMutex.Lock()
+	defer w.reloadMutex.Unlock()
+
+	if w.ctx.Err() != nil {
+		return fmt.Errorf("watcher for %s is closed", w.pkgDir)
+	}
+
+	oldVersion := w.current.Load().(*watchedVersion)
+	newVersion, err := w.buildAndLoad()
+	if err != nil {
+		return err
+	}
+
+	if w.config.Migrate != nil {
+		err = w.migrate(oldVersion.module, newVersion.module)
+		if err != nil {
+			unloadErr := newVersion.module.Unload()
+			if unloadErr != nil {
+				return fmt.Errorf("failed to migrate %s: %w (and failed to unload new module: %s)", newVersion.unit.ImportPath, err, unloadErr)
+			}
+			return fmt.Errorf("failed to migrate %s: %w", newVersion.unit.ImportPath, err)
+		}
+	}
+
+	w.publish(newVersion)
+
+	// State has already moved to the new module, so there's nothing to roll back to if the old one fails to unload
+	ctx, cancel := context.WithTimeout(w.ctx, w.config.UnloadTimeout)
+	err = oldVersion.module.UnloadWait(ctx)
+	cancel()
+	if errors.Is(err, context.DeadlineExceeded) && w.ctx.Err() == nil {
+		w.wg.Add(1)
+		go w.unloadWhenQuiescent(oldVersion)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reloaded %s but failed to unload old module: %w", newVersion.unit.ImportPath, err)
+	}
+	return nil
+}
+
+// unloadWhenQuiescent retries unloading an old module which was busy when it was replaced, until the Watcher is closed
+func (w *Watcher) unloadWhenQuiescent(version *watchedVersion) {
+	defer w.wg.Done()
+	err := version.module.UnloadWait(w.ctx)
+	if err != nil && w.ctx.Err() == nil {
+		w.reportError(fmt.Errorf("failed to unload old module of %s: %w", version.unit.ImportPath, err))
+	}
+}
+
+func (w *Watcher) reportError(err error) {
+	if w.config.OnError != nil {
+		w.config.OnError(err)
+	} else {
+		log.Printf("goloader/jit failed to reload %s: %s\n", w.pkgDir, err)
+	}
+}
+
+func (w *Watcher) migrate(oldModule, newModule *goloader.CodeModule) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic in migrate func: %v\n stack trace: %s", v, debug.Stack())
+		}
+	}()
+	return w.config.Migrate(oldModule, newModule)
+}
+
+func (w *Watcher) buildAndLoad() (*watchedVersion, error) {
+	unit, err := BuildGoPackageContext(w.ctx, w.config.BuildConfig, w.pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	module, err := unit.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &watchedVersion{module: module, unit: unit}, nil
+}
+
+// Close stops watching and waits for any in-progress reload to finish (cancelling its build).
+// The current module stays loaded, and may be unloaded by the caller once it is no longer in use, as do any old
+// modules which were still busy being unloaded in the background.
+func (w *Watcher) Close() error {
+	w.cancel()
+	w.wg.Wait()
+	w.subsMutex.Lock()
+	for ch := range w.subs {
+		delete(w.subs, ch)
+	}
+	w.subsMutex.Unlock()
+	return nil
+}
+
+func (w *Watcher) notifyChanged() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) run(ctx context.Context) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.changed:
+			debounce = time.After(w.config.Debounce)
+		case <-debounce:
+			debounce = nil
+			if w.config.BuildConfig.DebugLog {
+				log.Printf("Reloading %s after file changes\n", w.pkgDir)
+			}
+			err := w.Reload()
+			if err != nil && ctx.Err() == nil {
+				w.reportError(err)
+			}
+		}
+	}
+}
+
+// dirNotifier calls changed whenever a relevant file in its directory may have changed, until ctx is done
+type dirNotifier interface {
+	run(ctx context.Context, changed func())
+}
+
+func (w *Watcher) newNotifier() (dirNotifier, error) {
+	if !w.config.ForcePolling {
+		notifier, err := newPlatformNotifier(w.pkgDir)
+		if err == nil {
+			return notifier, nil
+		}
+		if w.config.BuildConfig.DebugLog {
+			log.Printf("Falling back to polling %s for changes: %s\n", w.pkgDir, err)
+		}
+	}
+	return newPollingNotifier(w.pkgDir, w.config.PollInterval)
+}
+
+// isWatchedFile filters out hidden files and editor swap/backup files
+func isWatchedFile(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "#") || strings.HasSuffix(name, "~") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".swp", ".swx", ".tmp":
+		return false
+	}
+	return true
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type pollingNotifier struct {
+	dir      string
+	interval time.Duration
+	state    map[string]fileState
+}
+
+func newPollingNotifier(dir string, interval time.Duration) (*pollingNotifier, error) {
+	state, err := snapshotDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &pollingNotifier{dir: dir, interval: interval, state: state}, nil
+}
+
+func snapshotDir(dir string) (map[string]fileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read watched dir %s: %w", dir, err)
+	}
+	state := make(map[string]fileState, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !isWatchedFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Deleted since ReadDir, the next poll will see it's gone
+			continue
+		}
+		state[entry.Name()] = fileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	return state, nil
+}
+
+func (p *pollingNotifier) run(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			state, err := snapshotDir(p.dir)
+			if err != nil {
+				continue
+			}
+			if !sameDirState(p.state, state) {
+				p.state = state
+				changed()
+			}
+		}
+	}
+}
+
+func sameDirState(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, stateA := range a {
+		stateB, ok := b[name]
+		if !ok || stateA.size != stateB.size || !stateA.modTime.Equal(stateB.modTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package jit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+type inotifyNotifier struct {
+	file *os.File
+}
+
+func newPlatformNotifier(dir string) (dirNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1 failed: %w", err)
+	}
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	_, err = syscall.InotifyAddWatch(fd, dir, mask)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("inotify_add_watch on %s failed: %w", dir, err)
+	}
+	// A non-blocking fd is registered with the runtime poller, so Close unblocks a pending Read
+	return &inotifyNotifier{file: os.NewFile(uintptr(fd), "inotify:"+dir)}, nil
+}
+
+func (n *inotifyNotifier) run(ctx context.Context, changed func()) {
+	go func() {
+		<-ctx.Done()
+		_ = n.file.Close()
+	}()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		relevant := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			if event.Mask&syscall.IN_ISDIR == 0 && (name == "" || isWatchedFile(name)) {
+				relevant = true
+			}
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+		if relevant {
+			changed()
+		}
+	}
+}
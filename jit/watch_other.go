@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package jit
+
+import (
+	"errors"
+)
+
+func newPlatformNotifier(dir string) (dirNotifier, error) {
+	return nil, errors.New("file notifications are not implemented on this platform")
+}
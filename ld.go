@@ -10,9 +10,12 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/eh-steve/goloader/obj"
@@ -46,6 +49,7 @@ type Linker struct {
 	noptrdata              []byte
 	bss                    []byte
 	noptrbss               []byte
+	covctrs                []byte
 	cuFiles                []obj.CompilationUnitFiles
 	symMap                 map[string]*obj.Sym
 	objsymbolMap           map[string]*obj.ObjSymbol
@@ -70,6 +74,8 @@ type Linker struct {
 	reachableSymbols       map[string]struct{}
 	pkgs                   []*obj.Pkg
 	pkgsByName             map[string]*obj.Pkg
+	expectedFuncSignatures map[string]FuncSignature
+	inlinedCallers         map[string][]string
 }
 
 type CodeModule struct {
@@ -84,6 +90,29 @@ type CodeModule struct {
 	patchedTypeMethodsMtyp map[*_type]map[int]typeOff
 	deduplicatedTypes      map[string]uintptr
 	heapStrings            map[string]*string
+	funcTypes              map[string]*_type
+	inlinedCallers         map[string][]string
+	debugELF               []byte
+	jitDebugEntry          *jitCodeEntry
+	perfMapLines           []string
+	label                  string
+	importPath             string
+	loadTime               time.Time
+	unloadTime             int64 // UnixNano, accessed atomically
+	goVersion              string
+	buildInfo              *debug.BuildInfo
+	packages               []PackageInfo
+	initTasks              []string
+	finalCoverage          *Coverage // Snapshot taken when the module was unloaded
+	finalCoverageErr       error
+	coverageReleased       bool
+	goroutines             int64
+	goroutinesStarted      int64
+	cpuSamples             int64
+	cpuTime                int64
+	handleLock             sync.Mutex
+	handles                int
+	unloaded               int32
 }
 
 var (
@@ -113,6 +142,7 @@ func initLinker(opts []LinkerOptFunc) (*Linker, error) {
 		pkgNamesToForceRebuild: make(map[string]struct{}),
 		reachableTypes:         make(map[string]struct{}),
 		reachableSymbols:       make(map[string]struct{}),
+		inlinedCallers:         make(map[string][]string),
 	}
 	if os.Getenv("GOLOADER_FORCE_TEST_RELOCATION_EPILOGUES") == "1" {
 		opts = append(opts, WithForceTestRelocationEpilogues())
@@ -233,7 +263,7 @@ func (linker *Linker) addSymbols(symbolNames []string, globalSymPtr map[string]u
 			}
 		}
 		switch objSym.Kind {
-		case symkind.SNOPTRDATA, symkind.SRODATA, symkind.SDATA, symkind.SBSS, symkind.SNOPTRBSS:
+		case symkind.SNOPTRDATA, symkind.SRODATA, symkind.SDATA, symkind.SBSS, symkind.SNOPTRBSS, symkind.SCOVERAGE_COUNTER, symkind.SCOVERAGE_AUXVAR:
 			_, err := linker.addSymbol(objSym.Name, globalSymPtr)
 			if err != nil {
 				return err
@@ -251,8 +281,10 @@ func (linker *Linker) addSymbols(symbolNames []string, globalSymPtr map[string]u
 			}
 		case symkind.SBSS:
 			offset += len(linker.data) + len(linker.noptrdata)
-		case symkind.SNOPTRBSS:
+		case symkind.SNOPTRBSS, symkind.SCOVERAGE_AUXVAR:
 			offset += len(linker.data) + len(linker.noptrdata) + len(linker.bss)
+		case symkind.SCOVERAGE_COUNTER:
+			offset += len(linker.data) + len(linker.noptrdata) + len(linker.bss) + len(linker.noptrbss)
 		}
 		sym.Offset += offset
 		if offset != 0 {
@@ -264,6 +296,8 @@ func (linker *Linker) addSymbols(symbolNames []string, globalSymPtr map[string]u
 			}
 		}
 	}
+	// The runtime expects all coverage counters to be contiguous, between moduledata.covctrs and moduledata.ecovctrs
+	linker.noptrbss = append(linker.noptrbss, linker.covctrs...)
 	linker.symNameOrder = symbolNames
 	return nil
 }
@@ -409,10 +443,15 @@ func (linker *Linker) addSymbol(name string, globalSymPtr map[string]uintptr) (s
 		symbol.Offset = len(linker.bss)
 		linker.bss = append(linker.bss, objsym.Data...)
 		bytearrayAlign(&linker.bss, PtrSize)
-	case symkind.SNOPTRBSS:
+	case symkind.SNOPTRBSS, symkind.SCOVERAGE_AUXVAR:
 		symbol.Offset = len(linker.noptrbss)
 		linker.noptrbss = append(linker.noptrbss, objsym.Data...)
 		bytearrayAlign(&linker.noptrbss, PtrSize)
+	case symkind.SCOVERAGE_COUNTER:
+		// Appended to the end of noptrbss once all symbols have been added
+		symbol.Offset = len(linker.covctrs)
+		linker.covctrs = append(linker.covctrs, objsym.Data...)
+		bytearrayAlign(&linker.covctrs, PtrSize)
 	case symkind.STLSBSS:
 		// Nothing to do, since runtime.tls_g should be resolved from the host binary
 	default:
@@ -845,6 +884,7 @@ func (linker *Linker) buildModule(codeModule *CodeModule, symbolMap map[string]u
 	module.noptrbss = module.ebss
 	module.enoptrbss = module.noptrbss + uintptr(segment.noptrbssLen)
 	module.end = module.enoptrbss
+	setCoverageCounters(module, module.enoptrbss-uintptr(len(linker.covctrs)), module.enoptrbss)
 	module.types = module.data
 	module.etypes = module.enoptrbss
 
@@ -1055,6 +1095,7 @@ func (linker *Linker) deduplicateTypeDescriptors(codeModule *CodeModule, symbolM
 
 func (linker *Linker) buildExports(codeModule *CodeModule, symbolMap map[string]uintptr) {
 	codeModule.SymbolsByPkg = map[string]map[string]interface{}{}
+	codeModule.funcTypes = map[string]*_type{}
 	for _, pkg := range linker.pkgs {
 		pkgSyms := map[string]interface{}{}
 		for name, info := range pkg.Exports {
@@ -1099,6 +1140,7 @@ func (linker *Linker) buildExports(codeModule *CodeModule, symbolMap map[string]
 			(*valp)[0] = unsafe.Pointer(t)
 
 			if t.Kind() == reflect.Func {
+				codeModule.funcTypes[info.SymName] = t
 				(*valp)[1] = unsafe.Pointer(&addr)
 			} else {
 				(*valp)[1] = unsafe.Pointer(addr)
@@ -1231,15 +1273,76 @@ func (linker *Linker) UnresolvedExternalSymbolUsers(symbolMap map[string]uintptr
 	return requiredBy
 }
 
+// SymbolRef is a reference from a symbol defined by the linked packages to a symbol they don't define
+type SymbolRef struct {
+	Sym     string // Name of the referenced symbol
+	Pkg     string // Package path of the referenced symbol
+	User    string // Name of the referencing symbol
+	UserPkg string // Package path of the referencing symbol
+	File    string // Source file of the referencing function, if known
+}
+
+// ExternalSymbolRefs returns every reachable reference to a symbol which the linked packages don't define themselves,
+// and which must therefore be resolved against the host's symbols (this is the set UnresolvedExternalSymbols
+// filters down to those missing from the host), excluding types and other linker-generated symbols
+func (linker *Linker) ExternalSymbolRefs() []SymbolRef {
+	var refs []SymbolRef
+	for userName, user := range linker.symMap {
+		if user.Offset == InvalidOffset || !linker.isSymbolReachable(userName) {
+			continue
+		}
+		var file string
+		if objSym, ok := linker.objsymbolMap[userName]; ok && objSym.Func != nil && len(objSym.Func.File) > 0 {
+			file = expandGoroot(strings.TrimPrefix(objSym.Func.File[0], FileSymPrefix))
+		}
+		seen := map[string]struct{}{}
+		for _, reloc := range user.Reloc {
+			if reloc.Sym == nil {
+				continue
+			}
+			name := reloc.Sym.Name
+			target, ok := linker.symMap[name]
+			if !ok || target.Offset != InvalidOffset {
+				continue
+			}
+			if strings.HasPrefix(name, TypePrefix) || strings.HasPrefix(name, ItabPrefix) || strings.HasPrefix(name, "go:") {
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			refs = append(refs, SymbolRef{Sym: strings.TrimSuffix(name, obj.ABI0Suffix), Pkg: target.Pkg, User: userName, UserPkg: user.Pkg, File: file})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Sym != refs[j].Sym {
+			return refs[i].Sym < refs[j].Sym
+		}
+		return refs[i].User < refs[j].User
+	})
+	return refs
+}
+
 func (linker *Linker) UnloadStrings() {
 	linker.heapStringMap = nil
 }
 
 func Load(linker *Linker, symPtr map[string]uintptr) (codeModule *CodeModule, err error) {
+	if err = linker.verifyFuncSignatures(symPtr); err != nil {
+		return nil, err
+	}
 	codeModule = &CodeModule{
-		Syms:   make(map[string]uintptr),
-		module: &moduledata{typemap: make(map[typeOff]*_type)},
+		Syms:           make(map[string]uintptr),
+		module:         &moduledata{typemap: make(map[typeOff]*_type)},
+		inlinedCallers: linker.inlinedCallers,
 	}
+	codeModule.initLabel(linker.MainPkgPath())
+	codeModule.importPath = linker.MainPkgPath()
+	codeModule.loadTime = time.Now()
+	codeModule.goVersion = linker.mainGoVersion()
+	codeModule.buildInfo = linker.options.BuildInfo
+	codeModule.packages = linker.packageInfo()
 	codeModule.codeLen = len(linker.code)
 	codeModule.dataLen = len(linker.data)
 	codeModule.noptrdataLen = len(linker.noptrdata)
@@ -1252,8 +1355,9 @@ func Load(linker *Linker, symPtr map[string]uintptr) (codeModule *CodeModule, er
 	if err != nil {
 		return nil, err
 	}
-	dataByte, err := MmapData(codeModule.maxDataLength)
+	dataByte, err := mmapData(codeModule.maxDataLength, linker.raceInstrumented())
 	if err != nil {
+		_ = Munmap(codeByte)
 		return nil, err
 	}
 
@@ -1279,9 +1383,15 @@ func Load(linker *Linker, symPtr map[string]uintptr) (codeModule *CodeModule, er
 			if err = linker.buildModule(codeModule, symbolMap); err == nil {
 				if err = linker.deduplicateTypeDescriptors(codeModule, symbolMap); err == nil {
 					linker.buildExports(codeModule, symbolMap)
-					MakeThreadJITCodeExecutable(uintptr(codeModule.codeBase), codeModule.maxCodeLength)
-					if err = linker.doInitialize(codeModule, symbolMap); err == nil {
-						return codeModule, err
+					if err = linker.registerDebugInfo(codeModule, symbolMap); err == nil {
+						if err = linker.registerPerfMap(codeModule, symbolMap); err == nil {
+							MakeThreadJITCodeExecutable(uintptr(codeModule.codeBase), codeModule.maxCodeLength)
+							if err = linker.doInitialize(codeModule, symbolMap); err == nil {
+								return codeModule, err
+							}
+							codeModule.unregisterPerfMap()
+						}
+						codeModule.unregisterDebugInfo()
 					}
 				}
 			}
@@ -1289,7 +1399,7 @@ func Load(linker *Linker, symPtr map[string]uintptr) (codeModule *CodeModule, er
 	}
 	if err != nil {
 		err2 := Munmap(codeByte)
-		err3 := Munmap(dataByte)
+		err3 := munmapData(dataByte)
 		if err2 != nil {
 			err = fmt.Errorf("failed to munmap (%s) after linker error: %w", err2, err)
 		}
@@ -1300,19 +1410,61 @@ func Load(linker *Linker, symPtr map[string]uintptr) (codeModule *CodeModule, er
 	return nil, err
 }
 
-func (cm *CodeModule) Unload() error {
-	err := cm.revertPatchedTypeMethods()
+// Unload unmaps the module's code and data. If any goroutines are executing the module's code (which would then
+// crash), it's left loaded and a *ModuleBusyError is returned, see also UnloadWait. Unloading a module which has
+// already been unloaded returns an error.
+// Modules shared via Handles are unloaded when their last Handle is released, and can't be unloaded directly until then.
+func (cm *CodeModule) Unload(opts ...UnloadOptFunc) error {
+	cm.handleLock.Lock()
+	defer cm.handleLock.Unlock()
+	if cm.handles > 0 {
+		return fmt.Errorf("module %s has %d unreleased Handle(s)", cm.label, cm.handles)
+	}
+	return cm.unload(opts)
+}
+
+// unload must be called with cm.handleLock held
+func (cm *CodeModule) unload(opts []UnloadOptFunc) error {
+	if atomic.LoadInt32(&cm.unloaded) != 0 {
+		return fmt.Errorf("module %s has already been unloaded", cm.label)
+	}
+	options := UnloadOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := cm.Busy(); err != nil {
+		return err
+	}
+	if options.FailOnReferences {
+		refs, err := cm.FindReferences(options.ReferenceScanOpts...)
+		if err != nil {
+			return fmt.Errorf("failed to find references to module: %w", err)
+		}
+		if len(refs) > 0 {
+			return &ModuleReferencedError{References: refs}
+		}
+	}
+	err := cm.forgetReplacements()
+	if err != nil {
+		return err
+	}
+	err = cm.revertPatchedTypeMethods()
 	if err != nil {
 		return err
 	}
+	cm.unregisterDebugInfo()
+	cm.unregisterPerfMap()
 	removeitabs(cm.module)
 	runtime.GC()
 	modulesLock.Lock()
 	removeModule(cm)
 	modulesLock.Unlock()
+	atomic.StoreInt32(&cm.unloaded, 1)
+	atomic.StoreInt64(&cm.unloadTime, time.Now().UnixNano())
 	modulesinit()
+	releaseCoverageMeta(cm)
 	err1 := Munmap(cm.codeByte)
-	err2 := Munmap(cm.dataByte)
+	err2 := munmapData(cm.dataByte)
 	if err1 != nil {
 		return err1
 	}
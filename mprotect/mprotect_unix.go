@@ -26,6 +26,10 @@ func MprotectMakeExecutable(page []byte) error {
 	return syscall.Mprotect(page, syscall.PROT_READ|syscall.PROT_EXEC)
 }
 
+func MprotectMakeWritableExecutable(page []byte) error {
+	return syscall.Mprotect(page, syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC)
+}
+
 func MprotectMakeReadOnly(page []byte) error {
 	return syscall.Mprotect(page, syscall.PROT_READ)
 }
@@ -26,6 +26,10 @@ func MprotectMakeExecutable(page []byte) error {
 	return VirtualProtect(uintptr(unsafe.Pointer(&page[0])), uintptr(len(page)), syscall.PAGE_EXECUTE_READ)
 }
 
+func MprotectMakeWritableExecutable(page []byte) error {
+	return VirtualProtect(uintptr(unsafe.Pointer(&page[0])), uintptr(len(page)), syscall.PAGE_EXECUTE_READWRITE)
+}
+
 func MprotectMakeReadOnly(page []byte) error {
 	return VirtualProtect(uintptr(unsafe.Pointer(&page[0])), uintptr(len(page)), syscall.PAGE_READONLY)
 }
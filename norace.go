@@ -0,0 +1,14 @@
+//go:build !race
+// +build !race
+
+package goloader
+
+const raceEnabled = false
+
+func mmapData(size int, instrumented bool) ([]byte, error) {
+	return MmapData(size)
+}
+
+func munmapData(segment []byte) error {
+	return Munmap(segment)
+}
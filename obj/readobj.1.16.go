@@ -60,6 +60,7 @@ func (pkg *Pkg) Symbols() error {
 				pkg.AutoLib = append(pkg.AutoLib, imported.Pkg)
 			}
 			pkg.Arch = e.Obj.Arch
+			pkg.TextHeader = string(e.Obj.TextHeader)
 			nsym := r.NSym() + r.NHashed64def() + r.NHasheddef() + r.NNonpkgdef()
 			for i := 0; i < nsym; i++ {
 				pkg.addSym(r, uint32(i), &refNames, objabi.PathToPrefix(pkg.PkgPath))
@@ -110,6 +111,15 @@ func (pkg *Pkg) Symbols() error {
 		if !strings.HasPrefix(sym.Name, TypeStringPrefix) {
 			sym.Name = strings.Replace(sym.Name, EmptyPkgPath, pkg.PkgPath, -1)
 		}
+		if !pkg.RaceEnabled && pkg.PkgPath != "runtime" {
+			for _, reloc := range sym.Reloc {
+				// Code compiled with -race calls runtime.racefuncenter, runtime.raceread etc.
+				if strings.HasPrefix(reloc.Sym.Name, "runtime.race") {
+					pkg.RaceEnabled = true
+					break
+				}
+			}
+		}
 	}
 	for i, symName := range pkg.SymNameOrder {
 		if !strings.HasPrefix(symName, TypeStringPrefix) {
@@ -371,9 +381,13 @@ func (pkg *Pkg) addSym(r *goobj.Reader, idx uint32, refNames *map[goobj.SymRef]s
 		case goobj.AuxFuncdata:
 			symbol.Func.FuncData = append(symbol.Func.FuncData, name)
 		case goobj.AuxDwarfInfo:
+			symbol.Func.DwarfInfo = name
 		case goobj.AuxDwarfLoc:
+			symbol.Func.DwarfLoc = name
 		case goobj.AuxDwarfRanges:
+			symbol.Func.DwarfRanges = name
 		case goobj.AuxDwarfLines:
+			symbol.Func.DwarfLines = name
 		case goobj.AuxPcsp:
 			symbol.Func.PCSP = r.Data(index)
 		case goobj.AuxPcfile:
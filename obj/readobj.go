@@ -26,6 +26,8 @@ type Pkg struct {
 	SymNamesByIdx  map[uint32]string
 	AutoLib        []string
 	Exports        map[string]ExportSymType
+	TextHeader     string // Header of the archive's Go object, e.g. "go object linux amd64 go1.21.0 GOAMD64=v1 X:..."
+	RaceEnabled    bool   // Whether the archive was built with -race (it calls the race detector's runtime hooks)
 }
 
 type FuncInfo struct {
@@ -44,6 +46,11 @@ type FuncInfo struct {
 	InlTree   []InlTreeNode
 	ABI       uint16
 	CUOffset  int
+	// Names of the symbols holding the function's DWARF info entry, location lists, range lists and line program
+	DwarfInfo   string
+	DwarfLoc    string
+	DwarfRanges string
+	DwarfLines  string
 }
 
 type ObjSymbol struct {
@@ -93,3 +100,68 @@ type Reloc struct {
 	EpilogueOffset int // This is added to store the offset of the extra instructions added by goloader in the case of certain overflowing relocations, e.g. ADRP, PCREL, CALLARM64
 	EpilogueSize   int
 }
+
+// Clone returns a deep copy of a parsed package, so that a cached parse of an archive can be handed to
+// a new Linker (which mutates symbols, relocs and pcdata in place) without affecting the cached original.
+func (pkg *Pkg) Clone(objIdx uint32) *Pkg {
+	clone := &Pkg{
+		Syms:           make(map[string]*ObjSymbol, len(pkg.Syms)),
+		CUFiles:        make([]CompilationUnitFiles, len(pkg.CUFiles)),
+		Arch:           pkg.Arch,
+		PkgPath:        pkg.PkgPath,
+		SymNameOrder:   append([]string(nil), pkg.SymNameOrder...),
+		Objidx:         objIdx,
+		ReferencedPkgs: append([]string(nil), pkg.ReferencedPkgs...),
+		SymNamesByIdx:  make(map[uint32]string, len(pkg.SymNamesByIdx)),
+		AutoLib:        append([]string(nil), pkg.AutoLib...),
+		Exports:        make(map[string]ExportSymType, len(pkg.Exports)),
+		TextHeader:     pkg.TextHeader,
+		RaceEnabled:    pkg.RaceEnabled,
+	}
+	for i, cuFiles := range pkg.CUFiles {
+		clone.CUFiles[i] = CompilationUnitFiles{
+			ArchiveName: cuFiles.ArchiveName,
+			Files:       append([]string(nil), cuFiles.Files...),
+		}
+	}
+	for idx, name := range pkg.SymNamesByIdx {
+		clone.SymNamesByIdx[idx] = name
+	}
+	for name, export := range pkg.Exports {
+		clone.Exports[name] = export
+	}
+	for name, sym := range pkg.Syms {
+		clone.Syms[name] = sym.clone(objIdx)
+	}
+	return clone
+}
+
+func (sym *ObjSymbol) clone(objIdx uint32) *ObjSymbol {
+	clone := *sym
+	clone.Objidx = objIdx
+	clone.Data = append([]byte(nil), sym.Data...)
+	clone.Reloc = make([]Reloc, len(sym.Reloc))
+	for i, reloc := range sym.Reloc {
+		clone.Reloc[i] = reloc
+		if reloc.Sym != nil {
+			relocSym := *reloc.Sym
+			clone.Reloc[i].Sym = &relocSym
+		}
+	}
+	if sym.Func != nil {
+		fn := *sym.Func
+		fn.PCSP = append([]byte(nil), sym.Func.PCSP...)
+		fn.PCFile = append([]byte(nil), sym.Func.PCFile...)
+		fn.PCLine = append([]byte(nil), sym.Func.PCLine...)
+		fn.PCInline = append([]byte(nil), sym.Func.PCInline...)
+		fn.PCData = make([][]byte, len(sym.Func.PCData))
+		for i, pcdata := range sym.Func.PCData {
+			fn.PCData[i] = append([]byte(nil), pcdata...)
+		}
+		fn.File = append([]string(nil), sym.Func.File...)
+		fn.FuncData = append([]string(nil), sym.Func.FuncData...)
+		fn.InlTree = append([]InlTreeNode(nil), sym.Func.InlTree...)
+		clone.Func = &fn
+	}
+	return &clone
+}
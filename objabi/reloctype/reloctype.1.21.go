@@ -58,6 +58,10 @@ const (
 	// symbol's DWARF compile unit.
 	R_ADDRCUOFF = (int)(objabi.R_ADDRCUOFF)
 
+	// R_DWARFSECREF resolves to the offset of the symbol from its section.
+	// Target of relocation must be size 4 (in current implementation).
+	R_DWARFSECREF = (int)(objabi.R_DWARFSECREF)
+
 	// R_KEEP tells the linker to keep the referred-to symbol in the final binary
 	// if the symbol containing the R_KEEP relocation is in the final binary.
 	R_KEEP = (int)(objabi.R_KEEP)
@@ -0,0 +1,13 @@
+//go:build go1.20 && !go1.23
+// +build go1.20,!go1.23
+
+package symkind
+
+import "cmd/objfile/objabi"
+
+// copy from $GOROOT/src/cmd/internal/objabi/symkind.go
+const (
+	// Coverage instrumentation counter, aux variable for cmd/cover
+	SCOVERAGE_COUNTER = int(objabi.SCOVERAGE_COUNTER)
+	SCOVERAGE_AUXVAR  = int(objabi.SCOVERAGE_AUXVAR)
+)
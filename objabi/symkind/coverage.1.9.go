@@ -0,0 +1,10 @@
+//go:build go1.9 && !go1.20
+// +build go1.9,!go1.20
+
+package symkind
+
+// Coverage symbol kinds don't exist before go1.20, so use values which never match a real kind
+const (
+	SCOVERAGE_COUNTER = -1
+	SCOVERAGE_AUXVAR  = -2
+)
@@ -0,0 +1,144 @@
+package goloader
+
+import (
+	"fmt"
+	"github.com/eh-steve/goloader/obj"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// ArchiveMismatchError is returned by ReadObjs when an archive was built with settings the running host binary wasn't,
+// which would otherwise cause obscure failures during relocation or crashes at runtime
+type ArchiveMismatchError struct {
+	File    string
+	PkgPath string
+	Setting string // e.g. "GOARCH", "Go version", "GOAMD64", "GOEXPERIMENT" or "-race"
+	Archive string
+	Host    string
+}
+
+func (e *ArchiveMismatchError) Error() string {
+	return fmt.Sprintf("archive %s (package %s) was built with %s %q, but the host binary was built with %s %q", e.File, e.PkgPath, e.Setting, e.Archive, e.Setting, e.Host)
+}
+
+var hostBuildSettings struct {
+	once     sync.Once
+	settings map[string]string
+}
+
+// HostBuildSettings returns the build settings recorded in the running binary (see debug.BuildInfo.Settings),
+// e.g. "-race", "-tags", "CGO_ENABLED", "GOEXPERIMENT" and "GOAMD64"
+func HostBuildSettings() map[string]string {
+	hostBuildSettings.once.Do(func() {
+		hostBuildSettings.settings = map[string]string{}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				hostBuildSettings.settings[setting.Key] = setting.Value
+			}
+		}
+	})
+	return hostBuildSettings.settings
+}
+
+type objHeader struct {
+	goos        string
+	goarch      string
+	version     string
+	archLevel   [2]string // e.g. GOAMD64, v3
+	experiments map[string]struct{}
+}
+
+// parseObjHeader parses a header of the form "go object <GOOS> <GOARCH> <version> [<GOxxx>=<level>] X:<experiments>"
+func parseObjHeader(header string) (objHeader, bool) {
+	fields := strings.Fields(header)
+	if len(fields) < 5 || fields[0] != "go" || fields[1] != "object" {
+		return objHeader{}, false
+	}
+	h := objHeader{goos: fields[2], goarch: fields[3], experiments: map[string]struct{}{}}
+	var versionParts []string
+	for _, field := range fields[4:] {
+		switch {
+		case strings.HasPrefix(field, "X:"):
+			for _, experiment := range strings.Split(strings.TrimPrefix(field, "X:"), ",") {
+				if experiment != "" {
+					h.experiments[experiment] = struct{}{}
+				}
+			}
+		case strings.HasPrefix(field, "GO") && strings.Contains(field, "="):
+			kv := strings.SplitN(field, "=", 2)
+			h.archLevel = [2]string{kv[0], kv[1]}
+		default:
+			versionParts = append(versionParts, field)
+		}
+	}
+	h.version = strings.Join(versionParts, " ")
+	return h, true
+}
+
+func hostGoVersion() string {
+	version := runtime.Version()
+	// Non-default experiments are appended to the version, e.g. "go1.21.0 X:loopvar"
+	if i := strings.Index(version, " X:"); i != -1 {
+		version = version[:i]
+	}
+	return version
+}
+
+// raceInstrumented returns whether any of the linked packages were built with -race
+func (linker *Linker) raceInstrumented() bool {
+	for _, pkg := range linker.pkgs {
+		if pkg.RaceEnabled {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArchiveHeader compares the settings recorded in an archive (read from file, if known) against the running binary's
+func checkArchiveHeader(pkg *obj.Pkg, file string) error {
+	mismatch := func(setting, archive, host string) error {
+		return &ArchiveMismatchError{File: file, PkgPath: pkg.PkgPath, Setting: setting, Archive: archive, Host: host}
+	}
+	// Race instrumented code can't run against a runtime without the race detector (the reverse is fine)
+	if pkg.RaceEnabled && !raceEnabled {
+		return mismatch("-race", "true", "false")
+	}
+
+	h, ok := parseObjHeader(pkg.TextHeader)
+	if !ok {
+		// Archives which only contain native objects have no Go object header
+		return nil
+	}
+	if h.goos != runtime.GOOS {
+		return mismatch("GOOS", h.goos, runtime.GOOS)
+	}
+	if h.goarch != runtime.GOARCH {
+		return mismatch("GOARCH", h.goarch, runtime.GOARCH)
+	}
+	if hostVersion := hostGoVersion(); !strings.HasPrefix(h.version, "devel") && !strings.HasPrefix(hostVersion, "devel") && h.version != hostVersion {
+		return mismatch("Go version", h.version, hostVersion)
+	}
+	settings := HostBuildSettings()
+	if h.archLevel[0] != "" {
+		if hostLevel, ok := settings[h.archLevel[0]]; ok && hostLevel != h.archLevel[1] {
+			return mismatch(h.archLevel[0], h.archLevel[1], hostLevel)
+		}
+	}
+	// Only non-default experiments are recorded in the host's build info, so check those are consistently
+	// enabled (or disabled with a "no" prefix) in the archive
+	if hostExperiments := settings["GOEXPERIMENT"]; hostExperiments != "" {
+		archiveExperiments := make([]string, 0, len(h.experiments))
+		for experiment := range h.experiments {
+			archiveExperiments = append(archiveExperiments, experiment)
+		}
+		for _, experiment := range strings.Split(hostExperiments, ",") {
+			_, enabled := h.experiments[strings.TrimPrefix(experiment, "no")]
+			if wantEnabled := !strings.HasPrefix(experiment, "no"); experiment != "" && enabled != wantEnabled {
+				return mismatch("GOEXPERIMENT", strings.Join(archiveExperiments, ","), hostExperiments)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+//go:build go1.18
+// +build go1.18
+
+package goloader
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/eh-steve/goloader/obj"
+)
+
+// OverrideHostFunction redirects all calls to the host function hostSymName (whose address is in symPtr, as populated
+// by RegSymbol) to newSymName in newImpl, by patching the host function's entry with a jump.
+// newSymName must be exported (so that its type is known), and its signature must match the host function's, which is
+// read from the host's DWARF info, so the host must be built with DWARF. Methods are overridden by functions which
+// take the receiver as their first parameter.
+// The override is refused if the host function was inlined anywhere in the host (or into any loaded module), since
+// those copies would not be redirected, if it's implemented in assembly, if it's too short to hold the jump, or if any
+// goroutine's stack has a frame which would resume within the instructions overwritten by the jump.
+// The host function is restored by Revert, or when newImpl is unloaded.
+func OverrideHostFunction(symPtr map[string]uintptr, hostSymName string, newImpl *CodeModule, newSymName string) (*FunctionReplacement, error) {
+	if newImpl.module == nil || atomic.LoadInt32(&newImpl.unloaded) != 0 {
+		return nil, fmt.Errorf("could not override %s: module %s is not loaded", hostSymName, newImpl.label)
+	}
+	entry, ok := symPtr[hostSymName]
+	if !ok {
+		return nil, fmt.Errorf("could not override %s: no such host function", hostSymName)
+	}
+	if _, isAsm := symPtr[hostSymName+obj.ABI0Suffix]; isAsm {
+		return nil, fmt.Errorf("could not override %s: it is implemented in assembly", hostSymName)
+	}
+	newEntry, ok := newImpl.Syms[newSymName]
+	if !ok {
+		return nil, fmt.Errorf("could not override %s: no such function %s in module %s", hostSymName, newSymName, newImpl.label)
+	}
+	newType := newImpl.funcTypes[newSymName]
+	if newType == nil {
+		return nil, fmt.Errorf("could not override %s with %s: only exported functions have known types", hostSymName, newSymName)
+	}
+
+	hostSigs, err := HostFuncSignatures()
+	if err != nil {
+		return nil, fmt.Errorf("could not override %s: %w", hostSymName, err)
+	}
+	hostSig, ok := hostSigs[hostSymName]
+	if !ok {
+		return nil, fmt.Errorf("could not override %s: the host has no DWARF info for it", hostSymName)
+	}
+	if newSig := funcSignature(newType); !newSig.matches(hostSig) {
+		return nil, fmt.Errorf("could not override %s with %s: host function is %s but replacement is %s", hostSymName, newSymName, hostSig, newSig)
+	}
+	inlined, err := hostInlinedFuncs()
+	if err != nil {
+		return nil, fmt.Errorf("could not override %s: %w", hostSymName, err)
+	}
+	if _, ok := inlined[hostSymName]; ok {
+		return nil, fmt.Errorf("could not override %s: it has been inlined in the host", hostSymName)
+	}
+	if callers := moduleInlinedCallers(hostSymName); len(callers) > 0 {
+		return nil, fmt.Errorf("could not override %s: it has been inlined into %s", hostSymName, strings.Join(callers, ", "))
+	}
+
+	jump, err := jumpCode(newEntry)
+	if err != nil {
+		return nil, fmt.Errorf("could not override %s: %w", hostSymName, err)
+	}
+	if size := funcSize(&firstmoduledata, entry); size < len(jump) {
+		return nil, fmt.Errorf("could not override %s: function is %d bytes, too short for a %d byte jump", hostSymName, size, len(jump))
+	}
+
+	replacementsLock.Lock()
+	defer replacementsLock.Unlock()
+	for r := range replacements {
+		if r.entry == entry {
+			return nil, fmt.Errorf("could not override %s: it is already overridden by %s, which must be reverted first", hostSymName, r.newSymName)
+		}
+	}
+	original, goroutines, err := patchText(entry, jump)
+	if err != nil {
+		return nil, fmt.Errorf("could not override %s: %w", hostSymName, err)
+	}
+	if len(goroutines) > 0 {
+		return nil, fmt.Errorf("could not override %s: goroutine(s) %v would resume within its first %d bytes", hostSymName, goroutines, len(jump))
+	}
+	r := &FunctionReplacement{newImpl: newImpl, symName: hostSymName, newSymName: newSymName, entry: entry, original: original}
+	replacements[r] = struct{}{}
+	return r, nil
+}
+
+// funcSignature returns the signature of a func type, spelled the way the linker spells type names
+func funcSignature(t *_type) FuncSignature {
+	typ := AsRType(t)
+	var sig FuncSignature
+	for i := 0; i < typ.NumIn(); i++ {
+		sig.Params = append(sig.Params, resolveFullyQualifiedSymbolName(fromRType(typ.In(i))))
+	}
+	for i := 0; i < typ.NumOut(); i++ {
+		sig.Results = append(sig.Results, resolveFullyQualifiedSymbolName(fromRType(typ.Out(i))))
+	}
+	return sig
+}
+
+// moduleInlinedCallers returns the functions of all loaded modules into which symName has been inlined
+func moduleInlinedCallers(symName string) []string {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	var callers []string
+	for m := range modules {
+		callers = append(callers, m.inlinedCallers[symName]...)
+	}
+	sort.Strings(callers)
+	return callers
+}
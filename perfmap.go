@@ -0,0 +1,247 @@
+//go:build go1.18 && linux
+// +build go1.18,linux
+
+package goloader
+
+import (
+	"bytes"
+	"cmd/objfile/sys"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	_ "unsafe"
+)
+
+// The jitdump format read by 'perf inject --jit', see $LINUX/tools/perf/Documentation/jitdump-specification.txt
+const (
+	jitDumpMagic      = 0x4A695444
+	jitDumpVersion    = 1
+	jitDumpHeaderSize = 40
+	jitCodeLoad       = 0
+	jitCodeDebugInfo  = 2
+)
+
+var (
+	perfLock         sync.Mutex
+	jitDumpFile      *os.File
+	jitDumpMarker    []byte
+	jitDumpCodeIndex uint64
+)
+
+// nanotime reads CLOCK_MONOTONIC, which perf uses for jitdump timestamps when recording with -k mono
+//
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+func perfMapPath() string {
+	return fmt.Sprintf("/tmp/perf-%d.map", os.Getpid())
+}
+
+// registerPerfMap writes the module's functions to the perf map and/or jitdump, if enabled
+func (linker *Linker) registerPerfMap(codeModule *CodeModule, symbolMap map[string]uintptr) error {
+	if !linker.options.PerfMap && !linker.options.PerfJITDump {
+		return nil
+	}
+	funcs := linker.textFuncs(symbolMap)
+	perfLock.Lock()
+	defer perfLock.Unlock()
+	if linker.options.PerfJITDump {
+		if err := linker.writeJITDump(codeModule, funcs); err != nil {
+			return fmt.Errorf("failed to write jitdump: %w", err)
+		}
+	}
+	if linker.options.PerfMap {
+		var buf bytes.Buffer
+		lines := make([]string, 0, len(funcs))
+		for _, f := range funcs {
+			line := fmt.Sprintf("%x %x %s", f.addr, f.size, f.name)
+			lines = append(lines, line)
+			buf.WriteString(line + "\n")
+		}
+		file, err := os.OpenFile(perfMapPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open perf map: %w", err)
+		}
+		_, err = file.Write(buf.Bytes())
+		if err2 := file.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write perf map: %w", err)
+		}
+		codeModule.perfMapLines = lines
+	}
+	return nil
+}
+
+// unregisterPerfMap removes the module's entries from the perf map, since its addresses may be reused by modules
+// loaded later. This is best effort - the module is unloaded regardless.
+func (cm *CodeModule) unregisterPerfMap() {
+	if len(cm.perfMapLines) == 0 {
+		return
+	}
+	perfLock.Lock()
+	defer perfLock.Unlock()
+	remove := make(map[string]int, len(cm.perfMapLines))
+	for _, line := range cm.perfMapLines {
+		remove[line]++
+	}
+	cm.perfMapLines = nil
+	data, err := os.ReadFile(perfMapPath())
+	if err != nil {
+		return
+	}
+	var kept bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if n := remove[strings.TrimSuffix(line, "\n")]; n > 0 {
+			remove[strings.TrimSuffix(line, "\n")] = n - 1
+			continue
+		}
+		kept.WriteString(line)
+	}
+	_ = os.WriteFile(perfMapPath(), kept.Bytes(), 0644)
+}
+
+// openJITDump creates the process's jitdump (in the directory requested by the first module to enable it) and maps
+// it executable, which is how 'perf record' notices it
+func openJITDump(dir string, machine elf.Machine, byteOrder binary.ByteOrder) (*os.File, error) {
+	if jitDumpFile != nil {
+		return jitDumpFile, nil
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	file, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("jit-%d.dump", os.Getpid())), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, jitDumpHeaderSize)
+	byteOrder.PutUint32(header[0:], jitDumpMagic)
+	byteOrder.PutUint32(header[4:], jitDumpVersion)
+	byteOrder.PutUint32(header[8:], jitDumpHeaderSize)
+	byteOrder.PutUint32(header[12:], uint32(machine))
+	byteOrder.PutUint32(header[20:], uint32(os.Getpid()))
+	byteOrder.PutUint64(header[24:], uint64(nanotime()))
+	if _, err = file.Write(header); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	marker, err := syscall.Mmap(int(file.Fd()), 0, PageSize, syscall.PROT_READ|syscall.PROT_EXEC, syscall.MAP_PRIVATE)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to mmap jitdump: %w", err)
+	}
+	jitDumpFile, jitDumpMarker = file, marker
+	return file, nil
+}
+
+// writeJITDump writes a debug info record followed by a code load record for each function, must be called with
+// perfLock held
+func (linker *Linker) writeJITDump(codeModule *CodeModule, funcs []debugFunc) error {
+	var machine elf.Machine
+	switch linker.Arch.Family {
+	case sys.AMD64:
+		machine = elf.EM_X86_64
+	case sys.ARM64:
+		machine = elf.EM_AARCH64
+	default:
+		return fmt.Errorf("jitdump is not supported on %s", linker.Arch.Name)
+	}
+	byteOrder := linker.Arch.ByteOrder
+	file, err := openJITDump(linker.options.PerfJITDumpDir, machine, byteOrder)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	var scratch [8]byte
+	appendUint32 := func(b []byte, v uint32) []byte {
+		byteOrder.PutUint32(scratch[:], v)
+		return append(b, scratch[:4]...)
+	}
+	appendUint64 := func(b []byte, v uint64) []byte {
+		byteOrder.PutUint64(scratch[:], v)
+		return append(b, scratch[:]...)
+	}
+	record := func(id uint32) func() {
+		start := len(buf)
+		buf = appendUint32(buf, id)
+		buf = appendUint32(buf, 0) // total_size
+		buf = appendUint64(buf, uint64(nanotime()))
+		return func() {
+			byteOrder.PutUint32(buf[start+4:], uint32(len(buf)-start))
+		}
+	}
+	for _, f := range funcs {
+		if lines := linker.pcLines(f); len(lines) > 0 {
+			end := record(jitCodeDebugInfo)
+			buf = appendUint64(buf, uint64(f.addr))
+			buf = appendUint64(buf, uint64(len(lines)))
+			for _, line := range lines {
+				buf = appendUint64(buf, uint64(f.addr+line.pc))
+				buf = appendUint32(buf, uint32(line.line))
+				buf = appendUint32(buf, 0) // discriminator
+				buf = append(append(buf, line.file...), 0)
+			}
+			end()
+		}
+
+		end := record(jitCodeLoad)
+		buf = appendUint32(buf, uint32(os.Getpid()))
+		buf = appendUint32(buf, uint32(syscall.Gettid()))
+		buf = appendUint64(buf, uint64(f.addr))
+		buf = appendUint64(buf, uint64(f.addr))
+		buf = appendUint64(buf, uint64(f.size))
+		buf = appendUint64(buf, jitDumpCodeIndex)
+		jitDumpCodeIndex++
+		buf = append(append(buf, f.name...), 0)
+		offset := int(f.addr) - codeModule.codeBase
+		buf = append(buf, codeModule.codeByte[offset:offset+f.size]...)
+		end()
+	}
+	_, err = file.Write(buf)
+	return err
+}
+
+type pcLine struct {
+	pc   uintptr // Offset from the function's entry
+	file string
+	line int32
+}
+
+// pcLines returns the source position at each offset in the function where it changes, from its pcfile and pcline
+// tables
+func (linker *Linker) pcLines(f debugFunc) []pcLine {
+	filePCs, fileVals := readPCData(f.sym.Func.PCFile, 0)
+	linePCs, lineVals := readPCData(f.sym.Func.PCLine, 0)
+	files := linker.cuFiles[f.cu].Files
+	var lines []pcLine
+	var pc uintptr
+	for i, j := 0, 0; i < len(filePCs) && j < len(linePCs); {
+		var file string
+		if fileVals[i] >= 0 && int(fileVals[i]) < len(files) {
+			file = expandGoroot(strings.TrimPrefix(files[fileVals[i]], FileSymPrefix))
+		}
+		if n := len(lines); n == 0 || lines[n-1].file != file || lines[n-1].line != lineVals[j] {
+			lines = append(lines, pcLine{pc: pc, file: file, line: lineVals[j]})
+		}
+		// Move on to the next range of whichever table changes first
+		switch {
+		case filePCs[i] < linePCs[j]:
+			pc = filePCs[i]
+			i++
+		case linePCs[j] < filePCs[i]:
+			pc = linePCs[j]
+			j++
+		default:
+			pc = filePCs[i]
+			i++
+			j++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,17 @@
+//go:build go1.18 && !linux
+// +build go1.18,!linux
+
+package goloader
+
+import (
+	"errors"
+)
+
+func (linker *Linker) registerPerfMap(codeModule *CodeModule, symbolMap map[string]uintptr) error {
+	if linker.options.PerfMap || linker.options.PerfJITDump {
+		return errors.New("perf map and jitdump output are only supported on linux")
+	}
+	return nil
+}
+
+func (cm *CodeModule) unregisterPerfMap() {}
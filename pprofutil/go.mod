@@ -0,0 +1,10 @@
+module github.com/eh-steve/goloader/pprofutil
+
+go 1.18
+
+require (
+	github.com/eh-steve/goloader v0.0.0-20240111193324-64f971021f52
+	github.com/google/pprof v0.0.0-20221118152302-e6195bd50e26
+)
+
+//replace github.com/eh-steve/goloader => ../
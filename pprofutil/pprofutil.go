@@ -0,0 +1,246 @@
+// Package pprofutil attributes the samples of pprof profiles to the goloader modules whose code they were taken in,
+// so that the profile of a host running several modules can be filtered, split or aggregated per module.
+package pprofutil
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/eh-steve/goloader"
+	"github.com/google/pprof/profile"
+)
+
+// LabelKey is the sample label set by Tag, which is the same as the pprof label of goroutines started by a module
+const LabelKey = goloader.ModuleLabelKey
+
+// Module describes where a module's code was, so that samples can still be attributed to it after it's unloaded
+type Module struct {
+	Label      string // See goloader.CodeModule.Label
+	ImportPath string
+	LoadTime   time.Time
+	UnloadTime time.Time // Zero if the module was still loaded when described
+	TextStart  uint64
+	TextEnd    uint64
+	Functions  []string // Names of the module's functions, to attribute locations without addresses
+}
+
+// Describe captures the text range and function table of a module. Modules must be described before they're unloaded
+// for samples to be attributed to them by function name (their addresses are enough otherwise).
+func Describe(cm *goloader.CodeModule) Module {
+	start, end := cm.TextAddr()
+	_, label := cm.Label()
+	m := Module{
+		Label:      label,
+		ImportPath: cm.ImportPath(),
+		LoadTime:   cm.LoadTime(),
+		UnloadTime: cm.UnloadTime(),
+		TextStart:  uint64(start),
+		TextEnd:    uint64(end),
+	}
+	for _, f := range cm.Functions() {
+		m.Functions = append(m.Functions, f.Name)
+	}
+	return m
+}
+
+// Loaded describes all currently loaded modules
+func Loaded() []Module {
+	loaded := goloader.LoadedModules()
+	modules := make([]Module, 0, len(loaded))
+	for _, cm := range loaded {
+		modules = append(modules, Describe(cm))
+	}
+	return modules
+}
+
+// Parse decodes a (possibly gzipped) pprof profile
+func Parse(data []byte) (*profile.Profile, error) {
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profile: %w", err)
+	}
+	return p, nil
+}
+
+// attributor finds the module owning a profile's locations
+type attributor struct {
+	modules     []Module // Sorted by TextStart
+	byFunction  map[string][]int
+	start, end  int64 // The profile's time window, in UnixNano
+	locationMod map[uint64]int
+}
+
+func newAttributor(p *profile.Profile, modules []Module) *attributor {
+	a := &attributor{
+		modules:     append([]Module(nil), modules...),
+		byFunction:  make(map[string][]int),
+		start:       p.TimeNanos,
+		end:         p.TimeNanos + p.DurationNanos,
+		locationMod: make(map[uint64]int),
+	}
+	sort.SliceStable(a.modules, func(i, j int) bool { return a.modules[i].TextStart < a.modules[j].TextStart })
+	for i, m := range a.modules {
+		for _, f := range m.Functions {
+			a.byFunction[f] = append(a.byFunction[f], i)
+		}
+	}
+	return a
+}
+
+// choose picks between modules which could own a location, since a module's addresses (and function names) may have
+// been reused by a module loaded after it was unloaded. Modules which were loaded while the profile was being taken
+// are preferred, then the most recently loaded.
+func (a *attributor) choose(candidates []int) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	best := candidates[0]
+	for _, i := range candidates[1:] {
+		if a.live(i) != a.live(best) {
+			if a.live(i) {
+				best = i
+			}
+		} else if a.modules[i].LoadTime.After(a.modules[best].LoadTime) {
+			best = i
+		}
+	}
+	return best
+}
+
+// live returns whether the module was loaded at any time during the profile
+func (a *attributor) live(i int) bool {
+	if a.start == 0 {
+		return a.modules[i].UnloadTime.IsZero()
+	}
+	m := a.modules[i]
+	return m.LoadTime.UnixNano() <= a.end && (m.UnloadTime.IsZero() || m.UnloadTime.UnixNano() >= a.start)
+}
+
+// location returns the index of the module owning loc, or -1 if it's host code
+func (a *attributor) location(loc *profile.Location) int {
+	if i, ok := a.locationMod[loc.ID]; ok {
+		return i
+	}
+	var candidates []int
+	if loc.Address != 0 {
+		for i, m := range a.modules {
+			if m.TextStart > loc.Address {
+				break
+			}
+			if loc.Address < m.TextEnd {
+				candidates = append(candidates, i)
+			}
+		}
+	} else {
+		for _, line := range loc.Line {
+			if line.Function != nil {
+				candidates = append(candidates, a.byFunction[line.Function.Name]...)
+			}
+		}
+	}
+	i := a.choose(candidates)
+	a.locationMod[loc.ID] = i
+	return i
+}
+
+// sample returns the label of the module owning a sample - that of the innermost frame in a module's code, so that
+// time spent in host functions called by a module is attributed to it - or else its existing LabelKey label, which
+// goroutines started by modules carry
+func (a *attributor) sample(s *profile.Sample) string {
+	for _, loc := range s.Location {
+		if i := a.location(loc); i >= 0 {
+			return a.modules[i].Label
+		}
+	}
+	return sampleLabel(s)
+}
+
+// Tag sets the LabelKey label of each of the profile's samples taken in a module's code to the module's label.
+// Profiles tagged this way can be filtered with e.g. 'go tool pprof -tagfocus goloader.module=<label>'.
+func Tag(p *profile.Profile, modules []Module) {
+	a := newAttributor(p, modules)
+	for _, s := range p.Sample {
+		if label := a.sample(s); label != "" {
+			if s.Label == nil {
+				s.Label = make(map[string][]string)
+			}
+			s.Label[LabelKey] = []string{label}
+		}
+	}
+}
+
+// Filter returns a copy of the profile holding only the samples attributed to the module with the given label, or
+// to the host if label is empty
+func Filter(p *profile.Profile, modules []Module, label string) *profile.Profile {
+	tagged := p.Copy()
+	Tag(tagged, modules)
+	return only(tagged, label)
+}
+
+// Split tags a copy of the profile, and splits it into a profile per module label, with the samples attributed to
+// the host under the empty label. Module labels are absent if they have no samples.
+func Split(p *profile.Profile, modules []Module) map[string]*profile.Profile {
+	tagged := p.Copy()
+	Tag(tagged, modules)
+	split := make(map[string]*profile.Profile)
+	for _, s := range tagged.Sample {
+		label := sampleLabel(s)
+		if _, ok := split[label]; ok {
+			continue
+		}
+		split[label] = only(tagged.Copy(), label)
+	}
+	return split
+}
+
+// only removes the samples of a tagged profile not attributed to label
+func only(p *profile.Profile, label string) *profile.Profile {
+	samples := p.Sample[:0]
+	for _, s := range p.Sample {
+		if sampleLabel(s) == label {
+			samples = append(samples, s)
+		}
+	}
+	p.Sample = samples
+	return p.Compact()
+}
+
+func sampleLabel(s *profile.Sample) string {
+	if labels := s.Label[LabelKey]; len(labels) > 0 {
+		return labels[0]
+	}
+	return ""
+}
+
+// Total is the sum of each of a profile's sample values attributed to a module (or the host, with an empty Label)
+type Total struct {
+	Label  string
+	Values []int64 // Indexed like the profile's SampleType
+}
+
+// Aggregate totals the profile's sample values per module, ordered by label with the host first
+func Aggregate(p *profile.Profile, modules []Module) []Total {
+	a := newAttributor(p, modules)
+	totals := make(map[string][]int64)
+	for _, s := range p.Sample {
+		label := a.sample(s)
+		values := totals[label]
+		if values == nil {
+			values = make([]int64, len(p.SampleType))
+			totals[label] = values
+		}
+		for i, v := range s.Value {
+			if i < len(values) {
+				values[i] += v
+			}
+		}
+	}
+	result := make([]Total, 0, len(totals))
+	for label, values := range totals {
+		result = append(result, Total{Label: label, Values: values})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Label < result[j].Label })
+	return result
+}
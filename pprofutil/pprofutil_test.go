@@ -0,0 +1,85 @@
+package pprofutil_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/eh-steve/goloader/pprofutil"
+	"github.com/google/pprof/profile"
+)
+
+func TestSplit(t *testing.T) {
+	loadTime := time.Unix(1000, 0)
+	modules := []pprofutil.Module{
+		// An unloaded module whose text was reused by "current"
+		{Label: "old", LoadTime: loadTime, UnloadTime: loadTime.Add(time.Second), TextStart: 0x1000, TextEnd: 0x2000, Functions: []string{"old.Run"}},
+		{Label: "current", LoadTime: loadTime.Add(2 * time.Second), TextStart: 0x1000, TextEnd: 0x1800, Functions: []string{"current.Run"}},
+		{Label: "other", LoadTime: loadTime, TextStart: 0x3000, TextEnd: 0x4000, Functions: []string{"other.Run"}},
+	}
+	host := &profile.Function{ID: 1, Name: "runtime.mallocgc"}
+	oldRun := &profile.Function{ID: 2, Name: "old.Run"}
+	locations := []*profile.Location{
+		{ID: 1, Address: 0x500, Line: []profile.Line{{Function: host}}},
+		{ID: 2, Address: 0x1100},
+		{ID: 3, Address: 0x3100},
+		{ID: 4, Line: []profile.Line{{Function: oldRun}}},
+	}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		TimeNanos:  loadTime.Add(3 * time.Second).UnixNano(),
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{locations[0]}, Value: []int64{1}},
+			{Location: []*profile.Location{locations[0], locations[1]}, Value: []int64{2}},
+			{Location: []*profile.Location{locations[2], locations[1]}, Value: []int64{4}},
+			{Location: []*profile.Location{locations[3]}, Value: []int64{8}},
+			{Location: []*profile.Location{locations[0]}, Value: []int64{16}, Label: map[string][]string{pprofutil.LabelKey: {"other"}}},
+		},
+		Location: locations,
+		Function: []*profile.Function{host, oldRun},
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p, err := pprofutil.Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totals := map[string]int64{}
+	for _, total := range pprofutil.Aggregate(p, modules) {
+		totals[total.Label] = total.Values[0]
+	}
+	expected := map[string]int64{"": 1, "current": 2, "other": 20, "old": 8}
+	for label, value := range expected {
+		if totals[label] != value {
+			t.Errorf("expected %s total %d, got %d", label, value, totals[label])
+		}
+	}
+
+	split := pprofutil.Split(p, modules)
+	if len(split) != len(expected) {
+		t.Errorf("expected %d profiles, got %d", len(expected), len(split))
+	}
+	for label, part := range split {
+		var sum int64
+		for _, s := range part.Sample {
+			sum += s.Value[0]
+		}
+		if sum != expected[label] {
+			t.Errorf("expected %s profile to total %d, got %d", label, expected[label], sum)
+		}
+	}
+	if len(split["old"].Location) != 1 {
+		t.Errorf("expected old profile to be compacted to 1 location, got %d", len(split["old"].Location))
+	}
+
+	filtered := pprofutil.Filter(p, modules, "other")
+	if len(filtered.Sample) != 2 {
+		t.Errorf("expected 2 samples in other, got %d", len(filtered.Sample))
+	}
+	if len(p.Sample[0].Label) != 0 {
+		t.Errorf("expected original profile to be left untagged")
+	}
+}
@@ -0,0 +1,101 @@
+//go:build race
+// +build race
+
+package goloader
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+const raceEnabled = true
+
+//go:linkname racefree runtime.racefree
+func racefree(p unsafe.Pointer, sz uintptr)
+
+// raceDataArenaSize is how much data race instrumented modules loaded at the same time can have in total
+const raceDataArenaSize = 64 << 20
+
+// raceDataArena holds the data segments of race instrumented modules. Instrumented accesses are only passed to the
+// race detector within the Go heap or the host's own data and bss (outside of which they're silently ignored), and
+// raceinit maps shadow memory for the whole of the latter, which this (otherwise untouched, so never paged in)
+// array is part of. Unlike the heap, it's also within reach of PC relative relocations from modules' code, which is
+// mapped near the host's. Moving the race detector's bounds to cover segments mapped elsewhere would instead make
+// every address in between look valid, although nothing there has shadow memory.
+var raceDataArena [raceDataArenaSize + PageSize]byte
+
+var raceDataArenaAlloc struct {
+	sync.Mutex
+	init bool
+	free [][2]int // Sorted, non adjacent [start, end) ranges of offsets into raceDataArena
+}
+
+// mmapData maps a module's data segment, from raceDataArena if it's race instrumented
+func mmapData(size int, instrumented bool) ([]byte, error) {
+	if !instrumented {
+		// Accesses from the host's instrumented code are ignored outside the heap and host data, so no shadow is needed
+		return MmapData(size)
+	}
+	a := &raceDataArenaAlloc
+	a.Lock()
+	defer a.Unlock()
+	if !a.init {
+		// Segments must be page aligned
+		base := int(uintptr(unsafe.Pointer(&raceDataArena[0])))
+		start := alignof(base, PageSize) - base
+		a.free = [][2]int{{start, start + raceDataArenaSize}}
+		a.init = true
+	}
+	for i, r := range a.free {
+		if r[1]-r[0] < size {
+			continue
+		}
+		if r[1]-r[0] == size {
+			a.free = append(a.free[:i], a.free[i+1:]...)
+		} else {
+			a.free[i][0] += size
+		}
+		segment := raceDataArena[r[0] : r[0]+size : r[0]+size]
+		for j := range segment {
+			segment[j] = 0
+		}
+		return segment, nil
+	}
+	return nil, fmt.Errorf("no room for %d bytes of race instrumented data, modules already loaded use most of the %d reserved", size, raceDataArenaSize)
+}
+
+// munmapData unmaps a data segment mapped by mmapData, first resetting the race detector's state for it if it's in
+// raceDataArena, so that accesses by modules later given the same memory aren't reported as racing with the old one's
+func munmapData(segment []byte) error {
+	if len(segment) == 0 {
+		return nil
+	}
+	addr, arenaAddr := uintptr(unsafe.Pointer(&segment[0])), uintptr(unsafe.Pointer(&raceDataArena[0]))
+	if addr < arenaAddr || addr >= arenaAddr+uintptr(len(raceDataArena)) {
+		return Munmap(segment)
+	}
+	racefree(unsafe.Pointer(&segment[0]), uintptr(len(segment)))
+	start := int(addr - arenaAddr)
+
+	a := &raceDataArenaAlloc
+	a.Lock()
+	defer a.Unlock()
+	end := start + len(segment)
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i][0] >= end })
+	switch {
+	case i > 0 && a.free[i-1][1] == start && i < len(a.free) && a.free[i][0] == end:
+		a.free[i-1][1] = a.free[i][1]
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	case i > 0 && a.free[i-1][1] == start:
+		a.free[i-1][1] = end
+	case i < len(a.free) && a.free[i][0] == end:
+		a.free[i][0] = start
+	default:
+		a.free = append(a.free, [2]int{})
+		copy(a.free[i+1:], a.free[i:])
+		a.free[i] = [2]int{start, end}
+	}
+	return nil
+}
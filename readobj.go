@@ -11,6 +11,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"runtime/debug"
 	"strings"
 	"unsafe"
 )
@@ -32,13 +33,21 @@ func Parse(f *os.File, pkgpath *string) ([]string, error) {
 	return symbols, nil
 }
 
-func readObj(pkg *obj.Pkg, linker *Linker) error {
+func parseObj(pkg *obj.Pkg) error {
 	if pkg.PkgPath == EmptyString {
 		pkg.PkgPath = DefaultPkgPath
 	}
 	if err := pkg.Symbols(); err != nil {
 		return fmt.Errorf("read error: %v", err)
 	}
+	var file string
+	if pkg.F != nil {
+		file = pkg.F.Name()
+	}
+	return checkArchiveHeader(pkg, file)
+}
+
+func (linker *Linker) addPkg(pkg *obj.Pkg) error {
 	if linker.Arch != nil && linker.Arch.Name != pkg.Arch {
 		return fmt.Errorf("read obj error: Arch %s != Arch %s", linker.Arch.Name, pkg.Arch)
 	} else {
@@ -68,6 +77,9 @@ func readObj(pkg *obj.Pkg, linker *Linker) error {
 			for index, FuncData := range sym.Func.FuncData {
 				sym.Func.FuncData[index] = strings.Replace(FuncData, EmptyPkgPath, pkg.PkgPath, -1)
 			}
+			for _, dwarfSym := range []*string{&sym.Func.DwarfInfo, &sym.Func.DwarfLoc, &sym.Func.DwarfRanges, &sym.Func.DwarfLines} {
+				*dwarfSym = strings.Replace(*dwarfSym, EmptyPkgPath, pkg.PkgPath, -1)
+			}
 			sym.Func.CUOffset += cuOffset
 		}
 	}
@@ -89,6 +101,20 @@ type LinkerOptions struct {
 	NoRelocationEpilogues            bool
 	SkipTypeDeduplicationForPackages []string
 	ForceTestRelocationEpilogues     bool
+	PkgCache                         PkgCache
+	DebugInfo                        bool
+	PerfMap                          bool
+	PerfJITDump                      bool
+	PerfJITDumpDir                   string
+	BuildInfo                        *debug.BuildInfo
+	AllowNoHostDWARF                 bool
+}
+
+// PkgCache stores parsed archives so that linking the same (immutable) archive file again can skip parsing it.
+// Implementations must treat stored packages as read only - ReadObjs only ever hands clones to the linker.
+type PkgCache interface {
+	LoadPkg(file, pkgPath string) (*obj.Pkg, bool)
+	StorePkg(file, pkgPath string, pkg *obj.Pkg)
 }
 
 // WithSymbolNameOrder allows you to control the sequence (placement in memory) of symbols from an object file.
@@ -135,6 +161,39 @@ func WithForceTestRelocationEpilogues() func(*LinkerOptions) {
 	}
 }
 
+func WithPkgCache(cache PkgCache) func(*LinkerOptions) {
+	return func(options *LinkerOptions) {
+		options.PkgCache = cache
+	}
+}
+
+// WithDebugInfo makes Load relocate the DWARF emitted by the compiler to the module's addresses, and register it with
+// debuggers (such as gdb) through the GDB JIT interface until the module is unloaded, see CodeModule.DebugELF.
+// Debugging is easier if the code is built without optimisations or inlining (-gcflags='-N -l').
+func WithDebugInfo() func(*LinkerOptions) {
+	return func(options *LinkerOptions) {
+		options.DebugInfo = true
+	}
+}
+
+// WithPerfMap makes Load append each of the module's functions to /tmp/perf-<pid>.map, so that Linux perf can
+// symbolize samples in the module's code. The module's entries are removed when it's unloaded.
+func WithPerfMap() func(*LinkerOptions) {
+	return func(options *LinkerOptions) {
+		options.PerfMap = true
+	}
+}
+
+// WithPerfJITDump makes Load write a code load record (with line info from the module's pcln tables) for each of the
+// module's functions to jit-<pid>.dump in dir (or os.TempDir() if empty), for use with 'perf record -k mono' and
+// 'perf inject --jit'. Records are timestamped, so samples taken before a module was unloaded stay symbolized.
+func WithPerfJITDump(dir string) func(*LinkerOptions) {
+	return func(options *LinkerOptions) {
+		options.PerfJITDump = true
+		options.PerfJITDumpDir = dir
+	}
+}
+
 func resolveSymRefName(symRef goobj.SymRef, pkgs []*obj.Pkg, objByPkg map[string]uint32, objIdx uint32) (symName, pkgName string) {
 	pkg := pkgs[objIdx-1]
 	pkgName = pkg.ReferencedPkgs[symRef.PkgIdx]
@@ -159,7 +218,25 @@ func ReadObjs(files []string, pkgPath []string, globalSymPtr map[string]uintptr,
 	var symNames []string
 	objByPkg := map[string]uint32{}
 	var pkgs = make([]*obj.Pkg, 0, len(files))
+	cache := linker.options.PkgCache
 	for i, file := range files {
+		objIdx := uint32(i + 1)
+		if cache != nil {
+			if cached, ok := cache.LoadPkg(file, pkgPath[i]); ok {
+				pkg := cached.Clone(objIdx)
+				// The cache may have been populated by a differently built host, so check it like a freshly parsed archive
+				if err := checkArchiveHeader(pkg, file); err != nil {
+					return nil, err
+				}
+				objByPkg[pkgPath[i]] = pkg.Objidx
+				if err := linker.addPkg(pkg); err != nil {
+					return nil, err
+				}
+				pkgs = append(pkgs, pkg)
+				symNames = append(symNames, pkg.SymNameOrder...)
+				continue
+			}
+		}
 		f, err := os.Open(file)
 		if err != nil {
 			return nil, err
@@ -169,12 +246,19 @@ func ReadObjs(files []string, pkgPath []string, globalSymPtr map[string]uintptr,
 			Syms:          make(map[string]*obj.ObjSymbol, 0),
 			F:             f,
 			PkgPath:       pkgPath[i],
-			Objidx:        uint32(i + 1),
+			Objidx:        objIdx,
 			SymNamesByIdx: make(map[uint32]string),
 			Exports:       make(map[string]obj.ExportSymType),
 		}
 		objByPkg[pkgPath[i]] = pkg.Objidx
-		if err := readObj(&pkg, linker); err != nil {
+		if err := parseObj(&pkg); err != nil {
+			return nil, err
+		}
+		if cache != nil {
+			// Store a pristine copy, since the linker mutates symbols as it adds them
+			cache.StorePkg(file, pkgPath[i], pkg.Clone(objIdx))
+		}
+		if err := linker.addPkg(&pkg); err != nil {
 			return nil, err
 		}
 		pkgs = append(pkgs, &pkg)
@@ -0,0 +1,335 @@
+package goloader
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Reference is a pointer into a module's code or data from outside the module, which will dangle once it's unloaded
+type Reference struct {
+	Root       string   // What holds the pointer: a global as symbol+offset, a goroutine's stack frame, a finalizer, or a heap object
+	Addr       uintptr  // Address of the pointer, if known
+	Target     uintptr  // Address in the module it points to
+	TargetName string   // The module's function, type, itab or func value at Target
+	Path       []string // For heap objects, what keeps the object reachable, from the root down to the object's parent
+}
+
+func (r Reference) String() string {
+	var via string
+	if len(r.Path) > 0 {
+		via = fmt.Sprintf(" (reachable via %s)", strings.Join(r.Path, " -> "))
+	}
+	return fmt.Sprintf("%s references %s (0x%x)%s", r.Root, r.TargetName, r.Target, via)
+}
+
+// ErrModuleReferenced is matched (with errors.Is) by the *ModuleReferencedError returned by CodeModule.Unload with
+// WithFailOnReferences if anything outside the module references it
+var ErrModuleReferenced = errors.New("module is referenced")
+
+// ModuleReferencedError lists the references which would dangle if a module were unloaded
+type ModuleReferencedError struct {
+	References []Reference
+}
+
+func (e *ModuleReferencedError) Error() string {
+	lines := make([]string, 0, len(e.References))
+	for _, r := range e.References {
+		lines = append(lines, r.String())
+	}
+	return fmt.Sprintf("module is referenced by %d pointer(s):\n%s", len(e.References), strings.Join(lines, "\n"))
+}
+
+func (e *ModuleReferencedError) Is(target error) bool {
+	return target == ErrModuleReferenced
+}
+
+type ReferenceScanOptFunc func(options *ReferenceScanOptions)
+
+type ReferenceScanOptions struct {
+	HostSymbols map[string]uintptr
+	ScanHeap    bool
+}
+
+// WithHostSymbols names references from the host's globals by symbol, using a symbol map as populated by RegSymbol.
+// Otherwise they're named by their offset within the host's data or bss segment.
+func WithHostSymbols(symPtr map[string]uintptr) func(*ReferenceScanOptions) {
+	return func(options *ReferenceScanOptions) {
+		options.HostSymbols = symPtr
+	}
+}
+
+// WithHeapScan also scans the reachable heap (and goroutine stacks and finalizers), using a heap dump written by
+// debug.WriteHeapDump to a temporary file. This stops the world for as long as it takes to write the dump, so is
+// expensive for large heaps. Heap objects are reported by address and size, since the heap doesn't record their types,
+// along with the path by which they're reachable.
+func WithHeapScan() func(*ReferenceScanOptions) {
+	return func(options *ReferenceScanOptions) {
+		options.ScanHeap = true
+	}
+}
+
+type UnloadOptFunc func(options *UnloadOptions)
+
+type UnloadOptions struct {
+	FailOnReferences  bool
+	ReferenceScanOpts []ReferenceScanOptFunc
+}
+
+// WithFailOnReferences makes Unload return a *ModuleReferencedError instead of unloading the module if FindReferences
+// (with scanOpts) finds any references to it
+func WithFailOnReferences(scanOpts ...ReferenceScanOptFunc) func(*UnloadOptions) {
+	return func(options *UnloadOptions) {
+		options.FailOnReferences = true
+		options.ReferenceScanOpts = scanOpts
+	}
+}
+
+//go:linkname itabTableInit runtime.itabTableInit
+var itabTableInit [512]uintptr
+
+// FindReferences scans the globals of the host and all other loaded modules (using their GC pointer bitmaps) and,
+// with WithHeapScan, the reachable heap, for pointers into the module's code and data, such as function values,
+// interfaces holding the module's types, itabs and pointers to its globals.
+// The module's own bookkeeping (the CodeModule, and the runtime's record of the module until it's unloaded) is ignored.
+// Function values from SymbolsByPkg are heap allocated, so references to them are only found by the heap scan.
+func (cm *CodeModule) FindReferences(opts ...ReferenceScanOptFunc) ([]Reference, error) {
+	options := ReferenceScanOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if cm.module == nil {
+		return nil, nil
+	}
+
+	globals := cm.globalPointers(options.HostSymbols)
+	var refs []Reference
+	for _, ptr := range globals {
+		if cm.containsAddr(ptr.value) {
+			refs = append(refs, cm.newReference(ptr.root, ptr.addr, ptr.value, nil))
+		}
+	}
+	if options.ScanHeap {
+		heapRefs, err := cm.heapReferences(globals)
+		if err != nil {
+			return refs, err
+		}
+		refs = append(refs, heapRefs...)
+	}
+	return refs, nil
+}
+
+func (cm *CodeModule) containsAddr(addr uintptr) bool {
+	return (addr >= uintptr(cm.codeBase) && addr < uintptr(cm.codeBase+cm.maxCodeLength)) ||
+		(addr >= uintptr(cm.dataBase) && addr < uintptr(cm.dataBase+cm.maxDataLength))
+}
+
+func (cm *CodeModule) newReference(root string, addr, target uintptr, path []string) Reference {
+	return Reference{Root: root, Addr: addr, Target: target, TargetName: cm.describeAddr(target), Path: path}
+}
+
+// describeAddr names the function, type, itab or func value at addr in the module
+func (cm *CodeModule) describeAddr(addr uintptr) string {
+	if addr >= uintptr(cm.codeBase) && addr < uintptr(cm.codeBase+cm.maxCodeLength) {
+		if f := runtime.FuncForPC(addr); f != nil {
+			if addr == f.Entry() {
+				return f.Name()
+			}
+			return fmt.Sprintf("%s+0x%x", f.Name(), addr-f.Entry())
+		}
+		return fmt.Sprintf("text+0x%x", addr-uintptr(cm.codeBase))
+	}
+	module := cm.module
+	if addr >= module.types && addr < module.etypes {
+		if t, ok := module.typemap[typeOff(addr-module.types)]; ok {
+			return "type:" + _name(t.nameOff(t.str))
+		}
+	}
+	for _, tab := range module.itablinks {
+		if uintptr(unsafe.Pointer(tab)) == addr {
+			return "itab for " + _name(tab._type.nameOff(tab._type.str))
+		}
+	}
+	for name, symAddr := range cm.Syms {
+		if symAddr == addr && strings.HasSuffix(name, "·f") {
+			return name
+		}
+	}
+	return fmt.Sprintf("data+0x%x", addr-uintptr(cm.dataBase))
+}
+
+// globalPointers returns the pointers held by the globals of the host and all other modules.
+// modulesLock is held throughout, since modules are removed under it before their segments are unmapped.
+func (cm *CodeModule) globalPointers(hostSymbols map[string]uintptr) []rootPointer {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	moduleLabels := make(map[*moduledata]string, len(modules))
+	for m := range modules {
+		moduleLabels[m.module] = "module " + m.label
+	}
+
+	itabTableStart := uintptr(unsafe.Pointer(&itabTableInit))
+	itabTableEnd := itabTableStart + unsafe.Sizeof(itabTableInit)
+	var ptrs []rootPointer
+	for _, md := range activeModules() {
+		if md == cm.module {
+			continue
+		}
+		var namer *symbolNamer
+		owner, ok := moduleLabels[md]
+		if md == &firstmoduledata {
+			namer = newSymbolNamer(hostSymbols, md.data, md.ebss)
+			owner = "host"
+		} else if !ok {
+			// Already removed by a concurrent Unload, so its segments may be unmapped at any moment
+			continue
+		}
+		for _, segment := range []struct {
+			name       string
+			start, end uintptr
+			mask       bitvector
+		}{{"data", md.data, md.edata, md.gcdatamask}, {"bss", md.bss, md.ebss, md.gcbssmask}} {
+			for i := int32(0); i < segment.mask.n; i++ {
+				if *(*uint8)(adduintptr(uintptr(unsafe.Pointer(segment.mask.bytedata)), int(i/8)))>>(i%8)&1 == 0 {
+					continue
+				}
+				addr := segment.start + uintptr(i)*PtrSize
+				if addr >= segment.end {
+					break
+				}
+				// The runtime's initial itab table holds the module's itabs until it's unloaded
+				if addr >= itabTableStart && addr < itabTableEnd {
+					continue
+				}
+				value := *(*uintptr)(unsafe.Pointer(addr))
+				if value == 0 {
+					continue
+				}
+				root := fmt.Sprintf("%s %s+0x%x", owner, segment.name, addr-segment.start)
+				if name := namer.name(addr); name != "" {
+					root = name
+				}
+				ptrs = append(ptrs, rootPointer{root: root, addr: addr, value: value})
+			}
+		}
+	}
+	return ptrs
+}
+
+// heapReferences finds the heap objects reachable from the roots (other than through the module's own bookkeeping)
+// which point into the module, along with any goroutine stack frames, finalizers etc. which do
+func (cm *CodeModule) heapReferences(globals []rootPointer) ([]Reference, error) {
+	dump, err := writeHeapDump(func(addr uintptr) bool {
+		return addr >= uintptr(cm.codeBase) && addr < uintptr(cm.codeBase+cm.codeLen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var refs []Reference
+	for _, root := range dump.roots {
+		if cm.containsAddr(root.value) {
+			refs = append(refs, cm.newReference(root.root, root.addr, root.value, nil))
+		}
+	}
+
+	type link struct {
+		visited bool
+		parent  int    // Index of the object referencing this one, or -1 if referenced by root
+		root    string // Description of the referencing root or pointer within parent
+	}
+	links := make([]link, len(dump.objects))
+	for _, ignore := range []unsafe.Pointer{unsafe.Pointer(cm), unsafe.Pointer(cm.module)} {
+		if i := dump.findObject(uintptr(ignore)); i >= 0 {
+			links[i].visited = true
+		}
+	}
+	var queue []int
+	for _, roots := range [][]rootPointer{globals, dump.roots} {
+		for _, root := range roots {
+			if i := dump.findObject(root.value); i >= 0 && !links[i].visited {
+				links[i] = link{visited: true, parent: -1, root: root.root}
+				queue = append(queue, i)
+			}
+		}
+	}
+	describe := func(i int) string {
+		return fmt.Sprintf("heap object 0x%x (%d bytes)", dump.objects[i].addr, dump.objects[i].size)
+	}
+	path := func(i int) []string {
+		var path []string
+		for j := i; j >= 0; j = links[j].parent {
+			path = append(path, links[j].root)
+		}
+		for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+			path[l], path[r] = path[r], path[l]
+		}
+		return path
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		obj := dump.objects[i]
+		for _, ptr := range obj.ptrs {
+			if cm.containsAddr(ptr.value) {
+				refs = append(refs, cm.newReference(fmt.Sprintf("%s+0x%x", describe(i), ptr.offset), obj.addr+ptr.offset, ptr.value, path(i)))
+				continue
+			}
+			if j := dump.findObject(ptr.value); j >= 0 && !links[j].visited {
+				links[j] = link{visited: true, parent: i, root: fmt.Sprintf("%s+0x%x", describe(i), ptr.offset)}
+				queue = append(queue, j)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// symbolNamer names addresses within a range by the nearest preceding symbol
+type symbolNamer struct {
+	addrs []uintptr
+	names []string
+}
+
+func newSymbolNamer(symPtr map[string]uintptr, start, end uintptr) *symbolNamer {
+	if len(symPtr) == 0 {
+		return nil
+	}
+	type sym struct {
+		name string
+		addr uintptr
+	}
+	var syms []sym
+	for name, addr := range symPtr {
+		if addr >= start && addr < end {
+			syms = append(syms, sym{name, addr})
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].addr != syms[j].addr {
+			return syms[i].addr < syms[j].addr
+		}
+		return syms[i].name < syms[j].name
+	})
+	namer := &symbolNamer{}
+	for _, s := range syms {
+		namer.addrs = append(namer.addrs, s.addr)
+		namer.names = append(namer.names, s.name)
+	}
+	return namer
+}
+
+func (n *symbolNamer) name(addr uintptr) string {
+	if n == nil {
+		return ""
+	}
+	i := sort.Search(len(n.addrs), func(i int) bool { return n.addrs[i] > addr }) - 1
+	if i < 0 {
+		return ""
+	}
+	if addr == n.addrs[i] {
+		return n.names[i]
+	}
+	return fmt.Sprintf("%s+0x%x", n.names[i], addr-n.addrs[i])
+}
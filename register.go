@@ -154,6 +154,7 @@ func regSymbol(symPtr map[string]uintptr, pkgSet map[string]struct{}, path strin
 			symPtr[pkg+_InitTaskSuffix] = 0
 		}
 	}
+	regCoverageSymbols(symPtr)
 
 	tlsG, x86Found := symPtr["runtime.tlsg"]
 	tls_G, arm64Found := symPtr["runtime.tls_g"]
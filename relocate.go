@@ -370,6 +370,12 @@ func (linker *Linker) relocate(codeModule *CodeModule, symbolMap map[string]uint
 					}
 				}
 			}
+			if callType := loc.Type &^ reloctype.R_WEAK; loc.Sym.Name == newprocSymName && (callType == reloctype.R_CALL || callType == reloctype.R_CALLARM64) {
+				// Start goroutines via moduleNewproc, so they're labelled with the module and counted in its Stats
+				if trampoline := newprocTrampoline(); trampoline != 0 {
+					addr = trampoline
+				}
+			}
 			sym := loc.Sym
 			relocByte := segment.dataByte
 			addrBase := segment.dataBase
@@ -0,0 +1,205 @@
+//go:build go1.18
+// +build go1.18
+
+package goloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/eh-steve/goloader/mprotect"
+)
+
+// FunctionReplacement is a function whose entry point has been patched with a jump to another module's function,
+// see ReplaceFunction and OverrideHostFunction
+type FunctionReplacement struct {
+	cm, newImpl         *CodeModule // cm is nil for host functions
+	symName, newSymName string
+	entry               uintptr
+	original            []byte
+}
+
+var (
+	replacements     = make(map[*FunctionReplacement]struct{})
+	replacementsLock sync.Mutex
+)
+
+// ReplaceFunction redirects all calls to the function symName in cm (including through func values, interfaces and
+// from other modules) to newSymName in newImpl, by patching the old function's entry with a jump.
+// Both functions must be exported (so that their types are known) and have identical types.
+// The replacement is refused if symName has been inlined into any of cm's functions (since those copies would not be
+// redirected), if it's too short to hold the jump, or if any goroutine's stack has a frame which would resume within
+// the instructions overwritten by the jump. Frames already executing the old function past its entry carry on
+// running the old code.
+// newImpl can't be unloaded until the replacement is reverted (or cm is unloaded).
+func ReplaceFunction(cm *CodeModule, symName string, newImpl *CodeModule, newSymName string) (*FunctionReplacement, error) {
+	for _, m := range []*CodeModule{cm, newImpl} {
+		if m.module == nil || atomic.LoadInt32(&m.unloaded) != 0 {
+			return nil, fmt.Errorf("could not replace %s: module %s is not loaded", symName, m.label)
+		}
+	}
+	entry, ok := cm.Syms[symName]
+	if !ok {
+		return nil, fmt.Errorf("could not replace %s: no such function in module %s", symName, cm.label)
+	}
+	newEntry, ok := newImpl.Syms[newSymName]
+	if !ok {
+		return nil, fmt.Errorf("could not replace %s: no such function %s in module %s", symName, newSymName, newImpl.label)
+	}
+	if callers := cm.inlinedCallers[symName]; len(callers) > 0 {
+		return nil, fmt.Errorf("could not replace %s: it has been inlined into %s", symName, strings.Join(callers, ", "))
+	}
+	oldType, newType := cm.funcTypes[symName], newImpl.funcTypes[newSymName]
+	if oldType == nil || newType == nil {
+		return nil, fmt.Errorf("could not replace %s with %s: only exported functions have known types", symName, newSymName)
+	}
+	if err := TypeMismatch(AsRType(oldType), AsRType(newType)); err != nil {
+		return nil, fmt.Errorf("could not replace %s with %s: %w", symName, newSymName, err)
+	}
+	jump, err := jumpCode(newEntry)
+	if err != nil {
+		return nil, fmt.Errorf("could not replace %s: %w", symName, err)
+	}
+	if size := funcSize(cm.module, entry); size < len(jump) {
+		return nil, fmt.Errorf("could not replace %s: function is %d bytes, too short for a %d byte jump", symName, size, len(jump))
+	}
+
+	replacementsLock.Lock()
+	defer replacementsLock.Unlock()
+	for r := range replacements {
+		if r.entry == entry {
+			return nil, fmt.Errorf("could not replace %s: it is already replaced by %s, which must be reverted first", symName, r.newSymName)
+		}
+	}
+	original, goroutines, err := patchText(entry, jump)
+	if err != nil {
+		return nil, fmt.Errorf("could not replace %s: %w", symName, err)
+	}
+	if len(goroutines) > 0 {
+		return nil, fmt.Errorf("could not replace %s: goroutine(s) %v would resume within its first %d bytes", symName, goroutines, len(jump))
+	}
+	r := &FunctionReplacement{cm: cm, newImpl: newImpl, symName: symName, newSymName: newSymName, entry: entry, original: original}
+	replacements[r] = struct{}{}
+	return r, nil
+}
+
+// Revert restores the original function's entry, so that calls are no longer redirected.
+// It does nothing if the replacement has already been reverted, or its module unloaded.
+func (r *FunctionReplacement) Revert() error {
+	replacementsLock.Lock()
+	defer replacementsLock.Unlock()
+	if _, ok := replacements[r]; !ok {
+		return nil
+	}
+	return r.revert()
+}
+
+// revert must be called with replacementsLock held
+func (r *FunctionReplacement) revert() error {
+	_, goroutines, err := patchText(r.entry, r.original)
+	if err != nil {
+		return fmt.Errorf("could not revert replacement of %s: %w", r.symName, err)
+	}
+	if len(goroutines) > 0 {
+		return fmt.Errorf("could not revert replacement of %s: goroutine(s) %v would resume within its first %d bytes", r.symName, goroutines, len(r.original))
+	}
+	delete(replacements, r)
+	return nil
+}
+
+// forgetReplacements drops the replacements of the module's functions and reverts its overrides of host functions
+// before it's unloaded, and fails if any of its functions are still in use as replacements in other modules
+func (cm *CodeModule) forgetReplacements() error {
+	replacementsLock.Lock()
+	defer replacementsLock.Unlock()
+	var replaced []string
+	for r := range replacements {
+		if r.newImpl == cm && r.cm != nil && r.cm != cm {
+			replaced = append(replaced, r.symName)
+		}
+	}
+	if len(replaced) > 0 {
+		sort.Strings(replaced)
+		return fmt.Errorf("module %s replaces function(s) %s, which must be reverted first", cm.label, strings.Join(replaced, ", "))
+	}
+	for r := range replacements {
+		switch {
+		case r.cm == cm:
+			delete(replacements, r)
+		case r.newImpl == cm && r.cm == nil:
+			// Host functions are restored, since they'll outlive the module
+			if err := r.revert(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jumpCode returns the instructions for an absolute jump to target, which only clobber registers which are dead at a
+// function's entry
+func jumpCode(target uintptr) ([]byte, error) {
+	var code []byte
+	switch runtime.GOARCH {
+	case "amd64":
+		code = append(code, x86amd64JMPLcode...)
+	case "arm64":
+		code = append(code, arm64CALLCode...)
+	default:
+		return nil, fmt.Errorf("patching functions is not supported on %s", runtime.GOARCH)
+	}
+	addr := make([]byte, 8)
+	binary.LittleEndian.PutUint64(addr, uint64(target))
+	return append(code, addr...), nil
+}
+
+// funcSize returns the size of the function at entry in md's text (up to the next function), or 0 if there's no
+// function at entry
+func funcSize(md *moduledata, entry uintptr) int {
+	off := entry - md.text
+	i := sort.Search(len(md.ftab), func(i int) bool { return uintptr(md.ftab[i].entry) > off }) - 1
+	if i < 0 || i+1 >= len(md.ftab) || uintptr(md.ftab[i].entry) != off {
+		return 0
+	}
+	return int(uintptr(md.ftab[i+1].entry) - off)
+}
+
+// patchText overwrites the code at addr with the world stopped, returning the code it replaced. Nothing is patched if
+// any goroutine would resume within the overwritten code (which is checked while the world is stopped), in which case
+// those goroutines are returned instead.
+func patchText(addr uintptr, code []byte) ([]byte, []int64, error) {
+	var pages [][]byte
+	for p := addr; p < addr+uintptr(len(code)); {
+		page := mprotect.GetPage(p)
+		pages = append(pages, page)
+		p = uintptr(unsafe.Pointer(&page[0])) + uintptr(len(page))
+	}
+	for _, page := range pages {
+		if err := mprotect.MprotectMakeWritableExecutable(page); err != nil {
+			return nil, nil, fmt.Errorf("failed to make page at %p writeable: %w", &page[0], err)
+		}
+	}
+	text := (*[1 << 30]byte)(unsafe.Pointer(addr))[:len(code):len(code)]
+	original := append([]byte(nil), text...)
+
+	frames := framesWithin(addr, addr+uintptr(len(code)), func() {
+		copy(text, code)
+		MakeThreadJITCodeExecutable(addr, len(code))
+	})
+
+	for _, page := range pages {
+		if err := mprotect.MprotectMakeExecutable(page); err != nil {
+			return original, nil, fmt.Errorf("failed to make page at %p executable: %w", &page[0], err)
+		}
+	}
+	if len(frames) > 0 {
+		return nil, goroutineIDs(frames), nil
+	}
+	return original, nil, nil
+}
@@ -0,0 +1,134 @@
+package goloader
+
+import (
+	"runtime"
+	"sync/atomic"
+	_ "unsafe"
+)
+
+// g mirrors the start of the runtime's goroutine struct (which is the same in Go 1.18 to 1.22),
+// see $GOROOT/src/runtime/runtime2.go
+type g struct {
+	stack        [2]uintptr
+	stackguard0  uintptr
+	stackguard1  uintptr
+	_panic       uintptr
+	_defer       uintptr
+	m            uintptr
+	sched        [7]uintptr // gobuf
+	syscallsp    uintptr
+	syscallpc    uintptr
+	stktopsp     uintptr
+	param        uintptr
+	atomicstatus uint32
+	stackLock    uint32
+	goid         int64
+}
+
+// Goroutine statuses, see $GOROOT/src/runtime/runtime2.go
+const (
+	_Grunnable  = 1
+	_Grunning   = 2
+	_Gsyscall   = 3
+	_Gwaiting   = 4
+	_Gpreempted = 9
+	_Gscan      = 0x1000
+)
+
+//go:linkname forEachG runtime.forEachG
+func forEachG(fn func(gp *g))
+
+// goroutineFrame is a frame of a goroutine, which will resume at pc
+type goroutineFrame struct {
+	goid int64
+	pc   uintptr
+}
+
+// stackScan finds the frames of all goroutines which will resume within [start, end), by unwinding their stacks with
+// the runtime's traceback. It runs with the world stopped, so everything it needs is allocated up front.
+type stackScan struct {
+	start, end uintptr
+	callerPCs  []uintptr // The stack of the goroutine running the scan, which can't unwind itself
+	frames     []goroutineFrame
+	overflow   bool
+	goid       int64
+	visitFunc  func(gp *g)
+}
+
+// newStackScan prepares a scan for frames within [start, end), with room for capacity of them
+func newStackScan(start, end uintptr, capacity int) *stackScan {
+	s := &stackScan{start: start, end: end, frames: make([]goroutineFrame, 0, capacity)}
+	s.callerPCs = make([]uintptr, 64)
+	for {
+		n := runtime.Callers(1, s.callerPCs)
+		if n < len(s.callerPCs) {
+			s.callerPCs = s.callerPCs[:n]
+			break
+		}
+		s.callerPCs = make([]uintptr, 2*len(s.callerPCs))
+	}
+	s.visitFunc = s.visit
+	return s
+}
+
+// run collects the frames, and must be called with the world stopped, on the goroutine which created the scan.
+// It returns false if there were more frames than the scan has room for, in which case it must be rerun with more.
+func (s *stackScan) run() bool {
+	forEachG(s.visitFunc)
+	return !s.overflow
+}
+
+func (s *stackScan) visit(gp *g) {
+	s.goid = gp.goid
+	switch atomic.LoadUint32(&gp.atomicstatus) &^ _Gscan {
+	case _Grunning:
+		// Only the goroutine running the scan is running while the world is stopped
+		for _, pc := range s.callerPCs {
+			s.frame(pc)
+		}
+	case _Grunnable, _Gsyscall, _Gwaiting, _Gpreempted:
+		s.traceback(gp)
+	}
+}
+
+func (s *stackScan) frame(pc uintptr) {
+	if pc < s.start || pc >= s.end {
+		return
+	}
+	if len(s.frames) == cap(s.frames) {
+		s.overflow = true
+		return
+	}
+	s.frames = append(s.frames, goroutineFrame{goid: s.goid, pc: pc})
+}
+
+// framesWithin returns the frames of all goroutines which will resume within [start, end), grouped by goroutine and
+// innermost first. If there are none and ifNone isn't nil, it's called before the world is restarted, so that no
+// goroutine can move into the range first - it must not allocate or block.
+func framesWithin(start, end uintptr, ifNone func()) []goroutineFrame {
+	capacity := 1024
+	for {
+		s := newStackScan(start, end, capacity)
+		stopTheWorld()
+		ok := s.run()
+		if ok && len(s.frames) == 0 && ifNone != nil {
+			ifNone()
+		}
+		startTheWorld()
+		if ok {
+			return s.frames
+		}
+		capacity *= 2
+	}
+}
+
+// goroutineIDs returns the distinct goroutines of frames, in order
+func goroutineIDs(frames []goroutineFrame) []int64 {
+	var ids []int64
+	for _, f := range frames {
+		if len(ids) == 0 || ids[len(ids)-1] != f.goid {
+			ids = append(ids, f.goid)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,24 @@
+//go:build go1.18 && !go1.21
+// +build go1.18,!go1.21
+
+package goloader
+
+import (
+	_ "unsafe"
+)
+
+//go:linkname runtimeStopTheWorld runtime.stopTheWorld
+func runtimeStopTheWorld(reason string)
+
+//go:linkname runtimeStartTheWorld runtime.startTheWorld
+func runtimeStartTheWorld()
+
+// stopTheWorld stops all other goroutines at safe points until startTheWorld is called.
+// Nothing in between may allocate or block.
+func stopTheWorld() {
+	runtimeStopTheWorld("goloader")
+}
+
+func startTheWorld() {
+	runtimeStartTheWorld()
+}
@@ -0,0 +1,29 @@
+//go:build go1.21 && !go1.22
+// +build go1.21,!go1.22
+
+package goloader
+
+import (
+	_ "unsafe"
+)
+
+// stwReason mirrors the runtime's, see $GOROOT/src/runtime/proc.go
+type stwReason uint8
+
+const stwUnknown stwReason = 0
+
+//go:linkname runtimeStopTheWorld runtime.stopTheWorld
+func runtimeStopTheWorld(reason stwReason)
+
+//go:linkname runtimeStartTheWorld runtime.startTheWorld
+func runtimeStartTheWorld()
+
+// stopTheWorld stops all other goroutines at safe points until startTheWorld is called.
+// Nothing in between may allocate or block.
+func stopTheWorld() {
+	runtimeStopTheWorld(stwUnknown)
+}
+
+func startTheWorld() {
+	runtimeStartTheWorld()
+}
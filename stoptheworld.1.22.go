@@ -0,0 +1,37 @@
+//go:build go1.22 && !go1.23
+// +build go1.22,!go1.23
+
+package goloader
+
+import (
+	_ "unsafe"
+)
+
+// stwReason and worldStop mirror the runtime's, see $GOROOT/src/runtime/proc.go
+type stwReason uint8
+
+const stwUnknown stwReason = 0
+
+type worldStop struct {
+	reason stwReason
+	start  int64
+}
+
+//go:linkname runtimeStopTheWorld runtime.stopTheWorld
+func runtimeStopTheWorld(reason stwReason) worldStop
+
+//go:linkname runtimeStartTheWorld runtime.startTheWorld
+func runtimeStartTheWorld(w worldStop)
+
+// stoppedWorld is only accessed between stopTheWorld and startTheWorld, which are serialised by the runtime
+var stoppedWorld worldStop
+
+// stopTheWorld stops all other goroutines at safe points until startTheWorld is called.
+// Nothing in between may allocate or block.
+func stopTheWorld() {
+	stoppedWorld = runtimeStopTheWorld(stwUnknown)
+}
+
+func startTheWorld() {
+	runtimeStartTheWorld(stoppedWorld)
+}
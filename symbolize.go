@@ -0,0 +1,137 @@
+//go:build go1.18
+// +build go1.18
+
+package goloader
+
+import (
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PCInfo describes the code at a PC within a loaded module, see LookupPC
+type PCInfo struct {
+	Module     *CodeModule
+	Label      string    // The module's label, see CodeModule.Label
+	ImportPath string    // Import path of the module's main package
+	LoadTime   time.Time // When the module was loaded
+	Function   string    // Symbol of the (outermost) function containing the PC
+	Entry      uintptr   // Entry address of Function
+	Frames     []SourceFrame
+}
+
+// SourceFrame is a source position of a PC. A PC within inlined code has a frame for each inlined call.
+type SourceFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// FunctionInfo describes a function in a loaded module, see CodeModule.Functions
+type FunctionInfo struct {
+	Name  string
+	Entry uintptr
+	Size  int
+	File  string // Position of the function's entry
+	Line  int
+}
+
+// LookupPC finds the loaded module whose code contains pc (e.g. from a crash report or a profiler sample), and
+// symbolizes it. Frames are ordered innermost first, expanding any calls inlined at pc into its function using the
+// module's inline tree, the last frame being in Function. It returns false if pc isn't within any loaded module.
+func LookupPC(pc uintptr) (*PCInfo, bool) {
+	cm := moduleForPC(pc)
+	if cm == nil {
+		return nil, false
+	}
+	f := findfunc(pc)
+	if f._func == nil {
+		return nil, false
+	}
+	fn := runtime.FuncForPC(pc)
+	info := &PCInfo{
+		Module:     cm,
+		Label:      cm.label,
+		ImportPath: cm.importPath,
+		LoadTime:   cm.loadTime,
+		Function:   funcname(f),
+		Entry:      fn.Entry(),
+	}
+	// CallersFrames expects return addresses, which it steps back into the call instruction, so it's given pc+1 unless
+	// that's outside the function
+	if next := runtime.FuncForPC(pc + 1); next == nil || next.Entry() != info.Entry {
+		file, line := fn.FileLine(pc)
+		info.Frames = append(info.Frames, SourceFrame{Function: fn.Name(), File: file, Line: line})
+		return info, true
+	}
+	frames := runtime.CallersFrames([]uintptr{pc + 1})
+	for {
+		frame, more := frames.Next()
+		info.Frames = append(info.Frames, SourceFrame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		if !more {
+			break
+		}
+	}
+	return info, true
+}
+
+// Functions returns every function in the module's text, ordered by address, or nil if the module has been unloaded
+func (cm *CodeModule) Functions() []FunctionInfo {
+	md := cm.module
+	if md == nil || atomic.LoadInt32(&cm.unloaded) != 0 {
+		return nil
+	}
+	var funcs []FunctionInfo
+	// The last functab entry marks the end of the text
+	for i := 0; i+1 < len(md.ftab); i++ {
+		entry, next := uintptr(md.ftab[i].entry), uintptr(md.ftab[i+1].entry)
+		if entry == next {
+			// The first entry duplicates the first function's if it starts at the module's minpc
+			continue
+		}
+		fn := runtime.FuncForPC(md.text + entry)
+		if fn == nil {
+			continue
+		}
+		file, line := fn.FileLine(md.text + entry)
+		funcs = append(funcs, FunctionInfo{
+			Name:  fn.Name(),
+			Entry: md.text + entry,
+			Size:  int(next - entry),
+			File:  file,
+			Line:  line,
+		})
+	}
+	return funcs
+}
+
+// ImportPath returns the import path of the module's main package
+func (cm *CodeModule) ImportPath() string {
+	return cm.importPath
+}
+
+// LoadTime returns when the module was loaded
+func (cm *CodeModule) LoadTime() time.Time {
+	return cm.loadTime
+}
+
+// UnloadTime returns when the module was unloaded, or the zero time if it's still loaded
+func (cm *CodeModule) UnloadTime() time.Time {
+	if t := atomic.LoadInt64(&cm.unloadTime); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// LoadedModules returns all currently loaded modules, ordered by load time
+func LoadedModules() []*CodeModule {
+	modulesLock.Lock()
+	loaded := make([]*CodeModule, 0, len(modules))
+	for cm := range modules {
+		loaded = append(loaded, cm)
+	}
+	modulesLock.Unlock()
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].loadTime.Before(loaded[j].loadTime) })
+	return loaded
+}
@@ -0,0 +1,27 @@
+//go:build go1.18 && !go1.21
+// +build go1.18,!go1.21
+
+package goloader
+
+import (
+	"unsafe"
+)
+
+// stkframe mirrors the start of the runtime's, see $GOROOT/src/runtime/traceback.go
+type stkframe struct {
+	fn funcInfo
+	pc uintptr
+}
+
+//go:linkname gentraceback runtime.gentraceback
+func gentraceback(pc0, sp0, lr0 uintptr, gp *g, skip int, pcbuf *uintptr, max int, callback func(*stkframe, unsafe.Pointer) bool, v unsafe.Pointer, flags uint) int
+
+func tracebackFrame(frame *stkframe, v unsafe.Pointer) bool {
+	(*stackScan)(v).frame(frame.pc)
+	return true
+}
+
+// traceback passes the PC of each of a stopped goroutine's frames to s.frame, innermost first
+func (s *stackScan) traceback(gp *g) {
+	gentraceback(^uintptr(0), ^uintptr(0), 0, gp, 0, nil, 0x7fffffff, tracebackFrame, unsafe.Pointer(s), 0)
+}
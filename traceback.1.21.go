@@ -0,0 +1,48 @@
+//go:build go1.21 && !go1.23
+// +build go1.21,!go1.23
+
+package goloader
+
+import (
+	_ "unsafe"
+)
+
+// stkframe and unwinder mirror the runtime's, see $GOROOT/src/runtime/traceback.go
+type stkframe struct {
+	fn       funcInfo
+	pc       uintptr
+	continpc uintptr
+	lr       uintptr
+	sp       uintptr
+	fp       uintptr
+	varp     uintptr
+	argp     uintptr
+}
+
+type unwindFlags uint8
+
+const unwindSilentErrors unwindFlags = 1 << 1
+
+type unwinder struct {
+	frame        stkframe
+	g            uintptr
+	cgoCtxt      int
+	calleeFuncID uint8
+	flags        unwindFlags
+}
+
+//go:noescape
+//go:linkname unwinderInitAt runtime.(*unwinder).initAt
+func unwinderInitAt(u *unwinder, pc0, sp0, lr0 uintptr, gp *g, flags unwindFlags)
+
+//go:noescape
+//go:linkname unwinderNext runtime.(*unwinder).next
+func unwinderNext(u *unwinder)
+
+// traceback passes the PC of each of a stopped goroutine's frames to s.frame, innermost first
+func (s *stackScan) traceback(gp *g) {
+	var u unwinder
+	for unwinderInitAt(&u, ^uintptr(0), ^uintptr(0), ^uintptr(0), gp, unwindSilentErrors); u.frame.pc != 0; unwinderNext(&u) {
+		s.frame(u.frame.pc)
+	}
+}
@@ -0,0 +1,144 @@
+//go:build go1.18
+// +build go1.18
+
+package goloader
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// TypeMismatchError describes how two types which are not equal (according to the same rules as
+// ConvertTypesAcrossModules) differ, e.g. parameter by parameter for funcs, or field by field for structs
+type TypeMismatchError struct {
+	Expected    reflect.Type
+	Actual      reflect.Type
+	Differences []string
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("expected type %s but got %s:\n\t%s", e.Expected, e.Actual, strings.Join(e.Differences, "\n\t"))
+}
+
+// TypeMismatch returns nil if expected and actual are equal types (even if defined in different modules),
+// otherwise a *TypeMismatchError describing the differences
+func TypeMismatch(expected, actual reflect.Type) error {
+	if expected == nil || actual == nil {
+		if expected == actual {
+			return nil
+		}
+		return &TypeMismatchError{Expected: expected, Actual: actual, Differences: []string{fmt.Sprintf("expected %v, got %v", expected, actual)}}
+	}
+	if rtypesEqual(expected, actual) {
+		return nil
+	}
+	differences := describeTypeDifferences(nil, expected, actual, map[[2]reflect.Type]struct{}{})
+	if len(differences) == 0 {
+		differences = []string{fmt.Sprintf("expected %s, got %s", expected, actual)}
+	}
+	return &TypeMismatchError{Expected: expected, Actual: actual, Differences: differences}
+}
+
+func rtypesEqual(t, v reflect.Type) bool {
+	seen := map[_typePair]struct{}{}
+	return typesEqual(fromRType(t), fromRType(v), seen)
+}
+
+func typeDifference(path []string, format string, args ...interface{}) string {
+	if len(path) == 0 {
+		return fmt.Sprintf(format, args...)
+	}
+	return strings.Join(path, ", ") + ": " + fmt.Sprintf(format, args...)
+}
+
+func describeTypeDifferences(path []string, expected, actual reflect.Type, visited map[[2]reflect.Type]struct{}) []string {
+	if rtypesEqual(expected, actual) {
+		return nil
+	}
+	// Recursive types which are unequal will already have reported their difference higher up
+	pair := [2]reflect.Type{expected, actual}
+	if _, ok := visited[pair]; ok {
+		return nil
+	}
+	visited[pair] = struct{}{}
+
+	within := func(elem string) []string {
+		return append(append([]string{}, path...), elem)
+	}
+
+	if expected.Kind() != actual.Kind() {
+		return []string{typeDifference(path, "expected %s (%s), got %s (%s)", expected, expected.Kind(), actual, actual.Kind())}
+	}
+	if expected.Name() != actual.Name() || expected.PkgPath() != actual.PkgPath() {
+		return []string{typeDifference(path, "expected %s, got %s", expected, actual)}
+	}
+
+	var differences []string
+	switch expected.Kind() {
+	case reflect.Func:
+		if expected.IsVariadic() != actual.IsVariadic() {
+			differences = append(differences, typeDifference(path, "expected variadic=%t, got variadic=%t", expected.IsVariadic(), actual.IsVariadic()))
+		}
+		if expected.NumIn() != actual.NumIn() {
+			differences = append(differences, typeDifference(path, "expected %d parameter(s), got %d", expected.NumIn(), actual.NumIn()))
+		}
+		for i := 0; i < expected.NumIn() && i < actual.NumIn(); i++ {
+			differences = append(differences, describeTypeDifferences(within(fmt.Sprintf("parameter %d", i)), expected.In(i), actual.In(i), visited)...)
+		}
+		if expected.NumOut() != actual.NumOut() {
+			differences = append(differences, typeDifference(path, "expected %d result(s), got %d", expected.NumOut(), actual.NumOut()))
+		}
+		for i := 0; i < expected.NumOut() && i < actual.NumOut(); i++ {
+			differences = append(differences, describeTypeDifferences(within(fmt.Sprintf("result %d", i)), expected.Out(i), actual.Out(i), visited)...)
+		}
+	case reflect.Struct:
+		if expected.NumField() != actual.NumField() {
+			differences = append(differences, typeDifference(path, "expected %d field(s), got %d", expected.NumField(), actual.NumField()))
+		}
+		for i := 0; i < expected.NumField() && i < actual.NumField(); i++ {
+			expectedField, actualField := expected.Field(i), actual.Field(i)
+			fieldPath := within("field " + expectedField.Name)
+			switch {
+			case expectedField.Name != actualField.Name:
+				differences = append(differences, typeDifference(path, "field %d: expected name %s, got %s", i, expectedField.Name, actualField.Name))
+			case expectedField.Anonymous != actualField.Anonymous:
+				differences = append(differences, typeDifference(fieldPath, "expected embedded=%t, got embedded=%t", expectedField.Anonymous, actualField.Anonymous))
+			case expectedField.Tag != actualField.Tag:
+				differences = append(differences, typeDifference(fieldPath, "expected tag %q, got %q", expectedField.Tag, actualField.Tag))
+			}
+			differences = append(differences, describeTypeDifferences(fieldPath, expectedField.Type, actualField.Type, visited)...)
+		}
+	case reflect.Interface:
+		for i := 0; i < expected.NumMethod(); i++ {
+			expectedMethod := expected.Method(i)
+			actualMethod, ok := actual.MethodByName(expectedMethod.Name)
+			if !ok {
+				differences = append(differences, typeDifference(path, "missing method %s", expectedMethod.Name))
+				continue
+			}
+			differences = append(differences, describeTypeDifferences(within("method "+expectedMethod.Name), expectedMethod.Type, actualMethod.Type, visited)...)
+		}
+		for i := 0; i < actual.NumMethod(); i++ {
+			if _, ok := expected.MethodByName(actual.Method(i).Name); !ok {
+				differences = append(differences, typeDifference(path, "unexpected method %s", actual.Method(i).Name))
+			}
+		}
+	case reflect.Array:
+		if expected.Len() != actual.Len() {
+			differences = append(differences, typeDifference(path, "expected array length %d, got %d", expected.Len(), actual.Len()))
+		}
+		differences = append(differences, describeTypeDifferences(within("element"), expected.Elem(), actual.Elem(), visited)...)
+	case reflect.Chan:
+		if expected.ChanDir() != actual.ChanDir() {
+			differences = append(differences, typeDifference(path, "expected channel direction %s, got %s", expected.ChanDir(), actual.ChanDir()))
+		}
+		differences = append(differences, describeTypeDifferences(within("element"), expected.Elem(), actual.Elem(), visited)...)
+	case reflect.Map:
+		differences = append(differences, describeTypeDifferences(within("key"), expected.Key(), actual.Key(), visited)...)
+		differences = append(differences, describeTypeDifferences(within("value"), expected.Elem(), actual.Elem(), visited)...)
+	case reflect.Ptr, reflect.Slice:
+		differences = append(differences, describeTypeDifferences(within("element"), expected.Elem(), actual.Elem(), visited)...)
+	}
+	return differences
+}